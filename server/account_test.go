@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func loginTestPasswd(user *User, passwd string) *RestAPIError {
+	respChan := make(chan LoginResponse)
+	user.Login <- LoginRequest{Passwd: hash(passwd), Response: respChan}
+	return (<-respChan).Err
+}
+
+func TestChangePasswd(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+
+	_, err := changePasswd_restAPI_handler(alice, TEST_DEVICE, ChangePasswdRequest{
+		OldPasswd: hash("wrong"),
+		NewPasswd: hash("new"),
+	})
+	if err == nil || err.Code != http.StatusForbidden {
+		t.Fatalf("wrong old password: %v", err)
+	}
+
+	resp, err := changePasswd_restAPI_handler(alice, TEST_DEVICE, ChangePasswdRequest{
+		OldPasswd: hash("passwd of alice"),
+		NewPasswd: hash("new"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The device making the request stays logged in
+	if restAPIerr := authorizeTestBearer(resp.Bearer); restAPIerr != nil {
+		t.Errorf("new bearer rejected: %s", restAPIerr)
+	}
+
+	if err := loginTestPasswd(alice, "passwd of alice"); err == nil {
+		t.Error("old password accepted")
+	}
+	if err := loginTestPasswd(alice, "new"); err != nil {
+		t.Errorf("new password rejected: %s", err)
+	}
+
+	// The new password is saved
+	saved, loadErr := storage.loadUser(alice.Id)
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	if ok, _ := saved.check_passwd(hash("new")); !ok {
+		t.Error("new password not saved")
+	}
+}
+
+func TestChangePasswdClosesStreams(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	sub := subscribeTestStream(t, alice).Subscriber
+
+	_, err := changePasswd_restAPI_handler(alice, TEST_DEVICE, ChangePasswdRequest{
+		OldPasswd: hash("passwd of alice"),
+		NewPasswd: hash("new"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sub.Done:
+	case <-time.After(5 * time.Second):
+		t.Error("stream still open")
+	}
+}
+
+func TestChangePasswdEmpty(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	_, err := changePasswd_restAPI_handler(alice, TEST_DEVICE, ChangePasswdRequest{OldPasswd: hash("passwd of alice")})
+	if err == nil || err.Code != http.StatusBadRequest {
+		t.Errorf("empty password: %v", err)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	addTestUser(t, "bob")
+	waiter := startTestRecv(alice, 10)
+	// Let it park
+	time.Sleep(100 * time.Millisecond)
+
+	_, err := deleteAccount_restAPI_handler(alice, TEST_DEVICE, DeleteAccountRequest{Passwd: hash("wrong")})
+	if err == nil || err.Code != http.StatusForbidden {
+		t.Fatalf("wrong password: %v", err)
+	}
+
+	_, err = deleteAccount_restAPI_handler(alice, TEST_DEVICE, DeleteAccountRequest{Passwd: hash("passwd of alice")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The parked `recv` is released and later requests fail
+	waitTestRecv(t, waiter)
+	_, err = recv_restAPI_handler(context.Background(), alice, TEST_DEVICE, RecvRequest{})
+	if err == nil || err.Code != http.StatusServiceUnavailable {
+		t.Errorf("recv after delete: %v", err)
+	}
+
+	if usersList.Load().userByName("alice") != nil || usersList.Load().userByName("bob") == nil {
+		t.Error("users list not updated")
+	}
+	usernames, loadErr := storage.loadUsernames()
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	if !maps.Equal(usernames, map[string]uint64{"bob": usersList.Load().name_map["bob"]}) {
+		t.Errorf("stored users: %v", usernames)
+	}
+}
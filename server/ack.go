@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Acknowledges messages received through `/api/stream`.
+// Clients using `/api/recv` can send the acknowledgement as part of the next `recv` request.
+
+type AckRequest struct {
+	// All messages with `seq <= Seq` are removed from the inbox
+	Seq uint64 `json:"seq"`
+
+	Device   uint64             `json:"-"`
+	Response chan<- AckResponse `json:"-"`
+}
+
+type AckResponse struct {
+	Err *RestAPIError `json:"-"`
+}
+
+func ack_http_handler(w http.ResponseWriter, r *http.Request) {
+	restAPI_handler(w, r, "ack", 512, ack_restAPI_handler)
+}
+
+func ack_restAPI_handler(user *User, device uint64, req AckRequest) (AckResponse, *RestAPIError) {
+	respChan := make(chan AckResponse)
+	defer close(respChan)
+
+	req.Device = device
+	req.Response = respChan
+
+	resp, ok := callUserHandler(user, user.Ack, req, respChan)
+	if !ok {
+		return AckResponse{}, errUserStopped("ack")
+	}
+
+	return resp, resp.Err
+}
+
+func ack_synchronized_handler(user *User, req AckRequest) AckResponse {
+	device, err := user.deviceOrError(req.Device)
+	if err != nil {
+		return AckResponse{Err: err}
+	}
+	return AckResponse{
+		Err: device.Inbox.ack(req.Seq),
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func recvTest(t *testing.T, user *User, ack *uint64) RecvResponse {
+	t.Helper()
+	resp, err := recv_restAPI_handler(context.Background(), user, TEST_DEVICE, RecvRequest{Ack: ack})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func ackTest(t *testing.T, user *User, seq uint64) {
+	t.Helper()
+	if _, err := ack_restAPI_handler(user, TEST_DEVICE, AckRequest{Seq: seq}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecvAck(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	putTestMessage(t, alice, "bob", "a")
+	putTestMessage(t, alice, "bob", "b")
+
+	var none uint64
+	resp := recvTest(t, alice, &none)
+	if got := messagePayloads(resp.Items); !slices.Equal(got, []string{"a", "b"}) {
+		t.Fatalf("got %v", got)
+	}
+	if resp.Cursor != resp.Items[1].Seq || resp.Items[0].Seq >= resp.Items[1].Seq {
+		t.Errorf("cursor %d, seqs %d %d", resp.Cursor, resp.Items[0].Seq, resp.Items[1].Seq)
+	}
+
+	// Not acknowledged yet, e.g., the response was lost
+	if got := messagePayloads(recvTest(t, alice, &none).Items); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("before ack: %v", got)
+	}
+
+	putTestMessage(t, alice, "bob", "c")
+	if got := messagePayloads(recvTest(t, alice, &resp.Cursor).Items); !slices.Equal(got, []string{"c"}) {
+		t.Errorf("after ack: %v", got)
+	}
+}
+
+func TestRecvWithoutAckRemoves(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	putTestMessage(t, alice, "bob", "a")
+
+	if got := messagePayloads(recvTest(t, alice, nil).Items); !slices.Equal(got, []string{"a"}) {
+		t.Fatalf("got %v", got)
+	}
+	if got := recvTest(t, alice, nil).Items; len(got) != 0 {
+		t.Errorf("returned again: %v", messagePayloads(got))
+	}
+}
+
+func TestAckBeyondNextSeq(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	putTestMessage(t, alice, "bob", "a")
+
+	// The client cannot acknowledge messages that don't exist yet
+	ackTest(t, alice, 5)
+	putTestMessage(t, alice, "bob", "b")
+	var none uint64
+	if got := messagePayloads(recvTest(t, alice, &none).Items); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("got %v", got)
+	}
+}
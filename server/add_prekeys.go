@@ -7,6 +7,7 @@ import (
 type AddPrekeysRequest struct {
 	Prekeys []string `json:"prekeys"`
 
+	Device   uint64                    `json:"-"`
 	Response chan<- AddPrekeysResponse `json:"-"`
 }
 
@@ -20,32 +21,85 @@ func addPrekeys_http_handler(w http.ResponseWriter, r *http.Request) {
 	restAPI_handler(w, r, "addPrekeys", 16384, addPrekeys_restAPI_handler)
 }
 
-func addPrekeys_restAPI_handler(user *User, req AddPrekeysRequest) (AddPrekeysResponse, *RestAPIError) {
+func addPrekeys_restAPI_handler(user *User, device uint64, req AddPrekeysRequest) (AddPrekeysResponse, *RestAPIError) {
 	respChan := make(chan AddPrekeysResponse)
 	defer close(respChan)
 
+	req.Device = device
 	req.Response = respChan
 
-	user.AddPrekeys <- req
-	resp := <-respChan
+	resp, ok := callUserHandler(user, user.AddPrekeys, req, respChan)
+	if !ok {
+		return AddPrekeysResponse{}, errUserStopped("addPrekeys")
+	}
 
 	return resp, resp.Err
 }
 
 func addPrekeys_synchronized_handler(user *User, req AddPrekeysRequest) AddPrekeysResponse {
-	if len(user.Prekeys)+len(req.Prekeys) > PREKEY_MAX_COUNT {
+	device, restAPIerr := user.deviceOrError(req.Device)
+	if restAPIerr != nil {
+		return AddPrekeysResponse{Err: restAPIerr}
+	}
+
+	if len(device.Prekeys)+len(req.Prekeys) > PREKEY_MAX_COUNT {
 		return AddPrekeysResponse{
-			LivePrekeys: user.Prekeys,
+			LivePrekeys: device.Prekeys,
 			Err:         nil,
 		}
 	}
 
-	user.Prekeys = append(user.Prekeys, req.Prekeys...)
+	oldCount := len(device.Prekeys)
+	device.Prekeys = append(device.Prekeys, req.Prekeys...)
 
-	_ = user.save()
+	err := user.save()
+	if err != nil {
+		device.Prekeys = device.Prekeys[:oldCount]
+		return AddPrekeysResponse{
+			Err: NewError("addPrekeys: saving user: "+err.Error(), http.StatusInternalServerError),
+		}
+	}
 
 	return AddPrekeysResponse{
-		LivePrekeys: user.Prekeys,
+		LivePrekeys: device.Prekeys,
 		Err:         nil,
 	}
 }
+
+// Used by handlers that report `needPrekeys` to the client, but otherwise don't need
+// to access the user's data.
+type NeedPrekeysRequest struct {
+	Device   uint64
+	Response chan<- NeedPrekeysResponse
+}
+
+type NeedPrekeysResponse struct {
+	NeedPrekeys bool
+	Err         *RestAPIError
+}
+
+func needPrekeys(user *User, device uint64) (bool, *RestAPIError) {
+	respChan := make(chan NeedPrekeysResponse)
+	defer close(respChan)
+
+	req := NeedPrekeysRequest{
+		Device:   device,
+		Response: respChan,
+	}
+	resp, ok := callUserHandler(user, user.NeedPrekeys, req, respChan)
+	if !ok {
+		return false, errUserStopped("needPrekeys")
+	}
+
+	return resp.NeedPrekeys, resp.Err
+}
+
+func needPrekeys_synchronized_handler(user *User, req NeedPrekeysRequest) NeedPrekeysResponse {
+	device, err := user.deviceOrError(req.Device)
+	if err != nil {
+		return NeedPrekeysResponse{Err: err}
+	}
+	return NeedPrekeysResponse{
+		NeedPrekeys: device.needPrekeys(),
+	}
+}
@@ -0,0 +1,845 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// API for managing the running server, served on the admin listener next to `/metrics`.
+// The commands in `cli.go` are built on it: they call the same handlers, either in the
+// running server or, if there is none, in their own process. See `AdminClient`.
+//
+// Every request must carry `Authorization: Bearer <token>`, where the token is the content
+// of `ADMIN_TOKEN_FILE` in the app directory. It's created on the first start.
+// The user bearers don't work here.
+//
+// Like the client API, requests and responses are JSON. Changes to the users index go through
+// `GlobalLock` and swap `usersList`, like `reg_http_handler()`. Changes to a user are done by
+// its `user_handler()`, see `AdminRequest`. Invitations are in the `ServerState`.
+
+const ADMIN_TOKEN_FILE = "secrets/admin.token"
+const ADMIN_MAX_REQUEST_SIZE = 4096
+
+var adminToken []byte
+
+var serverStarted = time.Now()
+
+// Reads the admin token, or creates it if it doesn't exist yet
+func loadAdminToken(appDir string) error {
+	file := appFile(appDir, ADMIN_TOKEN_FILE)
+	token, err := os.ReadFile(file)
+	if err == nil {
+		adminToken = []byte(strings.TrimSpace(string(token)))
+		if len(adminToken) == 0 {
+			return fmt.Errorf("%s is empty", file)
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	tokenBytes, err := randBytes(32)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+	token = []byte(base64Encode(tokenBytes))
+	err = writeFileAtomic(file, append(token, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+	adminToken = token
+	Log.i("Created admin token in %s", file)
+	return nil
+}
+
+func authorizeAdmin(r *http.Request, handlerName string) *RestAPIError {
+	authHeader := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if authHeader == token || subtle.ConstantTimeCompare([]byte(token), adminToken) != 1 {
+		return NewError(handlerName+": authorization: invalid admin token", http.StatusUnauthorized)
+	}
+	return nil
+}
+
+// Like `restAPI_handler()`, but for the admin API. An empty body is the same as `{}`.
+func admin_handler[
+	Request any,
+	Response any,
+](
+	w http.ResponseWriter,
+	r *http.Request,
+
+	handlerName string,
+	handler func(ctx context.Context, req Request) (Response, *RestAPIError),
+) {
+	handlerName = "admin/" + handlerName
+	w, done := meterRequest(w, handlerName)
+	defer done()
+	startRequest(w, r, handlerName)
+	r.Body = http.MaxBytesReader(w, r.Body, ADMIN_MAX_REQUEST_SIZE)
+
+	restAPIerr := authorizeAdmin(r, handlerName)
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
+	var req Request
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		msg := handlerName + ": decoding request: " + err.Error()
+		restAPIerror(w, NewError(msg, http.StatusBadRequest))
+		return
+	}
+
+	resp, restAPIerr := handler(r.Context(), req)
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(&resp)
+	if err != nil {
+		msg := handlerName + ": encoding response: " + err.Error()
+		restAPIerror(w, NewError(msg, http.StatusInternalServerError))
+		return
+	}
+}
+
+func registerAdminHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/invite", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "invite", adminInvite_handler)
+	})
+	mux.HandleFunc("/admin/createUser", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "createUser", adminCreateUser_handler)
+	})
+	mux.HandleFunc("/admin/disableUser", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "disableUser", adminUserOp_handler(ADMIN_OP_DISABLE))
+	})
+	mux.HandleFunc("/admin/enableUser", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "enableUser", adminUserOp_handler(ADMIN_OP_ENABLE))
+	})
+	mux.HandleFunc("/admin/logoutUser", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "logoutUser", adminUserOp_handler(ADMIN_OP_LOGOUT))
+	})
+	mux.HandleFunc("/admin/deleteUser", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "deleteUser", adminDeleteUser_handler)
+	})
+	mux.HandleFunc("/admin/resetPasswd", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "resetPasswd", adminResetPasswd_handler)
+	})
+	mux.HandleFunc("/admin/users", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "users", adminUsers_handler)
+	})
+	mux.HandleFunc("/admin/user", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "user", adminUserInfo_handler)
+	})
+	mux.HandleFunc("/admin/invitations", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "invitations", adminInvitations_handler)
+	})
+	mux.HandleFunc("/admin/revokeInvitation", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "revokeInvitation", adminRevokeInvitation_handler)
+	})
+	mux.HandleFunc("/admin/expireInvitations", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "expireInvitations", adminExpireInvitations_handler)
+	})
+	mux.HandleFunc("/admin/rotateBearerKey", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "rotateBearerKey", adminRotateBearerKey_handler)
+	})
+	mux.HandleFunc("/admin/check", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "check", adminCheck_handler)
+	})
+	mux.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "stats", adminStats_handler)
+	})
+	mux.HandleFunc("/admin/gc", func(w http.ResponseWriter, r *http.Request) {
+		admin_handler(w, r, "gc", adminGC_handler)
+	})
+}
+
+// Operations on one user, done by its `user_handler()`
+
+const ADMIN_OP_DISABLE = "disable"
+const ADMIN_OP_ENABLE = "enable"
+const ADMIN_OP_LOGOUT = "logout"
+const ADMIN_OP_DELETE = "delete"
+const ADMIN_OP_GC = "gc"
+const ADMIN_OP_PASSWD = "passwd"
+
+type AdminRequest struct {
+	Op string
+
+	// For `ADMIN_OP_PASSWD`: the new password, as the client would send it
+	Passwd []byte
+
+	Response chan<- AdminResponse
+}
+
+type AdminResponse struct {
+	// For `ADMIN_OP_GC`: unacknowledged messages left in the inboxes
+	Devices  int
+	Messages int
+
+	Err *RestAPIError
+}
+
+func admin_synchronized_handler(user *User, req AdminRequest) AdminResponse {
+	switch req.Op {
+	case ADMIN_OP_DISABLE:
+		return adminSaveUser(user, func() {
+			user.Disabled = true
+			atomic.StoreInt64(&user.BearersValidAfter, bearersValidAfterNow())
+		})
+	case ADMIN_OP_ENABLE:
+		return adminSaveUser(user, func() { user.Disabled = false })
+	case ADMIN_OP_LOGOUT:
+		return adminSaveUser(user, func() {
+			atomic.StoreInt64(&user.BearersValidAfter, bearersValidAfterNow())
+		})
+	case ADMIN_OP_PASSWD:
+		oldSalt, oldPasswd, oldParams := user.Salt, user.Passwd, user.PasswdHash
+		err := user.set_passwd(req.Passwd)
+		if err != nil {
+			return AdminResponse{
+				Err: NewError("hashing password: "+err.Error(), http.StatusInternalServerError),
+			}
+		}
+		resp := adminSaveUser(user, func() {
+			atomic.StoreInt64(&user.BearersValidAfter, bearersValidAfterNow())
+		})
+		if resp.Err != nil {
+			user.Salt, user.Passwd, user.PasswdHash = oldSalt, oldPasswd, oldParams
+		}
+		return resp
+	case ADMIN_OP_DELETE:
+		err := storage.deleteUser(user)
+		if err != nil {
+			return AdminResponse{
+				Err: NewError("deleting user: "+err.Error(), http.StatusInternalServerError),
+			}
+		}
+		user.disconnectDevices()
+		Log.i("User deleted by admin: %s, ID: %s", redact(user.Username), redactId(user.Id))
+		return AdminResponse{}
+	case ADMIN_OP_GC:
+		// Reading an inbox removes its expired messages
+		now := monotonicSeconds()
+		resp := AdminResponse{}
+		for _, device := range user.Devices {
+			msgs, restAPIerr := device.Inbox.getMessages(now)
+			if restAPIerr != nil {
+				return AdminResponse{Err: restAPIerr}
+			}
+			resp.Devices++
+			resp.Messages += len(msgs)
+		}
+		return resp
+	default:
+		return AdminResponse{
+			Err: NewError("unknown admin operation: "+req.Op, http.StatusInternalServerError),
+		}
+	}
+}
+
+// Applies `change` and saves the user. If saving fails, the user is restored.
+// Parked `recv` requests and streams are released, so logged out devices notice right away.
+func adminSaveUser(user *User, change func()) AdminResponse {
+	oldDisabled := user.Disabled
+	oldValidAfter := atomic.LoadInt64(&user.BearersValidAfter)
+
+	change()
+	err := user.save()
+	if err != nil {
+		user.Disabled = oldDisabled
+		atomic.StoreInt64(&user.BearersValidAfter, oldValidAfter)
+		return AdminResponse{
+			Err: NewError("saving user: "+err.Error(), http.StatusInternalServerError),
+		}
+	}
+	if atomic.LoadInt64(&user.BearersValidAfter) != oldValidAfter {
+		user.disconnectDevices()
+	}
+	return AdminResponse{}
+}
+
+func callAdminOp(ctx context.Context, user *User, op string) (AdminResponse, bool) {
+	return callAdminRequest(ctx, user, AdminRequest{Op: op})
+}
+
+func callAdminRequest(ctx context.Context, user *User, req AdminRequest) (AdminResponse, bool) {
+	respChan := make(chan AdminResponse)
+	defer close(respChan)
+
+	req.Response = respChan
+	return callUserHandlerContext(ctx, user, user.Admin, req, respChan)
+}
+
+type AdminInviteRequest struct {
+	Count     int    `json:"count"`      // default 1
+	MaxUses   int    `json:"max_uses"`   // default 1
+	ExpireSec int64  `json:"expire_sec"` // default never
+	Note      string `json:"note"`
+}
+
+type AdminInviteResponse struct {
+	Invitations []string `json:"invitations"`
+}
+
+func adminInvite_handler(ctx context.Context, req AdminInviteRequest) (AdminInviteResponse, *RestAPIError) {
+	count := max(req.Count, 1)
+	if count > 1000 {
+		return AdminInviteResponse{}, NewError("admin/invite: too many invitations", http.StatusBadRequest)
+	}
+
+	now := monotonicSeconds()
+	invitations := make([]Invitation, 0, count)
+	codes := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		inv, err := newInvitation(0, req.MaxUses, req.ExpireSec, req.Note, now)
+		if err != nil {
+			return AdminInviteResponse{}, NewError("admin/invite: "+err.Error(), http.StatusInternalServerError)
+		}
+		invitations = append(invitations, inv)
+		codes = append(codes, inv.Code)
+	}
+
+	err := addInvitations(invitations, now)
+	if err != nil {
+		msg := "admin/invite: saving state: " + err.Error()
+		return AdminInviteResponse{}, NewError(msg, http.StatusInternalServerError)
+	}
+
+	Log.i("Admin created %d invitations", count)
+	return AdminInviteResponse{Invitations: codes}, nil
+}
+
+type AdminCreateUserRequest struct {
+	Username string `json:"username"`
+}
+
+type AdminCreateUserResponse struct {
+	// Random. Give it to the user, who should change it.
+	Passwd string `json:"passwd"`
+}
+
+func adminCreateUser_handler(ctx context.Context, req AdminCreateUserRequest) (AdminCreateUserResponse, *RestAPIError) {
+	err := validateUsername(req.Username)
+	if err != nil {
+		return AdminCreateUserResponse{}, NewError("admin/createUser: "+err.Error(), http.StatusBadRequest)
+	}
+
+	passwdBytes, err := randBytes(16)
+	if err != nil {
+		msg := "admin/createUser: generating password: " + err.Error()
+		return AdminCreateUserResponse{}, NewError(msg, http.StatusInternalServerError)
+	}
+	passwd := base64Encode(passwdBytes)
+
+	GlobalLock.Lock()
+	defer GlobalLock.Unlock()
+
+	oldUsers := usersList.Load()
+	if oldUsers.hasName(req.Username) {
+		return AdminCreateUserResponse{}, NewError("admin/createUser: user already exists", http.StatusConflict)
+	}
+
+	newUsers, err := addUser(oldUsers, req.Username, hash(passwd))
+	if err != nil {
+		msg := "admin/createUser: adding user: " + err.Error()
+		return AdminCreateUserResponse{}, NewError(msg, http.StatusInternalServerError)
+	}
+	usersList.Store(newUsers)
+	Log.i("User created by admin: %s", redact(req.Username))
+
+	return AdminCreateUserResponse{Passwd: passwd}, nil
+}
+
+type AdminUserRequest struct {
+	Username string `json:"username"`
+}
+
+type AdminUserResponse struct {
+}
+
+func adminUser(handlerName string, username string) (*User, *RestAPIError) {
+	user := usersList.Load().userByName(username)
+	if user == nil {
+		return nil, NewError(handlerName+": user not found", http.StatusNotFound)
+	}
+	return user, nil
+}
+
+// Disables, enables or logs out the user. Disabling also logs out.
+func adminUserOp_handler(op string) func(context.Context, AdminUserRequest) (AdminUserResponse, *RestAPIError) {
+	return func(ctx context.Context, req AdminUserRequest) (AdminUserResponse, *RestAPIError) {
+		handlerName := "admin/" + op
+		user, restAPIerr := adminUser(handlerName, req.Username)
+		if restAPIerr != nil {
+			return AdminUserResponse{}, restAPIerr
+		}
+		resp, ok := callAdminOp(ctx, user, op)
+		if !ok {
+			return AdminUserResponse{}, errUserStopped(handlerName)
+		}
+		if resp.Err != nil {
+			return AdminUserResponse{}, NewError(handlerName+": "+resp.Err.Err, resp.Err.Code)
+		}
+		Log.i("Admin: %s %s", op, redact(user.Username))
+		return AdminUserResponse{}, nil
+	}
+}
+
+func adminDeleteUser_handler(ctx context.Context, req AdminUserRequest) (AdminUserResponse, *RestAPIError) {
+	user, restAPIerr := adminUser("admin/deleteUser", req.Username)
+	if restAPIerr != nil {
+		return AdminUserResponse{}, restAPIerr
+	}
+
+	// On success, the `user_handler()` stops after sending the response
+	resp, ok := callAdminOp(ctx, user, ADMIN_OP_DELETE)
+	if !ok {
+		return AdminUserResponse{}, errUserStopped("admin/deleteUser")
+	}
+	if resp.Err != nil {
+		return AdminUserResponse{}, NewError("admin/deleteUser: "+resp.Err.Err, resp.Err.Code)
+	}
+
+	GlobalLock.Lock()
+	defer GlobalLock.Unlock()
+
+	usersList.Store(removeUser(usersList.Load(), user))
+	return AdminUserResponse{}, nil
+}
+
+type AdminStatsRequest struct {
+}
+
+type AdminStatsResponse struct {
+	UptimeSec            int64  `json:"uptime_sec"`
+	Users                int    `json:"users"`
+	LoadedUsers          int    `json:"loaded_users"`
+	Invitations          int    `json:"invitations"`
+	Goroutines           int    `json:"goroutines"`
+	InboxMessagesWritten uint64 `json:"inbox_messages_written"`
+	InboxMessagesRead    uint64 `json:"inbox_messages_read"`
+}
+
+func adminStats_handler(ctx context.Context, req AdminStatsRequest) (AdminStatsResponse, *RestAPIError) {
+	loadedUsers.mutex.Lock()
+	loaded := len(loadedUsers.users)
+	loadedUsers.mutex.Unlock()
+
+	state, err := storage.loadState()
+	if err != nil {
+		return AdminStatsResponse{}, NewError("admin/stats: loading state: "+err.Error(), http.StatusInternalServerError)
+	}
+	invitations := len(validInvitations(state.Invitations, monotonicSeconds()))
+
+	return AdminStatsResponse{
+		UptimeSec:            int64(time.Since(serverStarted).Seconds()),
+		Users:                len(usersList.Load().id_map),
+		LoadedUsers:          loaded,
+		Invitations:          invitations,
+		Goroutines:           runtime.NumGoroutine(),
+		InboxMessagesWritten: metrics.InboxMessagesWritten.value.Load(),
+		InboxMessagesRead:    metrics.InboxMessagesRead.value.Load(),
+	}, nil
+}
+
+type AdminGCRequest struct {
+}
+
+type AdminGCResponse struct {
+	Users    int `json:"users"`
+	Devices  int `json:"devices"`
+	Messages int `json:"messages"` // unacknowledged messages left
+	Errors   int `json:"errors"`
+}
+
+// Removes expired messages from the inboxes of all users. Inboxes are otherwise only
+// cleaned up when they are used, so this frees space taken by users who don't come back.
+// Users that are not loaded are loaded for it, and evicted later as usual.
+func adminGC_handler(ctx context.Context, req AdminGCRequest) (AdminGCResponse, *RestAPIError) {
+	resp := AdminGCResponse{}
+	for id := range usersList.Load().id_map {
+		if ctx.Err() != nil {
+			return resp, NewError("admin/gc: canceled", http.StatusServiceUnavailable)
+		}
+		user := getUser(id)
+		if user == nil {
+			// Deleted in the meantime
+			continue
+		}
+		userResp, ok := callAdminOp(ctx, user, ADMIN_OP_GC)
+		if !ok || userResp.Err != nil {
+			resp.Errors++
+			continue
+		}
+		resp.Users++
+		resp.Devices += userResp.Devices
+		resp.Messages += userResp.Messages
+	}
+	Log.i("Admin GC: %d users, %d devices, %d messages left, %d errors", resp.Users, resp.Devices, resp.Messages, resp.Errors)
+	return resp, nil
+}
+
+type AdminResetPasswdResponse struct {
+	// Random. Give it to the user, who should change it.
+	Passwd string `json:"passwd"`
+}
+
+// Sets a new random password and logs out all devices
+func adminResetPasswd_handler(ctx context.Context, req AdminUserRequest) (AdminResetPasswdResponse, *RestAPIError) {
+	user, restAPIerr := adminUser("admin/resetPasswd", req.Username)
+	if restAPIerr != nil {
+		return AdminResetPasswdResponse{}, restAPIerr
+	}
+
+	passwdBytes, err := randBytes(16)
+	if err != nil {
+		msg := "admin/resetPasswd: generating password: " + err.Error()
+		return AdminResetPasswdResponse{}, NewError(msg, http.StatusInternalServerError)
+	}
+	passwd := base64Encode(passwdBytes)
+
+	resp, ok := callAdminRequest(ctx, user, AdminRequest{Op: ADMIN_OP_PASSWD, Passwd: hash(passwd)})
+	if !ok {
+		return AdminResetPasswdResponse{}, errUserStopped("admin/resetPasswd")
+	}
+	if resp.Err != nil {
+		return AdminResetPasswdResponse{}, NewError("admin/resetPasswd: "+resp.Err.Err, resp.Err.Code)
+	}
+	Log.i("Password of %s reset by admin", redact(user.Username))
+	return AdminResetPasswdResponse{Passwd: passwd}, nil
+}
+
+// Loads the user without starting a `user_handler()`, for handlers that only look at it.
+// Unlike `loadUser()`, doesn't open the inboxes, which would migrate and repair them.
+// See `Storage.inspectInbox()`.
+func inspectUser(id uint64) (*User, error) {
+	user, err := storage.loadUser(id)
+	if err != nil {
+		return nil, err
+	}
+	user.EncryptedID = UserID{Id: user.Id, Sn: user.Sn}.encrypt()
+	// Only in memory
+	user.migrateLegacyDevice()
+	return user, nil
+}
+
+func sortedUsernames(users *Users) []string {
+	names := make([]string, 0, len(users.name_map))
+	for name := range users.name_map {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+type AdminUsersRequest struct {
+}
+
+type AdminUsersResponse struct {
+	Users []AdminUsersItem `json:"users"`
+}
+
+type AdminUsersItem struct {
+	Username string `json:"username"`
+	Id       uint64 `json:"id"`
+	Devices  int    `json:"devices"`
+	Disabled bool   `json:"disabled"`
+
+	// Set if the user cannot be loaded
+	Err string `json:"err,omitempty"`
+}
+
+func adminUsers_handler(ctx context.Context, req AdminUsersRequest) (AdminUsersResponse, *RestAPIError) {
+	users := usersList.Load()
+	resp := AdminUsersResponse{Users: make([]AdminUsersItem, 0, len(users.name_map))}
+	for _, name := range sortedUsernames(users) {
+		item := AdminUsersItem{Username: name, Id: users.name_map[name]}
+		user, err := inspectUser(item.Id)
+		if err != nil {
+			item.Err = err.Error()
+		} else {
+			item.Devices = len(user.Devices)
+			item.Disabled = user.Disabled
+		}
+		resp.Users = append(resp.Users, item)
+	}
+	return resp, nil
+}
+
+type AdminUserInfoResponse struct {
+	Username    string `json:"username"`
+	Id          uint64 `json:"id"`
+	EncryptedID string `json:"enc_id"`
+	Disabled    bool   `json:"disabled"`
+	PasswdHash  string `json:"passwd_hash"` // algorithm
+
+	// Empty if the user registered without an invitation
+	InvitedBy string `json:"invited_by,omitempty"`
+	Invited   int64  `json:"invited,omitempty"` // seconds since `referenceTime`
+
+	Devices []AdminDeviceInfo `json:"devices"`
+}
+
+type AdminDeviceInfo struct {
+	Id            uint64 `json:"id"`
+	LastLogin     int64  `json:"last_login"` // seconds since `referenceTime`
+	Prekeys       int    `json:"prekeys"`
+	InboxMessages int    `json:"inbox_messages"`
+	InboxBytes    int64  `json:"inbox_bytes"`
+
+	// Set if the inbox cannot be read
+	InboxErr string `json:"inbox_err,omitempty"`
+}
+
+// Only reads the stored data, see `inspectUser()`
+func adminUserInfo_handler(ctx context.Context, req AdminUserRequest) (AdminUserInfoResponse, *RestAPIError) {
+	users := usersList.Load()
+	id, found := users.name_map[req.Username]
+	if !found {
+		return AdminUserInfoResponse{}, NewError("admin/user: user not found", http.StatusNotFound)
+	}
+	user, err := inspectUser(id)
+	if err != nil {
+		return AdminUserInfoResponse{}, NewError("admin/user: loading user: "+err.Error(), http.StatusInternalServerError)
+	}
+	state, err := storage.loadState()
+	if err != nil {
+		return AdminUserInfoResponse{}, NewError("admin/user: loading state: "+err.Error(), http.StatusInternalServerError)
+	}
+
+	resp := AdminUserInfoResponse{
+		Username:    user.Username,
+		Id:          user.Id,
+		EncryptedID: user.EncryptedID.toString(),
+		Disabled:    user.Disabled,
+		PasswdHash:  user.passwdHashParams().Algorithm,
+		Devices:     make([]AdminDeviceInfo, 0, len(user.Devices)),
+	}
+	if i := slices.IndexFunc(state.UsedInvitations, func(u UsedInvitation) bool { return u.Username == user.Username }); i >= 0 {
+		resp.InvitedBy = inviterName(users, state.UsedInvitations[i].InvitedBy)
+		resp.Invited = state.UsedInvitations[i].Time
+	}
+
+	now := monotonicSeconds()
+	for _, device := range user.Devices {
+		info := AdminDeviceInfo{Id: device.Id, LastLogin: device.LastLogin, Prekeys: len(device.Prekeys)}
+		stats, err := storage.inspectInbox(user, device.Id, now)
+		if err != nil {
+			info.InboxErr = err.Error()
+		} else {
+			info.InboxMessages = stats.Messages
+			info.InboxBytes = stats.Bytes
+		}
+		resp.Devices = append(resp.Devices, info)
+	}
+	return resp, nil
+}
+
+type AdminInvitationsRequest struct {
+}
+
+type AdminInvitationsResponse struct {
+	Invitations []AdminInvitationsItem `json:"invitations"`
+}
+
+type AdminInvitationsItem struct {
+	Code      string `json:"code"`
+	Created   int64  `json:"created"` // seconds since `referenceTime`
+	Expires   int64  `json:"expires"` // seconds since `referenceTime`, 0 means never
+	Expired   bool   `json:"expired"` // or used up
+	Uses      int    `json:"uses"`
+	MaxUses   int    `json:"max_uses"`
+	CreatedBy string `json:"created_by"` // username, or "admin"
+	Note      string `json:"note"`
+}
+
+func inviterName(users *Users, id uint64) string {
+	if id == 0 {
+		return "admin"
+	}
+	name, found := users.id_map[id]
+	if !found {
+		return fmt.Sprintf("deleted user %020d", id)
+	}
+	return name
+}
+
+func adminInvitations_handler(ctx context.Context, req AdminInvitationsRequest) (AdminInvitationsResponse, *RestAPIError) {
+	state, err := storage.loadState()
+	if err != nil {
+		return AdminInvitationsResponse{}, NewError("admin/invitations: loading state: "+err.Error(), http.StatusInternalServerError)
+	}
+
+	users := usersList.Load()
+	now := monotonicSeconds()
+	resp := AdminInvitationsResponse{Invitations: make([]AdminInvitationsItem, 0, len(state.Invitations))}
+	for _, inv := range state.Invitations {
+		resp.Invitations = append(resp.Invitations, AdminInvitationsItem{
+			Code:      inv.Code,
+			Created:   inv.Created,
+			Expires:   inv.Expires,
+			Expired:   !inv.valid(now),
+			Uses:      inv.Uses,
+			MaxUses:   inv.MaxUses,
+			CreatedBy: inviterName(users, inv.CreatedBy),
+			Note:      inv.Note,
+		})
+	}
+	return resp, nil
+}
+
+type AdminRevokeInvitationRequest struct {
+	Code string `json:"code"`
+}
+
+type AdminRevokeInvitationResponse struct {
+}
+
+func adminRevokeInvitation_handler(ctx context.Context, req AdminRevokeInvitationRequest) (AdminRevokeInvitationResponse, *RestAPIError) {
+	var restAPIerr *RestAPIError
+	err := storage.updateState(func(state *ServerState) error {
+		i := findInvitation(state.Invitations, req.Code)
+		if i < 0 {
+			restAPIerr = NewError("admin/revokeInvitation: invitation not found", http.StatusNotFound)
+			return errInvitationNotFound
+		}
+		state.Invitations = slices.Delete(state.Invitations, i, i+1)
+		return nil
+	})
+	if restAPIerr != nil {
+		return AdminRevokeInvitationResponse{}, restAPIerr
+	}
+	if err != nil {
+		msg := "admin/revokeInvitation: saving state: " + err.Error()
+		return AdminRevokeInvitationResponse{}, NewError(msg, http.StatusInternalServerError)
+	}
+	Log.i("Admin revoked an invitation")
+	return AdminRevokeInvitationResponse{}, nil
+}
+
+type AdminExpireInvitationsRequest struct {
+}
+
+type AdminExpireInvitationsResponse struct {
+	Revoked int `json:"revoked"`
+}
+
+// Revokes all unused invitations, including the ones created by users
+func adminExpireInvitations_handler(ctx context.Context, req AdminExpireInvitationsRequest) (AdminExpireInvitationsResponse, *RestAPIError) {
+	resp := AdminExpireInvitationsResponse{}
+	err := storage.updateState(func(state *ServerState) error {
+		resp.Revoked = len(state.Invitations)
+		state.Invitations = []Invitation{}
+		return nil
+	})
+	if err != nil {
+		msg := "admin/expireInvitations: saving state: " + err.Error()
+		return AdminExpireInvitationsResponse{}, NewError(msg, http.StatusInternalServerError)
+	}
+	Log.i("Admin revoked %d invitations", resp.Revoked)
+	return resp, nil
+}
+
+type AdminRotateBearerKeyRequest struct {
+}
+
+type AdminRotateBearerKeyResponse struct {
+}
+
+// Logs out everyone. Open `recv` requests and streams run until they end, the next requests fail.
+func adminRotateBearerKey_handler(ctx context.Context, req AdminRotateBearerKeyRequest) (AdminRotateBearerKeyResponse, *RestAPIError) {
+	err := rotateBearerKey()
+	if err != nil {
+		return AdminRotateBearerKeyResponse{}, NewError("admin/rotateBearerKey: "+err.Error(), http.StatusInternalServerError)
+	}
+	Log.i("Admin rotated the bearer key")
+	return AdminRotateBearerKeyResponse{}, nil
+}
+
+type AdminCheckRequest struct {
+}
+
+type AdminCheckResponse struct {
+	Users    int      `json:"users"`
+	Problems []string `json:"problems"`
+}
+
+// Checks the integrity of the stored data and reports every problem it finds, not just
+// the first one. Only reads the data, see `inspectUser()`. While the server is running,
+// an inbox that is being written to at the same time can show up with a torn record.
+func adminCheck_handler(ctx context.Context, req AdminCheckRequest) (AdminCheckResponse, *RestAPIError) {
+	resp := AdminCheckResponse{Problems: make([]string, 0)}
+	report := func(format string, args ...interface{}) {
+		resp.Problems = append(resp.Problems, fmt.Sprintf(format, args...))
+	}
+
+	state, err := storage.loadState()
+	if err != nil {
+		return AdminCheckResponse{}, NewError("admin/check: loading state: "+err.Error(), http.StatusInternalServerError)
+	}
+
+	users := usersList.Load()
+	resp.Users = len(users.name_map)
+	now := monotonicSeconds()
+	for _, name := range sortedUsernames(users) {
+		if ctx.Err() != nil {
+			return resp, NewError("admin/check: canceled", http.StatusServiceUnavailable)
+		}
+		id := users.name_map[name]
+		user, err := inspectUser(id)
+		if err != nil {
+			report("%s: cannot be loaded: %s", name, err)
+			continue
+		}
+		if user.Id != id || user.Username != name {
+			report("%s: stored as %s, ID %020d, but indexed with ID %020d", name, user.Username, user.Id, id)
+		}
+		if id > state.LastId {
+			report("%s: ID %020d is above last_id in the state, it could be assigned again", name, id)
+		}
+		if err := user.passwdHashParams().validate(); err != nil {
+			report("%s: invalid password hash parameters: %s", name, err)
+		}
+
+		deviceIds := make(map[uint64]bool)
+		for _, device := range user.Devices {
+			if deviceIds[device.Id] {
+				report("%s: duplicate device %d", name, device.Id)
+			}
+			deviceIds[device.Id] = true
+			if device.Id >= user.NextDeviceId {
+				report("%s: device %d is not below next_device_id %d", name, device.Id, user.NextDeviceId)
+			}
+			stats, err := storage.inspectInbox(user, device.Id, now)
+			if err != nil {
+				report("%s: inbox of device %d: %s", name, device.Id, err.Error())
+				continue
+			}
+			for _, problem := range stats.Problems {
+				report("%s: inbox of device %d: %s", name, device.Id, problem)
+			}
+		}
+	}
+	return resp, nil
+}
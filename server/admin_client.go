@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// How the commands in `cli.go` reach the admin API handlers. Without a running server,
+// the command holds the app directory lock and calls the handlers in its own process.
+// While the server runs, it holds the lock, and the command sends the request to its
+// admin listener instead, with the token from `ADMIN_TOKEN_FILE`.
+type AdminClient struct {
+	// nil if the handlers run in this process
+	http  *http.Client
+	url   string
+	token string
+
+	// For error messages
+	address string
+}
+
+func localAdminClient() *AdminClient {
+	return &AdminClient{}
+}
+
+func remoteAdminClient(appDir string, settings ListenSettings) (*AdminClient, error) {
+	if !settings.adminEnabled() {
+		return nil, fmt.Errorf("the server is running without the admin listener, see -admin-listen")
+	}
+	token, err := os.ReadFile(appFile(appDir, ADMIN_TOKEN_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("error reading admin token: %s", err)
+	}
+
+	client := &AdminClient{
+		http:  &http.Client{},
+		url:   "http://" + settings.AdminListen,
+		token: strings.TrimSpace(string(token)),
+
+		address: settings.AdminListen,
+	}
+	if isUnixSocket(settings.AdminListen) {
+		socket := strings.TrimPrefix(settings.AdminListen, UNIX_SOCKET_PREFIX)
+		client.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		// The host doesn't matter, the connection goes to the socket
+		client.url = "http://loky"
+	}
+	return client, nil
+}
+
+// Runs the command in the server that holds the app directory lock. The admin listener
+// is found the way the server found it: -admin-listen, `LOKY_ADMIN_LISTEN`, the config
+// or the default.
+func runRemoteCommand(appDir string, adminListenFlag string, args []string) error {
+	cfg, err := loadConfig(appFile(appDir, CONFIG_FILE))
+	if err != nil {
+		return err
+	}
+	config = cfg
+	settings := resolveListenSettings(appDir, "", "", "", adminListenFlag)
+	client, err := remoteAdminClient(appDir, settings)
+	if err != nil {
+		return err
+	}
+	return runCommand(client, args)
+}
+
+// Calls the admin API handler `handler`, served at `/admin/<name>`
+func adminCall[
+	Request any,
+	Response any,
+](
+	client *AdminClient,
+	name string,
+	handler func(ctx context.Context, req Request) (Response, *RestAPIError),
+	req Request,
+) (Response, error) {
+	if client.http == nil {
+		resp, restAPIerr := handler(serverCtx, req)
+		if restAPIerr != nil {
+			return resp, errors.New(restAPIerr.Err)
+		}
+		return resp, nil
+	}
+
+	var resp Response
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return resp, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, client.url+"/admin/"+name, bytes.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+client.token)
+
+	httpResp, err := client.http.Do(httpReq)
+	if err != nil {
+		return resp, fmt.Errorf("error contacting the running server at %s, see -admin-listen: %s", client.address, err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 4096))
+		return resp, errors.New(strings.TrimPrefix(strings.TrimSpace(string(msg)), "RestAPIError: "))
+	}
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		return resp, fmt.Errorf("error decoding response of the running server: %s", err)
+	}
+	return resp, nil
+}
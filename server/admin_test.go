@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serves the admin API with a new token in a temporary app directory, like the
+// admin listener of a running server. Needs `setupTest()`.
+func newTestAdminServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	oldToken := adminToken
+	t.Cleanup(func() { adminToken = oldToken })
+
+	appDir := t.TempDir()
+	err := loadAdminToken(appDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerAdminHandlers(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, appDir
+}
+
+func TestLoadAdminToken(t *testing.T) {
+	oldToken := adminToken
+	t.Cleanup(func() { adminToken = oldToken })
+	appDir := t.TempDir()
+
+	err := loadAdminToken(appDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := string(adminToken)
+	info, err := os.Stat(appFile(appDir, ADMIN_TOKEN_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode %v", info.Mode().Perm())
+	}
+
+	err = loadAdminToken(appDir)
+	if err != nil || string(adminToken) != created {
+		t.Fatalf("token changed on reload: %v", err)
+	}
+
+	writeTestFile(t, appFile(appDir, ADMIN_TOKEN_FILE), []byte("\n"))
+	if err := loadAdminToken(appDir); err == nil {
+		t.Error("empty token accepted")
+	}
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	server, _ := newTestAdminServer(t)
+
+	for _, auth := range []string{"", "Bearer wrong", "Bearer " + string(loginTestUser(t, alice)), string(adminToken)} {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/admin/stats", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%q: %d", auth, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/admin/stats", nil)
+	req.Header.Set("Authorization", "Bearer "+string(adminToken))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("admin token: %d", resp.StatusCode)
+	}
+}
+
+func TestAdminCreateAndDeleteUser(t *testing.T) {
+	setupTest(t)
+	ctx := context.Background()
+
+	resp, err := adminCreateUser_handler(ctx, AdminCreateUserRequest{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := adminCreateUser_handler(ctx, AdminCreateUserRequest{Username: "alice"}); err == nil || err.Code != http.StatusConflict {
+		t.Fatalf("duplicate user: %v", err)
+	}
+	alice := usersList.Load().userByName("alice")
+	if err := loginTestPasswd(alice, resp.Passwd); err != nil {
+		t.Fatalf("login with the generated password: %v", err)
+	}
+
+	_, err = adminDeleteUser_handler(ctx, AdminUserRequest{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-alice.Done
+	if usersList.Load().hasName("alice") {
+		t.Error("deleted user still listed")
+	}
+	if _, err := adminDeleteUser_handler(ctx, AdminUserRequest{Username: "alice"}); err == nil || err.Code != http.StatusNotFound {
+		t.Errorf("deleting again: %v", err)
+	}
+}
+
+func TestAdminLogoutUser(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bearer := loginTestUser(t, alice)
+	waiter := startTestRecv(alice, 10)
+	// Let it park
+	time.Sleep(100 * time.Millisecond)
+
+	_, err := adminUserOp_handler(ADMIN_OP_LOGOUT)(context.Background(), AdminUserRequest{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizeTestBearer(bearer); err == nil {
+		t.Error("bearer still valid")
+	}
+	// Not disabled, the user can log in again
+	if err := authorizeTestBearer(loginTestUser(t, alice)); err != nil {
+		t.Errorf("bearer after logout: %v", err)
+	}
+	// Released, so the device notices right away
+	waitTestRecv(t, waiter)
+}
+
+func TestAdminResetPasswdSaveError(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	storage = failingStorage{storage}
+
+	if _, err := adminResetPasswd_handler(context.Background(), AdminUserRequest{Username: "alice"}); err == nil {
+		t.Fatal("save error not reported")
+	}
+	// The old password still works, in memory as on disk
+	if err := loginTestPasswd(alice, "passwd of alice"); err != nil {
+		t.Fatalf("old password: %v", err)
+	}
+}
+
+func TestAdminGC(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	addTestUser(t, "bob")
+	putTestMessage(t, alice, "bob", "a")
+	if !evictTestUser(alice, monotonicSeconds()+1) {
+		t.Fatal("user not evicted")
+	}
+	<-alice.Done
+
+	// Evicted users are loaded for it
+	resp, err := adminGC_handler(context.Background(), AdminGCRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != (AdminGCResponse{Users: 2, Devices: 2, Messages: 1}) {
+		t.Errorf("%+v", resp)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := adminGC_handler(ctx, AdminGCRequest{}); err == nil {
+		t.Error("canceled GC finished")
+	}
+}
+
+func TestAdminInvitations(t *testing.T) {
+	setupTest(t)
+	client := localAdminClient()
+
+	invited, err := adminCall(client, "invite", adminInvite_handler, AdminInviteRequest{Count: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = adminCall(client, "revokeInvitation", adminRevokeInvitation_handler, AdminRevokeInvitationRequest{Code: invited.Invitations[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := adminCall(client, "revokeInvitation", adminRevokeInvitation_handler, AdminRevokeInvitationRequest{Code: invited.Invitations[0]}); err == nil {
+		t.Error("revoked twice")
+	}
+	listed, err := adminCall(client, "invitations", adminInvitations_handler, AdminInvitationsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := make([]string, 0)
+	for _, inv := range listed.Invitations {
+		codes = append(codes, inv.Code)
+		if inv.CreatedBy != "admin" || inv.Expired {
+			t.Errorf("invitation %+v", inv)
+		}
+	}
+	if !slices.Equal(codes, invited.Invitations[1:]) {
+		t.Errorf("invitations %v, created %v", codes, invited.Invitations)
+	}
+
+	expired, err := adminCall(client, "expireInvitations", adminExpireInvitations_handler, AdminExpireInvitationsRequest{})
+	if err != nil || expired.Revoked != 2 {
+		t.Fatalf("expired %+v, %v", expired, err)
+	}
+	if state := loadTestState(t); len(state.Invitations) != 0 {
+		t.Errorf("invitations left: %v", state.Invitations)
+	}
+}
+
+func TestRemoteAdminClient(t *testing.T) {
+	setupTest(t)
+	addTestUser(t, "alice")
+	server, appDir := newTestAdminServer(t)
+
+	settings := ListenSettings{AdminListen: strings.TrimPrefix(server.URL, "http://")}
+	client, err := remoteAdminClient(appDir, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runCommand(client, []string{"disable", "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !usersList.Load().userByName("alice").Disabled {
+		t.Error("user not disabled by the server")
+	}
+
+	// Errors of the server are reported without the HTTP details
+	_, err = adminCall(client, "user", adminUserInfo_handler, AdminUserRequest{Username: "nobody"})
+	if err == nil || err.Error() != "admin/user: user not found" {
+		t.Errorf("unknown user: %v", err)
+	}
+
+	client.token = "wrong"
+	if err := runCommand(client, []string{"users"}); err == nil {
+		t.Error("wrong token accepted")
+	}
+
+	if _, err := remoteAdminClient(appDir, ListenSettings{AdminListen: ADMIN_LISTEN_OFF}); err == nil {
+		t.Error("client for a disabled admin listener")
+	}
+}
+
+func TestRemoteAdminClientUnixSocket(t *testing.T) {
+	setupTest(t)
+	server, appDir := newTestAdminServer(t)
+
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, server.Config.Handler)
+	t.Cleanup(func() { listener.Close() })
+
+	client, err := remoteAdminClient(appDir, ListenSettings{AdminListen: UNIX_SOCKET_PREFIX + socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := adminCall(client, "invite", adminInvite_handler, AdminInviteRequest{Count: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := loadTestState(t); len(state.Invitations) != 2 || findInvitation(state.Invitations, resp.Invitations[1]) < 0 {
+		t.Errorf("invitations %+v, created %v", state.Invitations, resp.Invitations)
+	}
+}
+
+func TestRunRemoteCommand(t *testing.T) {
+	setupTest(t)
+	addTestUser(t, "alice")
+	server, appDir := newTestAdminServer(t)
+	t.Setenv("LOKY_ADMIN_LISTEN", "")
+
+	// The server listens where its config says
+	cfg := config
+	cfg.File = appFile(appDir, CONFIG_FILE)
+	cfg.AdminListen = strings.TrimPrefix(server.URL, "http://")
+	if err := cfg.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := runRemoteCommand(appDir, "", []string{"disable", "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !usersList.Load().userByName("alice").Disabled {
+		t.Error("user not disabled by the server")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Bearers are not stored on the server. Each bearer carries the encrypted user ID
+// (which includes the SN), the device, the time it was issued, its expiry and a random token ID.
+// It is signed with HMAC-SHA256 using the key in `BEARER_KEY_FILE`.
+//
+// So a user can have any number of valid bearers, and logging in on one device
+// doesn't log out the others.
+//
+// Format: base64(payload) "." base64(signature)
+
+type Bearer string
+
+// Next to the TLS certificate, created on the first start. Not in the config,
+// so the key can be rotated without touching the config, see `rotateBearerKey()`.
+const BEARER_KEY_FILE = "secrets/bearer.key"
+const BEARER_KEY_SIZE = 32
+
+// Replaced when the key changes, so it's read without locks
+var bearerKey atomic.Pointer[[]byte]
+
+var bearerKeyFile string
+
+// Reads the bearer key, or creates it if it doesn't exist yet
+func loadBearerKey(dir string) error {
+	bearerKeyFile = filepath.Join(dir, BEARER_KEY_FILE)
+	data, err := os.ReadFile(bearerKeyFile)
+	if err == nil {
+		key, err := base64Decode(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != BEARER_KEY_SIZE {
+			return fmt.Errorf("%s doesn't contain a valid key", bearerKeyFile)
+		}
+		bearerKey.Store(&key)
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	key, err := randBytes(BEARER_KEY_SIZE)
+	if err != nil {
+		return err
+	}
+	err = saveBearerKey(key)
+	if err != nil {
+		return err
+	}
+	bearerKey.Store(&key)
+	return nil
+}
+
+func saveBearerKey(key []byte) error {
+	err := os.MkdirAll(filepath.Dir(bearerKeyFile), 0700)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(bearerKeyFile, []byte(base64Encode(key)+"\n"), 0600)
+}
+
+// Bearers signed with the old key stop being accepted
+func rotateBearerKey() error {
+	key, err := randBytes(BEARER_KEY_SIZE)
+	if err != nil {
+		return fmt.Errorf("error generating bearer key: %s", err)
+	}
+	err = saveBearerKey(key)
+	if err != nil {
+		return fmt.Errorf("error saving bearer key: %s", err)
+	}
+	bearerKey.Store(&key)
+	return nil
+}
+
+type BearerClaims struct {
+	EncryptedID EncryptedID
+	Device      uint64 // `Device.Id`
+	Issued      int64  // seconds since `referenceTime`
+	Expires     int64  // seconds since `referenceTime`
+	TokenId     uint64 // random, used to revoke the bearer
+}
+
+const bearerPayloadSize = 16 + 8 + 8 + 8 + 8
+
+// For `User.BearersValidAfter` when invalidating all bearers of the user. `Issued` has
+// a resolution of seconds, so bearers issued earlier in the current second must be rejected as well.
+func bearersValidAfterNow() int64 {
+	return monotonicSeconds() + 1
+}
+
+// The bearer counts as issued no earlier than `user.BearersValidAfter`, so a bearer
+// made right after the user's bearers were invalidated is accepted.
+func makeBearer(user *User, device uint64) (Bearer, error) {
+	tokenId, err := randBytes(8)
+	if err != nil {
+		return "", err
+	}
+
+	now := monotonicSeconds()
+	claims := BearerClaims{
+		EncryptedID: user.EncryptedID,
+		Device:      device,
+		Issued:      max(now, atomic.LoadInt64(&user.BearersValidAfter)),
+		Expires:     now + BEARER_EXPIRE_SEC,
+		TokenId:     binary.LittleEndian.Uint64(tokenId),
+	}
+
+	payload := make([]byte, 0, bearerPayloadSize)
+	payload = append(payload, claims.EncryptedID.Bytes...)
+	payload = binary.LittleEndian.AppendUint64(payload, claims.Device)
+	payload = binary.LittleEndian.AppendUint64(payload, uint64(claims.Issued))
+	payload = binary.LittleEndian.AppendUint64(payload, uint64(claims.Expires))
+	payload = binary.LittleEndian.AppendUint64(payload, claims.TokenId)
+
+	bearer := fmt.Sprintf("%s.%s", base64Encode(payload), base64Encode(signBearer(payload)))
+
+	return Bearer(bearer), nil
+}
+
+func signBearer(payload []byte) []byte {
+	mac := hmac.New(sha256.New, *bearerKey.Load())
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Checks the signature, expiry and revocation of the bearer.
+// Doesn't check whether the user exists.
+func (bearer Bearer) verify() (BearerClaims, error) {
+	parts := strings.Split(string(bearer), ".")
+	if len(parts) != 2 {
+		return BearerClaims{}, fmt.Errorf("invalid bearer format")
+	}
+
+	payload, err := base64Decode(parts[0])
+	if err != nil || len(payload) != bearerPayloadSize {
+		return BearerClaims{}, fmt.Errorf("invalid bearer payload")
+	}
+	signature, err := base64Decode(parts[1])
+	if err != nil || !hmac.Equal(signature, signBearer(payload)) {
+		return BearerClaims{}, fmt.Errorf("invalid bearer signature")
+	}
+
+	claims := BearerClaims{
+		EncryptedID: EncryptedID{Bytes: payload[:16]},
+		Device:      binary.LittleEndian.Uint64(payload[16:24]),
+		Issued:      int64(binary.LittleEndian.Uint64(payload[24:32])),
+		Expires:     int64(binary.LittleEndian.Uint64(payload[32:40])),
+		TokenId:     binary.LittleEndian.Uint64(payload[40:48]),
+	}
+
+	if monotonicSeconds() >= claims.Expires {
+		return BearerClaims{}, fmt.Errorf("bearer expired")
+	}
+
+	if revokedBearers.Load().contains(claims.TokenId) {
+		return BearerClaims{}, fmt.Errorf("bearer revoked")
+	}
+
+	return claims, nil
+}
+
+// Bearers revoked by an explicit logout. Token ID -> expiry of the bearer.
+// Entries are dropped once the bearer expires, as it wouldn't be accepted anyway.
+type RevokedBearers map[uint64]int64
+
+// Like `usersList`, the map is treated as immutable, so it can be read without locks.
+// It is replaced while holding `GlobalLock`.
+var revokedBearers atomic.Pointer[RevokedBearers]
+
+func (revoked *RevokedBearers) contains(tokenId uint64) bool {
+	_, found := (*revoked)[tokenId]
+	return found
+}
+
+func loadRevokedBearers() error {
+	revoked, err := storage.loadRevokedBearers()
+	if err != nil {
+		return err
+	}
+	revokedBearers.Store(&revoked)
+	return nil
+}
+
+func revokeBearer(claims BearerClaims) error {
+	GlobalLock.Lock()
+	defer GlobalLock.Unlock()
+
+	now := monotonicSeconds()
+	newRevoked := make(RevokedBearers)
+	for tokenId, expires := range *revokedBearers.Load() {
+		if now < expires {
+			newRevoked[tokenId] = expires
+		}
+	}
+	newRevoked[claims.TokenId] = claims.Expires
+
+	err := storage.saveRevokedBearers(newRevoked)
+	if err != nil {
+		return err
+	}
+	revokedBearers.Store(&newRevoked)
+	return nil
+}
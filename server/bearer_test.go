@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func authorizeTestBearer(bearer Bearer) *RestAPIError {
+	r := httptest.NewRequest(http.MethodPost, "/api/recv", nil)
+	r.Header.Set("Authorization", "Bearer "+string(bearer))
+	_, _, restAPIerr := authorize(r, "recv")
+	return restAPIerr
+}
+
+func TestBearerSignAndVerify(t *testing.T) {
+	setupTest(t)
+	user := addTestUser(t, "alice")
+
+	bearer, err := makeBearer(user, TEST_DEVICE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := bearer.verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(claims.EncryptedID.Bytes, user.EncryptedID.Bytes) || claims.Device != TEST_DEVICE {
+		t.Errorf("claims = %+v", claims)
+	}
+	if claims.Expires != claims.Issued+BEARER_EXPIRE_SEC {
+		t.Errorf("expires = %d, issued = %d", claims.Expires, claims.Issued)
+	}
+	if restAPIerr := authorizeTestBearer(bearer); restAPIerr != nil {
+		t.Error(restAPIerr)
+	}
+}
+
+func TestBearerTampered(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bob := addTestUser(t, "bob")
+	bearer, err := makeBearer(alice, TEST_DEVICE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, _ := strings.Cut(string(bearer), ".")
+
+	other, err := makeBearer(bob, TEST_DEVICE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPayload, _, _ := strings.Cut(string(other), ".")
+
+	for _, tampered := range []string{
+		otherPayload + "." + signature,
+		payload + "." + signature[1:],
+		payload,
+		string(bearer) + ".x",
+		"",
+	} {
+		if _, err := Bearer(tampered).verify(); err == nil {
+			t.Errorf("%q accepted", tampered)
+		}
+	}
+}
+
+func TestBearerRevoked(t *testing.T) {
+	setupTest(t)
+	user := addTestUser(t, "alice")
+	revoked, err := makeBearer(user, TEST_DEVICE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := makeBearer(user, TEST_DEVICE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := revoked.verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = revokeBearer(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := revoked.verify(); err == nil {
+		t.Error("revoked bearer accepted")
+	}
+	if _, err := other.verify(); err != nil {
+		t.Errorf("other bearer rejected: %s", err)
+	}
+
+	// Revocations survive a restart
+	err = loadRevokedBearers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := revoked.verify(); err == nil {
+		t.Error("revoked bearer accepted after reload")
+	}
+}
+
+func TestBearersValidAfter(t *testing.T) {
+	setupTest(t)
+	user := addTestUser(t, "alice")
+	before, err := makeBearer(user, TEST_DEVICE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As on a password change. The new bearer is made in the same second.
+	atomic.StoreInt64(&user.BearersValidAfter, bearersValidAfterNow())
+	after, err := makeBearer(user, TEST_DEVICE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restAPIerr := authorizeTestBearer(before); restAPIerr == nil || restAPIerr.Code != http.StatusUnauthorized {
+		t.Errorf("bearer from before accepted: %v", restAPIerr)
+	}
+	if restAPIerr := authorizeTestBearer(after); restAPIerr != nil {
+		t.Errorf("new bearer rejected: %s", restAPIerr)
+	}
+}
+
+func TestLoadBearerKey(t *testing.T) {
+	setupTest(t)
+	user := addTestUser(t, "alice")
+	bearer, err := makeBearer(user, TEST_DEVICE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(bearerKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %s", info.Mode())
+	}
+
+	// The same key is used after a restart
+	bearerKey.Store(nil)
+	err = loadBearerKey(strings.TrimSuffix(bearerKeyFile, BEARER_KEY_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bearer.verify(); err != nil {
+		t.Errorf("bearer rejected after reload: %s", err)
+	}
+
+	err = os.WriteFile(bearerKeyFile, []byte("short\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadBearerKey(strings.TrimSuffix(bearerKeyFile, BEARER_KEY_FILE))
+	if err == nil {
+		t.Error("invalid key accepted")
+	}
+}
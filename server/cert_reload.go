@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Serves the TLS certificate through `tls.Config.GetCertificate`, so it can be replaced
+// without restarting the server. Existing connections keep the certificate they started with.
+//
+// The certificate is reloaded when the cert or key file changes (checked every
+// `CERT_CHECK_INTERVAL_SEC`) or when the server gets SIGHUP.
+// If the new files cannot be loaded, e.g., because the rotation tool has written the cert
+// but not the key yet, the old certificate stays in use and the reload is retried later.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	cert atomic.Pointer[tls.Certificate]
+
+	// Modification times of the files the current certificate was loaded from.
+	// Only accessed by `watch()`.
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// Fails if the certificate cannot be loaded. We don't want to start without one.
+func newCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *CertReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(reloader.CertFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(reloader.KeyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (reloader *CertReloader) reload() error {
+	// Take the times before reading, so that a change during the reload is not missed
+	certModTime, keyModTime, err := reloader.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.CertFile, reloader.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	reloader.cert.Store(&cert)
+	reloader.certModTime = certModTime
+	reloader.keyModTime = keyModTime
+	return nil
+}
+
+func (reloader *CertReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return reloader.cert.Load(), nil
+}
+
+func (reloader *CertReloader) changed() bool {
+	certModTime, keyModTime, err := reloader.modTimes()
+	if err != nil {
+		// Probably in the middle of a rotation. Try again later.
+		return false
+	}
+	return !certModTime.Equal(reloader.certModTime) || !keyModTime.Equal(reloader.keyModTime)
+}
+
+// Reloads the certificate when needed. Runs until the server shuts down.
+func (reloader *CertReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(time.Duration(CERT_CHECK_INTERVAL_SEC) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			Log.i("SIGHUP: reloading TLS certificate")
+		case <-ticker.C:
+			if !reloader.changed() {
+				continue
+			}
+			Log.i("TLS certificate files changed, reloading")
+		case <-serverCtx.Done():
+			return
+		}
+
+		err := reloader.reload()
+		if err != nil {
+			Log.e("Error reloading TLS certificate, keeping the old one: %s", err.Error())
+			continue
+		}
+		Log.i("TLS certificate reloaded")
+	}
+}
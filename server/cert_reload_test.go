@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed certificate for `name` and its key. Returns the PEM files' contents.
+func writeTestCert(t *testing.T, certFile string, keyFile string, name string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	writeTestFile(t, certFile, certPem)
+	writeTestFile(t, keyFile, keyPem)
+	return certPem, keyPem
+}
+
+func testCertName(t *testing.T, reloader *CertReloader) string {
+	t.Helper()
+	cert, err := reloader.getCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Fatal("started without a certificate")
+	}
+
+	writeTestCert(t, certFile, keyFile, "old")
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloader.changed() {
+		t.Error("changed right after loading")
+	}
+
+	// Halfway through a rotation: the new cert doesn't match the old key
+	oldKey, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, newKey := writeTestCert(t, certFile, keyFile, "new")
+	writeTestFile(t, keyFile, oldKey)
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if !reloader.changed() {
+		t.Fatal("change not detected")
+	}
+	if err := reloader.reload(); err == nil {
+		t.Fatal("mismatched key accepted")
+	}
+	if name := testCertName(t, reloader); name != "old" {
+		t.Errorf("serving %q after a failed reload", name)
+	}
+
+	writeTestFile(t, keyFile, newKey)
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := testCertName(t, reloader); name != "new" {
+		t.Errorf("serving %q after reload", name)
+	}
+}
+
+func TestCertReloadOnSighup(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	writeTestCert(t, certFile, keyFile, "old")
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keeps SIGHUP from terminating the test before `watch()` subscribes to it
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	oldCtx, oldCancel := serverCtx, cancelServerCtx
+	serverCtx, cancelServerCtx = context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	t.Cleanup(func() {
+		cancelServerCtx()
+		<-stopped
+		serverCtx, cancelServerCtx = oldCtx, oldCancel
+	})
+	go func() {
+		defer close(stopped)
+		reloader.watch()
+	}()
+
+	writeTestCert(t, certFile, keyFile, "new")
+	deadline := time.Now().Add(5 * time.Second)
+	for testCertName(t, reloader) != "new" {
+		if time.Now().After(deadline) {
+			t.Fatal("not reloaded on SIGHUP")
+		}
+		// Repeated in case `watch()` hasn't subscribed yet
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Changes the password and invalidates all bearers of the user.
+// The device making the request gets a new bearer, so it stays logged in.
+
+type ChangePasswdRequest struct {
+	OldPasswd Base64Bytes `json:"old_passwd"`
+	NewPasswd Base64Bytes `json:"new_passwd"`
+
+	Device   uint64                      `json:"-"`
+	Response chan<- ChangePasswdResponse `json:"-"`
+}
+
+type ChangePasswdResponse struct {
+	Bearer Bearer `json:"bearer"`
+
+	Err *RestAPIError `json:"-"`
+}
+
+func changePasswd_http_handler(w http.ResponseWriter, r *http.Request) {
+	restAPI_handler(w, r, "changePasswd", 1024, changePasswd_restAPI_handler)
+}
+
+func changePasswd_restAPI_handler(user *User, device uint64, req ChangePasswdRequest) (ChangePasswdResponse, *RestAPIError) {
+	if len(req.NewPasswd) == 0 {
+		return ChangePasswdResponse{}, NewError("changePasswd: empty password", http.StatusBadRequest)
+	}
+
+	respChan := make(chan ChangePasswdResponse)
+	defer close(respChan)
+
+	req.Device = device
+	req.Response = respChan
+
+	resp, ok := callUserHandler(user, user.ChangePasswd, req, respChan)
+	if !ok {
+		return ChangePasswdResponse{}, errUserStopped("changePasswd")
+	}
+
+	return resp, resp.Err
+}
+
+func changePasswd_synchronized_handler(user *User, req ChangePasswdRequest) ChangePasswdResponse {
+	device, restAPIerr := user.deviceOrError(req.Device)
+	if restAPIerr != nil {
+		return ChangePasswdResponse{Err: restAPIerr}
+	}
+
+	ok, _ := user.check_passwd(req.OldPasswd)
+	if !ok {
+		return ChangePasswdResponse{
+			Err: NewError("changePasswd: invalid password", http.StatusForbidden),
+		}
+	}
+
+	oldSalt, oldPasswd, oldParams := user.Salt, user.Passwd, user.PasswdHash
+	oldValidAfter := user.BearersValidAfter
+
+	err := user.set_passwd(req.NewPasswd)
+	if err != nil {
+		return ChangePasswdResponse{
+			Err: NewError("changePasswd: hashing password: "+err.Error(), http.StatusInternalServerError),
+		}
+	}
+	atomic.StoreInt64(&user.BearersValidAfter, bearersValidAfterNow())
+
+	err = user.save()
+	if err != nil {
+		user.Salt, user.Passwd, user.PasswdHash = oldSalt, oldPasswd, oldParams
+		atomic.StoreInt64(&user.BearersValidAfter, oldValidAfter)
+		return ChangePasswdResponse{
+			Err: NewError("changePasswd: saving user: "+err.Error(), http.StatusInternalServerError),
+		}
+	}
+	Log.i("Password of %s changed", redact(user.Username))
+	// Streams and parked requests were authorized with the old bearers
+	user.disconnectDevices()
+
+	bearer, err := makeBearer(user, device.Id)
+	if err != nil {
+		// The password is changed. The client just has to log in again.
+		return ChangePasswdResponse{
+			Err: NewError("changePasswd: creating bearer", http.StatusInternalServerError),
+		}
+	}
+
+	return ChangePasswdResponse{
+		Bearer: bearer,
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Admin commands, e.g. `loky -dir /var/lib/loky users`.
+//
+// They are built on the admin API handlers in `admin.go`. If the server is running,
+// it holds the app directory lock, and the commands go through its admin API.
+// Otherwise they take the lock and run the handlers themselves. See `AdminClient`.
+
+type Command struct {
+	Name  string
+	Args  string
+	Help  string
+	NArgs int // required arguments; -1 for one optional argument
+	Run   func(client *AdminClient, args []string) error
+}
+
+var commands = []Command{
+	{"users", "", "list users", 0, cmdUsers},
+	{"user", "<username>", "show devices, prekey counts and inbox sizes of a user", 1, cmdUser},
+	{"passwd", "<username>", "set a new random password and log out all devices", 1, cmdPasswd},
+	{"disable", "<username>", "log out all devices and reject logins", 1, cmdDisable},
+	{"enable", "<username>", "allow logins of a disabled user", 1, cmdEnable},
+	{"delete", "<username>", "delete a user and all their data", 1, cmdDelete},
+	{"invitations", "", "list invitations", 0, cmdInvitations},
+	{"invite", "[count]", "create invitations", -1, cmdInvite},
+	{"revoke-invitation", "<code>", "revoke an unused invitation", 1, cmdRevokeInvitation},
+	{"expire-invitations", "", "revoke all unused invitations", 0, cmdExpireInvitations},
+	{"rotate-bearer-key", "", "replace the key bearers are signed with; logs out everyone", 0, cmdRotateBearerKey},
+	{"check", "", "check the integrity of the stored data", 0, cmdCheck},
+}
+
+func printCommands() {
+	out := tabwriter.NewWriter(flag.CommandLine.Output(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %s %s\t%s\n", cmd.Name, cmd.Args, cmd.Help)
+	}
+	out.Flush()
+}
+
+func runCommand(client *AdminClient, args []string) error {
+	i := slices.IndexFunc(commands, func(cmd Command) bool { return cmd.Name == args[0] })
+	if i < 0 {
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+	cmd := commands[i]
+	args = args[1:]
+	if (cmd.NArgs >= 0 && len(args) != cmd.NArgs) || (cmd.NArgs < 0 && len(args) > 1) {
+		return fmt.Errorf("usage: loky %s %s", cmd.Name, cmd.Args)
+	}
+	return cmd.Run(client, args)
+}
+
+func formatTime(secondsSinceReference int64) string {
+	if secondsSinceReference == 0 {
+		return "-"
+	}
+	return referenceTime.Add(time.Duration(secondsSinceReference) * time.Second).Format(time.DateTime)
+}
+
+func cmdUsers(client *AdminClient, args []string) error {
+	resp, err := adminCall(client, "users", adminUsers_handler, AdminUsersRequest{})
+	if err != nil {
+		return err
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "USERNAME\tID\tDEVICES\tDISABLED")
+	for _, user := range resp.Users {
+		if user.Err != "" {
+			fmt.Fprintf(out, "%s\t%020d\terror: %s\t\n", user.Username, user.Id, user.Err)
+			continue
+		}
+		fmt.Fprintf(out, "%s\t%020d\t%d\t%t\n", user.Username, user.Id, user.Devices, user.Disabled)
+	}
+	return out.Flush()
+}
+
+func cmdUser(client *AdminClient, args []string) error {
+	user, err := adminCall(client, "user", adminUserInfo_handler, AdminUserRequest{Username: args[0]})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Username:  %s\n", user.Username)
+	fmt.Printf("ID:        %020d\n", user.Id)
+	fmt.Printf("Enc. ID:   %s\n", user.EncryptedID)
+	fmt.Printf("Disabled:  %t\n", user.Disabled)
+	fmt.Printf("Passwd:    %s\n", user.PasswdHash)
+	if user.InvitedBy != "" {
+		fmt.Printf("Invited:   by %s, %s\n", user.InvitedBy, formatTime(user.Invited))
+	}
+	fmt.Println()
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "DEVICE\tLAST LOGIN\tPREKEYS\tINBOX MESSAGES\tINBOX BYTES")
+	for _, device := range user.Devices {
+		if device.InboxErr != "" {
+			fmt.Fprintf(out, "%d\t%s\t%d\terror: %s\t\n", device.Id, formatTime(device.LastLogin), device.Prekeys, device.InboxErr)
+			continue
+		}
+		fmt.Fprintf(out, "%d\t%s\t%d\t%d\t%d\n", device.Id, formatTime(device.LastLogin), device.Prekeys, device.InboxMessages, device.InboxBytes)
+	}
+	return out.Flush()
+}
+
+func cmdPasswd(client *AdminClient, args []string) error {
+	resp, err := adminCall(client, "resetPasswd", adminResetPasswd_handler, AdminUserRequest{Username: args[0]})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("New password of %s: %s\n", args[0], resp.Passwd)
+	return nil
+}
+
+func cmdDisable(client *AdminClient, args []string) error {
+	_, err := adminCall(client, "disableUser", adminUserOp_handler(ADMIN_OP_DISABLE), AdminUserRequest{Username: args[0]})
+	return err
+}
+
+func cmdEnable(client *AdminClient, args []string) error {
+	_, err := adminCall(client, "enableUser", adminUserOp_handler(ADMIN_OP_ENABLE), AdminUserRequest{Username: args[0]})
+	return err
+}
+
+func cmdDelete(client *AdminClient, args []string) error {
+	_, err := adminCall(client, "deleteUser", adminDeleteUser_handler, AdminUserRequest{Username: args[0]})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %s\n", args[0])
+	return nil
+}
+
+func cmdInvitations(client *AdminClient, args []string) error {
+	resp, err := adminCall(client, "invitations", adminInvitations_handler, AdminInvitationsRequest{})
+	if err != nil {
+		return err
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(out, "CODE\tCREATED\tEXPIRES\tUSES\tCREATED BY\tNOTE")
+	for _, inv := range resp.Invitations {
+		expires := formatTime(inv.Expires)
+		if inv.Expired {
+			expires += " (expired)"
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%d/%d\t%s\t%s\n",
+			inv.Code, formatTime(inv.Created), expires, inv.Uses, inv.MaxUses, inv.CreatedBy, inv.Note)
+	}
+	return out.Flush()
+}
+
+func cmdInvite(client *AdminClient, args []string) error {
+	count := 1
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid count: %s", args[0])
+		}
+		count = n
+	}
+
+	resp, err := adminCall(client, "invite", adminInvite_handler, AdminInviteRequest{Count: count})
+	if err != nil {
+		return err
+	}
+	for _, code := range resp.Invitations {
+		fmt.Println(code)
+	}
+	return nil
+}
+
+func cmdRevokeInvitation(client *AdminClient, args []string) error {
+	_, err := adminCall(client, "revokeInvitation", adminRevokeInvitation_handler, AdminRevokeInvitationRequest{Code: args[0]})
+	return err
+}
+
+func cmdExpireInvitations(client *AdminClient, args []string) error {
+	resp, err := adminCall(client, "expireInvitations", adminExpireInvitations_handler, AdminExpireInvitationsRequest{})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Revoked %d invitations\n", resp.Revoked)
+	return nil
+}
+
+func cmdRotateBearerKey(client *AdminClient, args []string) error {
+	_, err := adminCall(client, "rotateBearerKey", adminRotateBearerKey_handler, AdminRotateBearerKeyRequest{})
+	return err
+}
+
+func cmdCheck(client *AdminClient, args []string) error {
+	resp, err := adminCall(client, "check", adminCheck_handler, AdminCheckRequest{})
+	if err != nil {
+		return err
+	}
+	for _, problem := range resp.Problems {
+		fmt.Println(problem)
+	}
+	if len(resp.Problems) > 0 {
+		return fmt.Errorf("found %d problems", len(resp.Problems))
+	}
+	fmt.Printf("%d users OK\n", resp.Users)
+	return nil
+}
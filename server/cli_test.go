@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunCommandArgs(t *testing.T) {
+	setupTest(t)
+	client := localAdminClient()
+
+	if err := runCommand(client, []string{"nonsense"}); err == nil {
+		t.Error("unknown command accepted")
+	}
+	if err := runCommand(client, []string{"user"}); err == nil {
+		t.Error("missing argument accepted")
+	}
+	if err := runCommand(client, []string{"invite", "1", "2"}); err == nil {
+		t.Error("second optional argument accepted")
+	}
+	if err := runCommand(client, []string{"user", "nobody"}); err == nil {
+		t.Error("unknown user accepted")
+	}
+}
+
+func TestCmdDisableAndEnable(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+
+	err := runCommand(localAdminClient(), []string{"disable", "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loginTestPasswd(alice, "passwd of alice"); err == nil || err.Code != http.StatusForbidden {
+		t.Fatalf("login of a disabled user: %v", err)
+	}
+
+	err = runCommand(localAdminClient(), []string{"enable", "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loginTestPasswd(alice, "passwd of alice"); err != nil {
+		t.Fatalf("login of an enabled user: %v", err)
+	}
+}
+
+func TestCmdPasswd(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bearer := loginTestUser(t, alice)
+
+	err := runCommand(localAdminClient(), []string{"passwd", "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loginTestPasswd(alice, "passwd of alice"); err == nil {
+		t.Fatal("old password still accepted")
+	}
+	if err := authorizeTestBearer(bearer); err == nil {
+		t.Fatal("device not logged out")
+	}
+}
+
+func TestCmdCheck(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	putTestMessage(t, alice, "bob", "a")
+
+	// Only reads, so it can look at a loaded user
+	err := runCommand(localAdminClient(), []string{"check"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.updateState(func(state *ServerState) error {
+		state.LastId = 0
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand(localAdminClient(), []string{"check"}); err == nil {
+		t.Fatal("ID above last_id not reported")
+	}
+}
+
+func TestInspectInbox(t *testing.T) {
+	for _, kind := range []string{"fs", "bolt", "memory"} {
+		t.Run(kind, func(t *testing.T) {
+			ts := newTestStorage(t, kind)
+			now := monotonicSeconds()
+			user := &User{Id: 42}
+
+			stats, err := ts.s.inspectInbox(user, 1, now)
+			if err != nil || stats.Messages != 0 {
+				t.Fatalf("inbox that doesn't exist: %+v, %v", stats, err)
+			}
+
+			inbox := ts.inbox()
+			seqs := addTestMessages(t, inbox, now, "a", "bc")
+			if err := inbox.ack(seqs[0]); err != nil {
+				t.Fatal(err)
+			}
+			stats, err = ts.s.inspectInbox(user, 1, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Messages != 1 || len(stats.Problems) != 0 {
+				t.Errorf("stats: %+v", stats)
+			}
+
+			// Expired messages aren't counted
+			stats, err = ts.s.inspectInbox(user, 1, now+MSG_EXPIRE_SEC+100)
+			if err != nil || stats.Messages != 0 {
+				t.Errorf("stats after expiry: %+v, %v", stats, err)
+			}
+		})
+	}
+}
+
+func TestCmdRotateBearerKey(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bearer := loginTestUser(t, alice)
+
+	err := runCommand(localAdminClient(), []string{"rotate-bearer-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizeTestBearer(bearer); err == nil {
+		t.Fatal("bearer signed with the old key accepted")
+	}
+	if err := authorizeTestBearer(loginTestUser(t, alice)); err != nil {
+		t.Fatalf("bearer signed with the new key: %v", err)
+	}
+
+	// The server started next uses the new key
+	rotated := *bearerKey.Load()
+	err = loadBearerKey(filepath.Dir(filepath.Dir(bearerKeyFile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(*bearerKey.Load()) != string(rotated) {
+		t.Error("rotated key not saved")
+	}
+}
+
+func TestLockAppDir(t *testing.T) {
+	oldLock := appDirLock
+	t.Cleanup(func() { appDirLock = oldLock })
+	dir := t.TempDir()
+
+	err := lockAppDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := appDirLock
+	// Commands go through the admin API then
+	if err := lockAppDir(dir); !errors.Is(err, errAppDirInUse) {
+		t.Fatalf("app dir locked twice: %v", err)
+	}
+
+	// Released when the process exits, i.e. the file is closed
+	lock.Close()
+	if err := lockAppDir(dir); err != nil {
+		t.Fatalf("lock not released: %v", err)
+	}
+	appDirLock.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, LOCK_FILE)); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -16,35 +15,96 @@ var referenceTime = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
 
 const MINUTE int64 = 60
 const HOUR int64 = 60 * MINUTE
+const DAY int64 = 24 * HOUR
 
 const SWITCH_INBOX_SEC int64 = 30 * MINUTE
 const MSG_EXPIRE_SEC int64 = 2 * HOUR
 
+// Upper limit for `RecvRequest.WaitSec`
+const RECV_MAX_WAIT_SEC int64 = 60
+
+const STREAM_BUFFER_SIZE = 256
+const STREAM_KEEPALIVE_SEC int64 = 30
+const STREAM_WRITE_TIMEOUT_SEC int64 = 15
+
+const DEFAULT_IDLE_USER_SEC int64 = 10 * MINUTE
+
+// How often to check whether the TLS certificate files have changed
+const CERT_CHECK_INTERVAL_SEC int64 = 30
+
+// How long to wait for running requests when shutting down
+const SHUTDOWN_TIMEOUT_SEC int64 = 10
+
+const BEARER_EXPIRE_SEC int64 = 30 * DAY
+
 const PREKEY_COUNT = 100
 const PREKEY_MAX_COUNT = 2 * PREKEY_COUNT
 
+// How many recipients of one `send` request are served at the same time
+const SEND_MAX_WORKERS = 8
+
+// How long `send` waits for busy recipients
+const SEND_TIMEOUT_SEC int64 = 10
+
+// Logging in on one more device removes the least recently used one
+const MAX_DEVICES = 10
+
+// In the app directory. The config is a plain file with every storage backend,
+// so it can be edited by hand or managed by configuration management.
+const CONFIG_FILE = "config.json"
+
 var config Config
 
 type Config struct {
-	AesKey          AesKey       `json:"aes_key"`
-	LastId          uint64       `json:"last_id"`
-	Filename        string       `json:"-"`
-	Aes             cipher.Block `json:"-"`
-	Invitations     []string     `json:"invitations"`
-	UsedInvitations []string     `json:"used_invitations"`
-}
+	AesKey AesKey       `json:"aes_key"`
+	Aes    cipher.Block `json:"-"`
 
-var GlobalLock sync.Mutex = sync.Mutex{}
+	// Where the config is loaded from and saved to
+	File string `json:"-"`
+
+	// Written by versions that kept the server state in the config. See `initState()`.
+	LegacyLastId          uint64           `json:"last_id,omitempty"`
+	LegacyInvitations     []Invitation     `json:"invitations,omitempty"`
+	LegacyUsedInvitations []UsedInvitation `json:"used_invitations,omitempty"`
+
+	// Filled with `defaultUserInvitations()` if missing
+	UserInvitations *UserInvitationConfig `json:"user_invitations"`
+
+	// Filled with `defaultRegistration()` if missing
+	Registration *RegistrationConfig `json:"registration"`
 
-func (config *Config) appPath() string {
-	return "."
+	// Used for new passwords. Can be tuned, existing passwords are rehashed on login.
+	PasswdHash PasswdHashParams `json:"passwd_hash"`
+
+	// Users that haven't been accessed for this long are unloaded from memory
+	IdleUserSec int64 `json:"idle_user_sec"`
+
+	// Optional. See `ListenSettings` for the defaults and how to override them.
+	Listen  string `json:"listen,omitempty"`
+	TlsCert string `json:"tls_cert,omitempty"`
+	TlsKey  string `json:"tls_key,omitempty"`
+
+	// Optional, `off` disables it. See `ListenSettings`.
+	AdminListen string `json:"admin_listen,omitempty"`
+
+	// Filled with `defaultRateLimits()` if missing
+	RateLimits *RateLimitConfig `json:"rate_limits"`
+
+	// Filled with `defaultInboxQuota()` if missing
+	InboxQuota *InboxQuota `json:"inbox_quota"`
+
+	// Optional. See `log.go`.
+	LogLevel  string `json:"log_level,omitempty"`
+	LogFormat string `json:"log_format,omitempty"`
 }
 
+var GlobalLock sync.Mutex = sync.Mutex{}
+
 type AesKey struct {
 	Key []byte
 }
 
-func newConfig(fn string) (Config, error) {
+func newConfig(file string) (Config, error) {
 	aesKey, err := newAesKey()
 	if err != nil {
 		return Config{}, err
@@ -58,22 +118,18 @@ func newConfig(fn string) (Config, error) {
 		return Config{}, fmt.Errorf("invalid block size: %d", aes.BlockSize())
 	}
 
-	idBytes, err := randBytes(8)
-	if err != nil {
-		return Config{}, err
-	}
-	id := binary.LittleEndian.Uint64(idBytes)
-
 	cfg := Config{
-		AesKey:   aesKey,
-		LastId:   id,
-		Filename: fn,
-		Aes:      aes,
-	}
+		AesKey: aesKey,
+		Aes:    aes,
+		File:   file,
 
-	err = cfg.save()
-	if err != nil {
-		return Config{}, err
+		PasswdHash:  defaultPasswdHashParams(),
+		IdleUserSec: DEFAULT_IDLE_USER_SEC,
+		RateLimits:  defaultRateLimits(),
+		InboxQuota:  defaultInboxQuota(),
+
+		UserInvitations: defaultUserInvitations(),
+		Registration:    defaultRegistration(),
 	}
 
 	return cfg, nil
@@ -86,47 +142,41 @@ func (cfg *Config) save() error {
 	}
 	jsonData = append(jsonData, '\n')
 
-	err = os.WriteFile(cfg.Filename, jsonData, 0644)
-	if err != nil {
-		return err
-	}
+	return writeFileAtomic(cfg.File, jsonData, 0644)
+}
 
-	return nil
+func (cfg *Config) hasLegacyState() bool {
+	return cfg.LegacyLastId != 0 || len(cfg.LegacyInvitations) > 0 || len(cfg.LegacyUsedInvitations) > 0
 }
 
-func (cfg *Config) genId() (UserID, error) {
-	id := cfg.LastId
-	id++
-	cfg.LastId = id
+// For changes the server makes to the config on its own, like filling in defaults
+// for missing settings. They are only a convenience, so it's fine if the config is read-only.
+func (cfg *Config) trySave() {
 	err := cfg.save()
 	if err != nil {
-		return UserID{}, fmt.Errorf("error saving config: %s", err)
+		Log.w("Cannot save the config, continuing with the changes in memory: %s", err.Error())
 	}
+}
 
-	snBytes, err := randBytes(8)
-	if err != nil {
-		return UserID{}, fmt.Errorf("error generating sn: %s", err)
+func loadConfig(file string) (Config, error) {
+	// Left behind if we crashed while saving, see `writeFileAtomic()`
+	if _, err := os.Stat(file + TEMP_SUFFIX); err == nil {
+		err = recoverTempFile(file+TEMP_SUFFIX, json.Valid)
+		if err != nil {
+			return Config{}, fmt.Errorf("error recovering unfinished write: %s", err)
+		}
 	}
-	sn := binary.LittleEndian.Uint64(snBytes)
-
-	return UserID{
-		Id: id,
-		Sn: sn,
-	}, nil
-}
 
-func loadConfig(fn string) (Config, error) {
-	bytes, err := os.ReadFile(fn)
+	bytes, err := os.ReadFile(file)
 	if err != nil {
 		return Config{}, fmt.Errorf("error reading config: %s", err)
 	}
 
-	cfg := Config{}
+	cfg := Config{File: file}
 	err = json.Unmarshal(bytes, &cfg)
 	if err != nil {
 		return Config{}, fmt.Errorf("error parsing config: %s", err)
 	}
-	cfg.Filename = fn
 
 	cfg.Aes, err = aes.NewCipher(cfg.AesKey.Key)
 	if err != nil {
@@ -136,6 +186,53 @@ func loadConfig(fn string) (Config, error) {
 		return Config{}, fmt.Errorf("invalid block size: %d", cfg.Aes.BlockSize())
 	}
 
+	// Configs created before password hashing was configurable don't have the parameters
+	if cfg.PasswdHash.Algorithm == "" {
+		cfg.PasswdHash = defaultPasswdHashParams()
+		cfg.trySave()
+	}
+	if cfg.RateLimits == nil {
+		cfg.RateLimits = defaultRateLimits()
+		cfg.trySave()
+	}
+	cfg.RateLimits.addMissingEndpoints(defaultRateLimits())
+	if cfg.InboxQuota == nil {
+		cfg.InboxQuota = defaultInboxQuota()
+		cfg.trySave()
+	}
+	if cfg.UserInvitations == nil {
+		cfg.UserInvitations = defaultUserInvitations()
+		cfg.trySave()
+	}
+	if cfg.Registration == nil {
+		cfg.Registration = defaultRegistration()
+		cfg.trySave()
+	}
+	if cfg.IdleUserSec <= 0 {
+		cfg.IdleUserSec = DEFAULT_IDLE_USER_SEC
+	}
+
+	err = cfg.PasswdHash.validate()
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid passwd_hash: %s", err)
+	}
+	err = cfg.RateLimits.validate()
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid rate_limits: %s", err)
+	}
+	err = cfg.InboxQuota.validate()
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid inbox_quota: %s", err)
+	}
+	err = cfg.UserInvitations.validate()
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid user_invitations: %s", err)
+	}
+	err = cfg.Registration.validate()
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid registration: %s", err)
+	}
+
 	return cfg, nil
 }
 
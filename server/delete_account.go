@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Deletes the account of the user making the request, including all devices and inboxes.
+// The password is required as a confirmation.
+
+type DeleteAccountRequest struct {
+	Passwd Base64Bytes `json:"passwd"`
+
+	Response chan<- DeleteAccountResponse `json:"-"`
+}
+
+type DeleteAccountResponse struct {
+	Err *RestAPIError `json:"-"`
+}
+
+func deleteAccount_http_handler(w http.ResponseWriter, r *http.Request) {
+	restAPI_handler(w, r, "deleteAccount", 512, deleteAccount_restAPI_handler)
+}
+
+func deleteAccount_restAPI_handler(user *User, _ uint64, req DeleteAccountRequest) (DeleteAccountResponse, *RestAPIError) {
+	respChan := make(chan DeleteAccountResponse)
+	defer close(respChan)
+
+	req.Response = respChan
+
+	// On success, the `user_handler()` stops after sending the response
+	resp, ok := callUserHandler(user, user.DeleteAccount, req, respChan)
+	if !ok {
+		return DeleteAccountResponse{}, errUserStopped("deleteAccount")
+	}
+	if resp.Err != nil {
+		return resp, resp.Err
+	}
+
+	GlobalLock.Lock()
+	defer GlobalLock.Unlock()
+
+	usersList.Store(removeUser(usersList.Load(), user))
+
+	return resp, nil
+}
+
+func deleteAccount_synchronized_handler(user *User, req DeleteAccountRequest) DeleteAccountResponse {
+	ok, _ := user.check_passwd(req.Passwd)
+	if !ok {
+		return DeleteAccountResponse{
+			Err: NewError("deleteAccount: invalid password", http.StatusForbidden),
+		}
+	}
+
+	err := storage.deleteUser(user)
+	if err != nil {
+		return DeleteAccountResponse{
+			Err: NewError("deleteAccount: deleting user: "+err.Error(), http.StatusInternalServerError),
+		}
+	}
+
+	user.disconnectDevices()
+
+	Log.i("User deleted: %s, ID: %s", redact(user.Username), redactId(user.Id))
+	return DeleteAccountResponse{}
+}
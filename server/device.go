@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// One installation of the app. A user can use several devices at the same time.
+// Each device has its own keys, prekeys and inbox.
+//
+// Devices are identified by the keys they log in with. Logging in with new keys adds
+// a device. When the user has too many devices, the one that hasn't logged in
+// for the longest time is removed.
+type Device struct {
+	Id         uint64   `json:"id"`
+	SigningKey string   `json:"sign_key"`   // public key for signing
+	MasterKey  string   `json:"master_key"` // master public key for diffie-hellman key exchange
+	Prekeys    []string `json:"prekeys"`    // public keys for diffie-hellman key exchange
+	LastLogin  int64    `json:"last_login"` // seconds since `referenceTime`
+
+	Inbox      *QuotaInbox       `json:"-"`
+	RecvWaiter *RecvWaiter       `json:"-"` // parked long-polling `recv`, if any
+	Subscriber *StreamSubscriber `json:"-"` // connected event stream, if any
+}
+
+// Device created for users stored before multi-device support.
+// Their keys, prekeys and inbox are moved to this device.
+const LEGACY_DEVICE_ID uint64 = 1
+
+func (device *Device) needPrekeys() bool {
+	return len(device.Prekeys) < PREKEY_COUNT
+}
+
+func (user *User) device(id uint64) *Device {
+	i := slices.IndexFunc(user.Devices, func(d *Device) bool { return d.Id == id })
+	if i < 0 {
+		return nil
+	}
+	return user.Devices[i]
+}
+
+// Returns the device for the request, or an error if the device was removed
+// after the bearer was issued.
+func (user *User) deviceOrError(id uint64) (*Device, *RestAPIError) {
+	device := user.device(id)
+	if device == nil {
+		return nil, NewError("device not found", http.StatusUnauthorized)
+	}
+	return device, nil
+}
+
+func (user *User) deviceByKeys(signingKey string, masterKey string) *Device {
+	i := slices.IndexFunc(user.Devices, func(d *Device) bool {
+		return d.SigningKey == signingKey && d.MasterKey == masterKey
+	})
+	if i < 0 {
+		return nil
+	}
+	return user.Devices[i]
+}
+
+// The device that logged in most recently, or nil if the user has no devices.
+// Used by API calls that don't specify a device.
+func (user *User) lastDevice() *Device {
+	var last *Device
+	for _, device := range user.Devices {
+		if last == nil || device.LastLogin >= last.LastLogin {
+			last = device
+		}
+	}
+	return last
+}
+
+// Adds a device with the given keys and saves the user.
+// If the user has `MAX_DEVICES` devices already, the least recently used one is removed.
+func (user *User) addDevice(signingKey string, masterKey string, now int64) (*Device, error) {
+	device := &Device{
+		Id:         user.NextDeviceId,
+		SigningKey: signingKey,
+		MasterKey:  masterKey,
+		Prekeys:    make([]string, 0),
+		LastLogin:  now,
+	}
+	inbox, err := storage.openInbox(user, device.Id)
+	if err != nil {
+		return nil, fmt.Errorf("error creating inbox: %s", err.Error())
+	}
+	device.Inbox = newQuotaInbox(inbox)
+
+	var evicted *Device
+	oldDevices := user.Devices
+	newDevices := slices.Clone(user.Devices)
+	if len(newDevices) >= MAX_DEVICES {
+		oldest := 0
+		for i, d := range newDevices {
+			if d.LastLogin < newDevices[oldest].LastLogin {
+				oldest = i
+			}
+		}
+		evicted = newDevices[oldest]
+		newDevices = slices.Delete(newDevices, oldest, oldest+1)
+	}
+
+	user.Devices = append(newDevices, device)
+	user.NextDeviceId++
+
+	err = user.save()
+	if err != nil {
+		user.Devices = oldDevices
+		user.NextDeviceId--
+		if err := storage.deleteInbox(user, device.Id); err != nil {
+			Log.e("addDevice(): error deleting inbox: %s", err.Error())
+		}
+		return nil, fmt.Errorf("error saving user: %s", err.Error())
+	}
+
+	if evicted != nil {
+		Log.i("Removing device %d of %s", evicted.Id, redact(user.Username))
+		evicted.disconnect()
+		err := storage.deleteInbox(user, evicted.Id)
+		if err != nil {
+			// The user record no longer references the inbox, so it's just wasted space
+			Log.e("addDevice(): error deleting inbox: %s", err.Error())
+		}
+	}
+
+	return device, nil
+}
+
+// Releases the parked `recv` and the event stream of a removed device
+func (device *Device) disconnect() {
+	if device.RecvWaiter != nil {
+		device.RecvWaiter.Superseded = true
+		close(device.RecvWaiter.Wake)
+		device.RecvWaiter = nil
+	}
+	if device.Subscriber != nil {
+		device.dropSubscriber()
+	}
+}
+
+// Moves the keys of a user stored before multi-device support to `LEGACY_DEVICE_ID`.
+// The storage moves the inbox when it is opened for this device.
+func (user *User) migrateLegacyDevice() {
+	if len(user.Devices) == 0 && (user.LegacySigningKey != "" || user.LegacyMasterKey != "") {
+		prekeys := user.LegacyPrekeys
+		if prekeys == nil {
+			prekeys = make([]string, 0)
+		}
+		user.Devices = []*Device{{
+			Id:         LEGACY_DEVICE_ID,
+			SigningKey: user.LegacySigningKey,
+			MasterKey:  user.LegacyMasterKey,
+			Prekeys:    prekeys,
+		}}
+		user.NextDeviceId = LEGACY_DEVICE_ID + 1
+	}
+	if user.Devices == nil {
+		user.Devices = make([]*Device, 0)
+	}
+	user.NextDeviceId = max(user.NextDeviceId, 1)
+	user.LegacySigningKey = ""
+	user.LegacyMasterKey = ""
+	user.LegacyPrekeys = nil
+}
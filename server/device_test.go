@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func recvTestDevice(t *testing.T, user *User, device uint64) []string {
+	t.Helper()
+	resp, err := recv_restAPI_handler(context.Background(), user, device, RecvRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messagePayloads(resp.Items)
+}
+
+func TestLoginNewDevice(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+
+	second := loginTestDevice(t, alice, "second")
+	if second.Device == TEST_DEVICE {
+		t.Fatal("new keys logged in as the same device")
+	}
+	// The same keys log in as the same device again
+	if again := loginTestDevice(t, alice, "second"); again.Device != second.Device {
+		t.Errorf("device %d, want %d", again.Device, second.Device)
+	}
+
+	// Each device gets its own copy, and receiving on one doesn't remove it from the other
+	putTestMessage(t, alice, "bob", "a")
+	if got := recvTestDevice(t, alice, TEST_DEVICE); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("first device: %v", got)
+	}
+	if got := recvTestDevice(t, alice, second.Device); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("second device: %v", got)
+	}
+
+	// Addressed to one device only
+	respChan := make(chan PutResponse)
+	alice.Put <- PutRequest{
+		Items: []PutItem{{
+			Message: Message{Time: monotonicSeconds(), From: "bob", Type: "msg", Msg: "b"},
+			Device:  &second.Device,
+		}},
+		Response: respChan,
+	}
+	if resp := <-respChan; resp.Results[0].Err != nil {
+		t.Fatal(resp.Results[0].Err)
+	}
+	if got := recvTestDevice(t, alice, TEST_DEVICE); len(got) != 0 {
+		t.Errorf("first device: %v", got)
+	}
+	if got := recvTestDevice(t, alice, second.Device); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("second device: %v", got)
+	}
+}
+
+func TestMaxDevices(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	waiter := startTestRecv(alice, 10)
+	// Let it park
+	time.Sleep(100 * time.Millisecond)
+
+	// All log in within the same second, so the first one is the least recently used
+	for i := 1; i < MAX_DEVICES; i++ {
+		loginTestDevice(t, alice, fmt.Sprintf("device %d", i))
+	}
+	if len(alice.Devices) != MAX_DEVICES {
+		t.Fatalf("%d devices", len(alice.Devices))
+	}
+	loginTestDevice(t, alice, "one too many")
+	if len(alice.Devices) != MAX_DEVICES || alice.device(TEST_DEVICE) != nil {
+		t.Fatalf("devices: %d, first kept: %t", len(alice.Devices), alice.device(TEST_DEVICE) != nil)
+	}
+
+	// The parked `recv` of the removed device is released right away, and the next one fails
+	if result := waitTestRecv(t, waiter); result.err != nil || len(result.resp.Items) != 0 || result.elapsed > time.Second {
+		t.Errorf("released after %s: %+v, %v", result.elapsed, result.resp, result.err)
+	}
+	_, err := recv_restAPI_handler(context.Background(), alice, TEST_DEVICE, RecvRequest{})
+	if err == nil || err.Code != http.StatusUnauthorized {
+		t.Errorf("recv of removed device: %v", err)
+	}
+}
+
+func TestMigrateLegacyDevice(t *testing.T) {
+	user := &User{LegacySigningKey: "sign", LegacyMasterKey: "master", LegacyPrekeys: []string{"k"}}
+	user.migrateLegacyDevice()
+	if len(user.Devices) != 1 || user.NextDeviceId != LEGACY_DEVICE_ID+1 {
+		t.Fatalf("devices %+v, next %d", user.Devices, user.NextDeviceId)
+	}
+	device := user.Devices[0]
+	if device.Id != LEGACY_DEVICE_ID || device.SigningKey != "sign" || device.MasterKey != "master" ||
+		!slices.Equal(device.Prekeys, []string{"k"}) {
+		t.Errorf("device %+v", device)
+	}
+	if user.LegacySigningKey != "" || user.LegacyMasterKey != "" || user.LegacyPrekeys != nil {
+		t.Error("legacy fields kept")
+	}
+
+	// Users without keys never logged in, so they get no device
+	user = &User{}
+	user.migrateLegacyDevice()
+	if user.Devices == nil || len(user.Devices) != 0 || user.NextDeviceId != 1 {
+		t.Errorf("devices %+v, next %d", user.Devices, user.NextDeviceId)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Asks the `user_handler()` to evict the user, as `evictIdleUsers()` does
+func evictTestUser(user *User, idleBefore int64) bool {
+	respChan := make(chan bool)
+	evicted, ok := callUserHandler(user, user.Evict, EvictRequest{IdleBefore: idleBefore, Response: respChan}, respChan)
+	return ok && evicted
+}
+
+func isTestUserLoaded(id uint64) bool {
+	loadedUsers.mutex.Lock()
+	defer loadedUsers.mutex.Unlock()
+	_, found := loadedUsers.users[id]
+	return found
+}
+
+func TestEvictAndReload(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	putTestMessage(t, alice, "bob", "a")
+
+	// Accessed by `addTestUser()` just now
+	if evictTestUser(alice, monotonicSeconds()-1) {
+		t.Fatal("recently accessed user evicted")
+	}
+	if !evictTestUser(alice, monotonicSeconds()+1) {
+		t.Fatal("idle user not evicted")
+	}
+	<-alice.Done
+	if isTestUserLoaded(alice.Id) {
+		t.Fatal("evicted user still loaded")
+	}
+
+	// Loaded again from the storage, with its devices and inboxes
+	reloaded := usersList.Load().userByName("alice")
+	if reloaded == nil || reloaded == alice {
+		t.Fatalf("reloaded %p, evicted %p", reloaded, alice)
+	}
+	if got := messagePayloads(recvTest(t, reloaded, nil).Items); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("inbox after reload: %v", got)
+	}
+}
+
+func TestEvictKeepsWaitingUser(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	waiter := startTestRecv(alice, 10)
+	// Let it park
+	time.Sleep(100 * time.Millisecond)
+	sub := subscribeTestStream(t, alice).Subscriber
+
+	if evictTestUser(alice, monotonicSeconds()+1) {
+		t.Fatal("user with a parked recv evicted")
+	}
+	putTestMessage(t, alice, "bob", "a")
+	waitTestRecv(t, waiter)
+
+	if evictTestUser(alice, monotonicSeconds()+1) {
+		t.Fatal("user with a stream evicted")
+	}
+	unsubscribeTestStream(alice, sub)
+	if !evictTestUser(alice, monotonicSeconds()+1) {
+		t.Error("idle user not evicted")
+	}
+}
+
+func TestEvictAfterRecvGaveUp(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+
+	// Neither a timed out nor a canceled recv keeps the user loaded
+	waitTestRecv(t, startTestRecv(alice, 1))
+	if !evictTestUser(alice, monotonicSeconds()+1) {
+		t.Fatal("user with a timed out recv not evicted")
+	}
+	<-alice.Done
+
+	alice = getUser(alice.Id)
+	if alice == nil {
+		t.Fatal("user not reloaded")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	waiter := startTestRecvContext(ctx, alice, 10)
+	// Let it park
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	waitTestRecv(t, waiter)
+	if !evictTestUser(alice, monotonicSeconds()+1) {
+		t.Error("user with a canceled recv not evicted")
+	}
+}
+
+func TestGetUserConcurrent(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	if !evictTestUser(alice, monotonicSeconds()+1) {
+		t.Fatal("idle user not evicted")
+	}
+	<-alice.Done
+
+	// All callers get the same user, so there is only one `user_handler()`
+	const callers = 20
+	users := make([]*User, callers)
+	var wg sync.WaitGroup
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			users[i] = getUser(alice.Id)
+		}()
+	}
+	wg.Wait()
+	for _, user := range users {
+		if user == nil || user != users[0] {
+			t.Fatalf("got %p and %p", user, users[0])
+		}
+	}
+}
+
+// Holds up loading the user `id` until `release` is closed
+type slowStorage struct {
+	Storage
+	id      uint64
+	release chan struct{}
+	loads   *atomic.Int32
+}
+
+func (s slowStorage) loadUser(id uint64) (*User, error) {
+	if id == s.id {
+		s.loads.Add(1)
+		<-s.release
+	}
+	return s.Storage.loadUser(id)
+}
+
+func TestGetUserWhileLoading(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bob := addTestUser(t, "bob")
+	for _, user := range []*User{alice, bob} {
+		if !evictTestUser(user, monotonicSeconds()+1) {
+			t.Fatal("idle user not evicted")
+		}
+		<-user.Done
+	}
+	slow := slowStorage{Storage: storage, id: alice.Id, release: make(chan struct{}), loads: &atomic.Int32{}}
+	storage = slow
+
+	const callers = 5
+	users := make(chan *User, callers)
+	for range callers {
+		go func() { users <- getUser(alice.Id) }()
+	}
+	// Let them wait for the load
+	time.Sleep(100 * time.Millisecond)
+
+	// Other users are loaded in the meantime
+	if user := getUser(bob.Id); user == nil {
+		t.Fatal("bob not loaded")
+	}
+	if isTestUserLoaded(alice.Id) {
+		t.Fatal("alice loaded before the storage returned")
+	}
+
+	close(slow.release)
+	first := <-users
+	for range callers - 1 {
+		if user := <-users; user == nil || user != first {
+			t.Fatalf("got %p and %p", user, first)
+		}
+	}
+	if loads := slow.loads.Load(); loads != 1 {
+		t.Errorf("loaded %d times", loads)
+	}
+}
+
+func TestGetUserAfterStop(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	stopUserHandlers()
+	if user := getUser(alice.Id); user != nil {
+		t.Error("user loaded after shutdown")
+	}
+}
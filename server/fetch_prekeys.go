@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"slices"
 )
 
 func fetchPrekeys_http_handler(w http.ResponseWriter, r *http.Request) {
@@ -10,68 +11,128 @@ func fetchPrekeys_http_handler(w http.ResponseWriter, r *http.Request) {
 
 type FetchPrekeysRequest struct {
 	Ids []string `json:"ids"`
+
+	// Optional. If set, `Devices[i]` is the device of `Ids[i]` we want a prekey of.
+	// Otherwise, we get a prekey of the device that logged in most recently.
+	Devices []uint64 `json:"devices"`
 }
 
 type FetchPrekeysResponse struct {
 	Prekeys []string `json:"prekeys"`
+
+	// The device each prekey belongs to
+	Devices []uint64 `json:"devices"`
 }
 
-func fetchPrekeys_restAPI_handler(_ *User, req FetchPrekeysRequest) (FetchPrekeysResponse, *RestAPIError) {
+func fetchPrekeys_restAPI_handler(_ *User, _ uint64, req FetchPrekeysRequest) (FetchPrekeysResponse, *RestAPIError) {
+	if req.Devices != nil && len(req.Devices) != len(req.Ids) {
+		return FetchPrekeysResponse{}, NewError("fetchPrekeys: ids and devices differ in length", http.StatusBadRequest)
+	}
+
 	respChan := make(chan FetchPrekeyResponse)
 	defer close(respChan)
 
 	response := FetchPrekeysResponse{
 		Prekeys: make([]string, 0, len(req.Ids)),
+		Devices: make([]uint64, 0, len(req.Ids)),
 	}
 
 	users := usersList.Load()
-	for _, id := range req.Ids {
+	for i, id := range req.Ids {
 		encId, err := encryptedIDfromString(id)
 		if err != nil {
 			response.Prekeys = append(response.Prekeys, "")
+			response.Devices = append(response.Devices, 0)
 			continue
 		}
 		id := encId.decrypt()
 		user := users.userById(id)
 		if user == nil {
 			response.Prekeys = append(response.Prekeys, "")
+			response.Devices = append(response.Devices, 0)
 			continue
 		}
 
-		user.FetchPrekey <- FetchPrekeyRequest{
+		var device *uint64
+		if req.Devices != nil {
+			device = &req.Devices[i]
+		}
+
+		fetch := FetchPrekeyRequest{
+			Device:   device,
 			Response: respChan,
 		}
-		resp := <-respChan
+		resp, ok := callUserHandler(user, user.FetchPrekey, fetch, respChan)
+		if !ok {
+			response.Prekeys = append(response.Prekeys, "")
+			response.Devices = append(response.Devices, 0)
+			continue
+		}
+		if resp.Err != nil {
+			return FetchPrekeysResponse{}, resp.Err
+		}
 
 		response.Prekeys = append(response.Prekeys, resp.Prekey)
+		response.Devices = append(response.Devices, resp.Device)
 	}
 
 	return response, nil
 }
 
 type FetchPrekeyRequest struct {
+	// nil for the device that logged in most recently
+	Device *uint64
+
 	Response chan<- FetchPrekeyResponse
 }
 
 type FetchPrekeyResponse struct {
 	Prekey string
+	Device uint64
+	Err    *RestAPIError
 }
 
-func fetchPrekey_synchronized_handler(user *User, _ FetchPrekeyRequest) FetchPrekeyResponse {
-	cnt := len(user.Prekeys)
+func fetchPrekey_synchronized_handler(user *User, req FetchPrekeyRequest) FetchPrekeyResponse {
+	var device *Device
+	if req.Device != nil {
+		device = user.device(*req.Device)
+	} else {
+		device = user.lastDevice()
+	}
+	if device == nil {
+		Log.i("no such device of %s", redact(user.Username))
+		return FetchPrekeyResponse{
+			Prekey: "",
+		}
+	}
+
+	metrics.PrekeyFetches.inc()
+	cnt := len(device.Prekeys)
 	if cnt > 0 {
-		Log.i("taking a prekey of %s", user.Username)
-		prekey := user.Prekeys[0]
-		user.Prekeys = shift(user.Prekeys, 1)
-		_ = user.save()
+		Log.i("taking a prekey of %s, device %d", redact(user.Username), device.Id)
+		prekey := device.Prekeys[0]
+		oldPrekeys := slices.Clone(device.Prekeys)
+		device.Prekeys = shift(device.Prekeys, 1)
+
+		// If we cannot persist the change, the prekey could be handed out again after restart.
+		err := user.save()
+		if err != nil {
+			device.Prekeys = oldPrekeys
+			return FetchPrekeyResponse{
+				Err: NewError("fetchPrekeys: saving user: "+err.Error(), http.StatusInternalServerError),
+			}
+		}
 
 		return FetchPrekeyResponse{
 			Prekey: prekey,
+			Device: device.Id,
 		}
 	} else {
-		Log.i("no prekeys for %s", user.Username)
+		Log.i("no prekeys for %s, device %d", redact(user.Username), device.Id)
+		metrics.PrekeyFetchesEmpty.inc()
 		return FetchPrekeyResponse{
 			Prekey: "",
+			Device: device.Id,
 		}
 	}
 }
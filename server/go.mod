@@ -1,5 +1,10 @@
-module main
+module loky
 
 go 1.22.2
 
-require golang.org/x/crypto v0.28.0 // indirect
+require (
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/crypto v0.28.0
+)
+
+require golang.org/x/sys v0.26.0 // indirect
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Inbox part file format:
+//
+//	file:    header | record*
+//	header:  "LKIB" | version (uint32)
+//	record:  payload length (uint32) | CRC-32C of payload (uint32) | payload
+//	payload: seq (uint64) | time (int64) | from | type | msg | from device (uint64)
+//
+// Strings are stored as their length (uint32) followed by the bytes, so they can contain
+// anything. All integers are little-endian.
+//
+// Records are only ever appended. If the server crashes in the middle of an append,
+// the last record is torn. This is detected by its length or checksum, and the record
+// is cut off when the inbox is loaded. A damaged record anywhere else is skipped,
+// the file is left as it is.
+
+const INBOX_MAGIC = "LKIB"
+const INBOX_VERSION uint32 = 1
+
+const inboxHeaderSize = 8
+const inboxRecordHeaderSize = 8
+
+// Upper limit for the payload length. Anything bigger is treated as corruption.
+const INBOX_MAX_RECORD_SIZE = 1024 * 1024
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+var errInboxVersion = errors.New("unsupported inbox version")
+
+func inboxHeader() []byte {
+	header := make([]byte, 0, inboxHeaderSize)
+	header = append(header, INBOX_MAGIC...)
+	return binary.LittleEndian.AppendUint32(header, INBOX_VERSION)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+func encodeRecord(msg *Message) []byte {
+	payloadLen := 8 + 8 + 4 + len(msg.From) + 4 + len(msg.Type) + 4 + len(msg.Msg) + 8
+	buf := make([]byte, inboxRecordHeaderSize, inboxRecordHeaderSize+payloadLen)
+	buf = binary.LittleEndian.AppendUint64(buf, msg.Seq)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(msg.Time))
+	buf = appendString(buf, msg.From)
+	buf = appendString(buf, msg.Type)
+	buf = appendString(buf, msg.Msg)
+	buf = binary.LittleEndian.AppendUint64(buf, msg.FromDevice)
+
+	payload := buf[inboxRecordHeaderSize:]
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crc32c))
+	return buf
+}
+
+type payloadReader struct {
+	data []byte
+	err  error
+}
+
+func (r *payloadReader) uint64() uint64 {
+	if r.err != nil || len(r.data) < 8 {
+		r.err = fmt.Errorf("record too short")
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *payloadReader) string() string {
+	if r.err != nil || len(r.data) < 4 {
+		r.err = fmt.Errorf("record too short")
+		return ""
+	}
+	n := binary.LittleEndian.Uint32(r.data)
+	if uint64(n) > uint64(len(r.data)-4) {
+		r.err = fmt.Errorf("string length out of range")
+		return ""
+	}
+	s := string(r.data[4 : 4+n])
+	r.data = r.data[4+n:]
+	return s
+}
+
+func decodePayload(payload []byte) (Message, error) {
+	r := payloadReader{data: payload}
+	msg := Message{
+		Seq:  r.uint64(),
+		Time: int64(r.uint64()),
+		From: r.string(),
+		Type: r.string(),
+		Msg:  r.string(),
+	}
+	msg.FromDevice = r.uint64()
+	if r.err == nil && len(r.data) != 0 {
+		r.err = fmt.Errorf("trailing bytes in record")
+	}
+	return msg, r.err
+}
+
+// Decodes a single record produced by `encodeRecord()`
+func decodeRecord(record []byte) (Message, error) {
+	if len(record) < inboxRecordHeaderSize {
+		return Message{}, fmt.Errorf("record too short")
+	}
+	payload := record[inboxRecordHeaderSize:]
+	if int(binary.LittleEndian.Uint32(record[0:4])) != len(payload) {
+		return Message{}, fmt.Errorf("invalid record length")
+	}
+	if crc32.Checksum(payload, crc32c) != binary.LittleEndian.Uint32(record[4:8]) {
+		return Message{}, fmt.Errorf("invalid record checksum")
+	}
+	return decodePayload(payload)
+}
+
+func isBinaryInbox(data []byte) bool {
+	// Also accept a file with an incomplete header, i.e., a part whose first append was torn
+	n := min(len(data), len(INBOX_MAGIC))
+	return bytes.Equal(data[:n], []byte(INBOX_MAGIC[:n]))
+}
+
+// Decodes the record starting at `pos`. Returns the offset of the next record.
+func decodeRecordAt(data []byte, pos int) (Message, int, error) {
+	if len(data)-pos < inboxRecordHeaderSize {
+		return Message{}, 0, fmt.Errorf("record too short")
+	}
+	payloadLen := int(binary.LittleEndian.Uint32(data[pos:]))
+	if payloadLen > INBOX_MAX_RECORD_SIZE || payloadLen > len(data)-pos-inboxRecordHeaderSize {
+		return Message{}, 0, fmt.Errorf("invalid record length")
+	}
+	end := pos + inboxRecordHeaderSize + payloadLen
+	msg, err := decodeRecord(data[pos:end])
+	return msg, end, err
+}
+
+// Finds the first well-formed record after `pos` that continues the sequence.
+// Returns -1 if there is none.
+//
+// Requiring `Seq > lastSeq` keeps us from picking up something that only looks
+// like a record, e.g., a message that contains an encoded record.
+func resyncRecord(data []byte, pos int, lastSeq uint64) int {
+	for ; pos+inboxRecordHeaderSize <= len(data); pos++ {
+		msg, _, err := decodeRecordAt(data, pos)
+		if err == nil && msg.Seq > lastSeq {
+			return pos
+		}
+	}
+	return -1
+}
+
+// Decodes the content of a binary inbox part file.
+//
+// `validLen` is the length of `data` without a torn record at the end. If it's less than
+// `len(data)`, the file ends with a torn record, and `err` says so.
+//
+// Damaged records in the middle of the file are skipped. The decoding continues with
+// the next well-formed record, so a single bad record doesn't take the following ones with it.
+// `err` reports them as well, but `validLen` stays `len(data)`.
+func decodeInboxFile(data []byte) (messages []Message, validLen int, err error) {
+	if len(data) == 0 {
+		return nil, 0, nil
+	}
+	if len(data) < inboxHeaderSize {
+		return nil, 0, fmt.Errorf("torn header")
+	}
+	version := binary.LittleEndian.Uint32(data[4:8])
+	if version != INBOX_VERSION {
+		return nil, 0, errInboxVersion
+	}
+
+	pos := inboxHeaderSize
+	var lastSeq uint64
+	skipped := 0
+	for pos < len(data) {
+		msg, end, err := decodeRecordAt(data, pos)
+		if err == nil {
+			messages = append(messages, msg)
+			lastSeq = msg.Seq
+			pos = end
+			continue
+		}
+
+		next := resyncRecord(data, pos+1, lastSeq)
+		if next < 0 {
+			// Nothing valid follows, so this is an append cut short by a crash
+			return messages, pos, fmt.Errorf("torn record at offset %d: %s", pos, err.Error())
+		}
+		Log.e("Skipping %d bytes of damaged inbox records at offset %d: %s", next-pos, pos, err.Error())
+		skipped++
+		pos = next
+	}
+	if skipped > 0 {
+		return messages, pos, fmt.Errorf("skipped %d damaged parts of the file", skipped)
+	}
+	return messages, pos, nil
+}
+
+func readInboxFile(file string) ([]Message, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	messages, _, err := decodeInboxFile(data)
+	return messages, err
+}
+
+func writeInboxFile(file string, messages []Message) error {
+	data := inboxHeader()
+	for i := range messages {
+		data = append(data, encodeRecord(&messages[i])...)
+	}
+
+	return writeFileAtomic(file, data, 0644)
+}
+
+// Parses the old text format, one message per line: `time from type msg`.
+// It has no sequence numbers, `Seq` is left at 0.
+//
+// Malformed lines are skipped. An error is only returned if the data can't be read to the end.
+func decodeTextInboxFile(data []byte) ([]Message, error) {
+	messages := make([]Message, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, INBOX_MAX_RECORD_SIZE)
+	for line := 1; scanner.Scan(); line++ {
+		msg, err := decodeTextLine(scanner.Text())
+		if err != nil {
+			Log.e("Skipping inbox line %d: %s", line, err.Error())
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages, scanner.Err()
+}
+
+func decodeTextLine(line string) (Message, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) != 4 {
+		return Message{}, fmt.Errorf("invalid line: %s", line)
+	}
+	var msg Message
+	var err error
+	msg.Time, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return Message{}, fmt.Errorf("invalid time: %s", fields[0])
+	}
+	msg.From = fields[1]
+	msg.Type = fields[2]
+	msg.Msg = fields[3]
+	return msg, nil
+}
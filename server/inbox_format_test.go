@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func encodeTestInbox(msgs []Message) []byte {
+	data := inboxHeader()
+	for i := range msgs {
+		data = append(data, encodeRecord(&msgs[i])...)
+	}
+	return data
+}
+
+func sequencedMessages(payloads ...string) []Message {
+	msgs := make([]Message, 0, len(payloads))
+	for i, payload := range payloads {
+		msgs = append(msgs, Message{Seq: uint64(i + 1), Time: 1000, From: "alice", Type: "msg", Msg: payload, FromDevice: 2})
+	}
+	return msgs
+}
+
+func TestDecodeInboxFile(t *testing.T) {
+	msgs := sequencedMessages("a", "", "with spaces and\nnewlines")
+	data := encodeTestInbox(msgs)
+
+	decoded, validLen, err := decodeInboxFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validLen != len(data) {
+		t.Errorf("validLen = %d, want %d", validLen, len(data))
+	}
+	if !slices.Equal(decoded, msgs) {
+		t.Errorf("decoded %v, want %v", decoded, msgs)
+	}
+}
+
+func TestDecodeInboxFileTornRecord(t *testing.T) {
+	msgs := sequencedMessages("a", "b", "c")
+	data := encodeTestInbox(msgs)
+	complete := len(data) - len(encodeRecord(&msgs[2]))
+
+	// Every way the last append can be cut short
+	for cut := complete + 1; cut < len(data); cut++ {
+		decoded, validLen, err := decodeInboxFile(data[:cut])
+		if err == nil {
+			t.Fatalf("cut at %d: no error", cut)
+		}
+		if validLen != complete {
+			t.Errorf("cut at %d: validLen = %d, want %d", cut, validLen, complete)
+		}
+		if !slices.Equal(messagePayloads(decoded), []string{"a", "b"}) {
+			t.Errorf("cut at %d: decoded %v", cut, messagePayloads(decoded))
+		}
+	}
+}
+
+func TestDecodeInboxFileCorruptRecord(t *testing.T) {
+	msgs := sequencedMessages("a", "b", "c", "d")
+	second := inboxHeaderSize + len(encodeRecord(&msgs[0]))
+
+	tests := []struct {
+		name    string
+		corrupt func(data []byte)
+	}{
+		{"payload", func(data []byte) { data[second+inboxRecordHeaderSize+20] ^= 0xff }},
+		{"checksum", func(data []byte) { data[second+4] ^= 0xff }},
+		{"length", func(data []byte) { binary.LittleEndian.PutUint32(data[second:], 0xffffff) }},
+		{"shorter length", func(data []byte) { data[second] -= 3 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := encodeTestInbox(msgs)
+			test.corrupt(data)
+
+			decoded, validLen, err := decodeInboxFile(data)
+			// Nothing is cut off, the damage is not at the end
+			if validLen != len(data) {
+				t.Errorf("validLen = %d, want %d", validLen, len(data))
+			}
+			if err == nil {
+				t.Error("no error")
+			}
+			if !slices.Equal(messagePayloads(decoded), []string{"a", "c", "d"}) {
+				t.Errorf("decoded %v", messagePayloads(decoded))
+			}
+		})
+	}
+}
+
+func TestDecodeInboxFileVersion(t *testing.T) {
+	data := encodeTestInbox(sequencedMessages("a"))
+	binary.LittleEndian.PutUint32(data[4:8], INBOX_VERSION+1)
+
+	_, _, err := decodeInboxFile(data)
+	if err != errInboxVersion {
+		t.Errorf("err = %v, want %v", err, errInboxVersion)
+	}
+}
+
+func TestDecodeRecordWithoutFromDevice(t *testing.T) {
+	record := encodeRecord(&sequencedMessages("a")[0])
+	payload := record[inboxRecordHeaderSize : len(record)-8]
+	if _, err := decodePayload(payload); err == nil {
+		t.Error("record without from device accepted")
+	}
+}
+
+func TestDecodeTextInboxFile(t *testing.T) {
+	data := []byte("1000 alice msg hello\n" +
+		"not a message\n" +
+		"7 1000 alice msg extra-field\n" +
+		"1001 bob msg again\n")
+
+	decoded, err := decodeTextInboxFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Message{
+		{Time: 1000, From: "alice", Type: "msg", Msg: "hello"},
+		{Time: 1001, From: "bob", Type: "msg", Msg: "again"},
+	}
+	if !slices.Equal(decoded, want) {
+		t.Errorf("decoded %v, want %v", decoded, want)
+	}
+}
+
+func TestLoadPartFile(t *testing.T) {
+	msgs := sequencedMessages("a", "b", "c")
+	data := encodeTestInbox(msgs)
+	complete := len(data) - len(encodeRecord(&msgs[2]))
+
+	t.Run("torn record is cut off", func(t *testing.T) {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "00000000000000001000")
+		writeTestFile(t, file, data[:len(data)-1])
+
+		inbox := newFsInbox(dir)
+		loaded, err := inbox.loadPartFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(messagePayloads(loaded), []string{"a", "b"}) {
+			t.Errorf("loaded %v", messagePayloads(loaded))
+		}
+		if size := fileSize(t, file); size != int64(complete) {
+			t.Errorf("file size = %d, want %d", size, complete)
+		}
+	})
+
+	t.Run("damaged record is left in place", func(t *testing.T) {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "00000000000000001000")
+		damaged := slices.Clone(data)
+		damaged[inboxHeaderSize+4] ^= 0xff
+		writeTestFile(t, file, damaged)
+
+		inbox := newFsInbox(dir)
+		loaded, err := inbox.loadPartFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(messagePayloads(loaded), []string{"b", "c"}) {
+			t.Errorf("loaded %v", messagePayloads(loaded))
+		}
+		if size := fileSize(t, file); size != int64(len(data)) {
+			t.Errorf("file size = %d, want %d", size, len(data))
+		}
+	})
+
+	t.Run("text file is converted", func(t *testing.T) {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "00000000000000001000")
+		writeTestFile(t, file, []byte("1000 alice msg a\n1000 alice msg b\n"))
+
+		inbox := newFsInbox(dir)
+		loaded, err := inbox.loadPartFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(loaded) != 2 || loaded[0].Seq != 1 || loaded[1].Seq != 2 {
+			t.Errorf("loaded %v", loaded)
+		}
+		converted, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isBinaryInbox(converted) {
+			t.Error("file was not converted")
+		}
+	})
+}
+
+func writeTestFile(t *testing.T, file string, data []byte) {
+	t.Helper()
+	err := os.WriteFile(file, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, file string) int64 {
+	t.Helper()
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
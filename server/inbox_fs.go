@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Inbox stored as a directory of part files. Each part contains the messages received
+// during `SWITCH_INBOX_SEC`, so whole parts can be removed when their messages expire.
+type FsInbox struct {
+	Dir   string
+	Parts []InboxPart
+
+	// `Seq` of the next message added to the inbox
+	NextSeq uint64
+
+	// All messages with `Seq <= Acked` were acknowledged by the client
+	Acked uint64
+}
+
+func newFsInbox(dir string) *FsInbox {
+	return &FsInbox{
+		Dir:     dir,
+		Parts:   make([]InboxPart, 0),
+		NextSeq: 1,
+		Acked:   0,
+	}
+}
+
+func (inbox *FsInbox) removeExpiredParts(now int64) {
+	// Note that inbox parts are sorted by their start time
+	firstNotExpired := find_first(
+		inbox.Parts,
+		func(p InboxPart) bool { return p.canContainUnexpiredMessages(now) },
+	)
+	if firstNotExpired == 0 {
+		return
+	}
+
+	// The expired messages are acknowledged before their parts are removed. Otherwise,
+	// if they were the newest messages, `loadFsInbox()` would give out their sequence
+	// numbers again, and a client still holding the old cursor would acknowledge
+	// new messages it has never received.
+	lastSeq := inbox.Acked
+	for i := 0; i < firstNotExpired; i++ {
+		lastSeq = max(lastSeq, inbox.Parts[i].LastSeq)
+	}
+	if lastSeq > inbox.Acked {
+		acked := inbox.Acked
+		inbox.Acked = lastSeq
+		if err := inbox.saveAcked(); err != nil {
+			// Keep the parts, they are removed on the next try
+			Log.e("Error saving inbox ack: %s", err.Error())
+			inbox.Acked = acked
+			return
+		}
+	}
+
+	for i := 0; i < firstNotExpired; i++ {
+		// Ignoring errors here. Not sure I can do anything about them.
+		_ = os.Remove(inbox.Parts[i].File)
+	}
+	inbox.Parts = shift(inbox.Parts, firstNotExpired)
+	metrics.InboxExpiredPartsDeleted.add(firstNotExpired)
+}
+
+func (inbox *FsInbox) clear() {
+	for _, part := range inbox.Parts {
+		_ = os.Remove(part.File)
+	}
+	inbox.Parts = inbox.Parts[:0]
+
+	// Sequence numbers keep growing, so that a late acknowledgement
+	// cannot remove messages added after the reset.
+	inbox.Acked = inbox.NextSeq - 1
+	if err := inbox.saveAcked(); err != nil {
+		Log.e("Error saving inbox ack: %s", err.Error())
+	}
+}
+
+func (inbox *FsInbox) addPart(now int64) *InboxPart {
+	part := newInboxPart(inbox.Dir, now)
+	inbox.Parts = append(inbox.Parts, part)
+	return &inbox.Parts[len(inbox.Parts)-1]
+}
+
+func (inbox *FsInbox) getPart(now int64) *InboxPart {
+	partCnt := len(inbox.Parts)
+	if partCnt > 0 && inbox.Parts[partCnt-1].canAdd(now) {
+		// We have an inbox part that's not too old, so we can use it
+		return &inbox.Parts[partCnt-1]
+	} else {
+		// We either don't have any inbox parts, or the last one is too old.
+		// Create a new one
+		inbox.removeExpiredParts(now)
+		return inbox.addPart(now)
+	}
+}
+
+func (inbox *FsInbox) addMessages(msgs []Message) *RestAPIError {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	// Get usable inbox part or create a new one
+	inboxPart := inbox.getPart(msgs[0].Time)
+
+	// Write the messages to the inbox part
+	Log.d("Writing %d messages to file: %s", len(msgs), inboxPart.File)
+	f, err := os.OpenFile(inboxPart.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return NewError("opening file: "+err.Error(), http.StatusInternalServerError)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return NewError("opening file: "+err.Error(), http.StatusInternalServerError)
+	}
+	size := info.Size()
+
+	var records []byte
+	if size == 0 {
+		records = inboxHeader()
+	}
+	for i := range msgs {
+		msgs[i].Seq = inbox.NextSeq + uint64(i)
+		records = append(records, encodeRecord(&msgs[i])...)
+	}
+	_, err = f.Write(records)
+	if err != nil {
+		// Don't leave a partial record behind. The following records would be unreadable.
+		_ = f.Truncate(size)
+		return NewError("writing to file: "+err.Error(), http.StatusInternalServerError)
+	}
+	inbox.NextSeq += uint64(len(msgs))
+	inboxPart.LastSeq = msgs[len(msgs)-1].Seq
+
+	return nil
+}
+
+func (part *InboxPart) getMessages(now int64, acked uint64, messages []Message) []Message {
+	partMessages, err := readInboxFile(part.File)
+	if err != nil {
+		Log.e("Error reading messages from %s: %s", redactPath(part.File), redactError(err))
+	}
+
+	validRange := messageValidRange(now)
+
+	for _, msg := range partMessages {
+		if msg.Seq > acked && validRange.contains(msg.Time) {
+			msg.Time = now - msg.Time
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+func (inbox *FsInbox) getMessages(now int64) ([]Message, *RestAPIError) {
+	inbox.removeExpiredParts(now)
+
+	messages := make([]Message, 0)
+	for _, part := range inbox.Parts {
+		if part.LastSeq > inbox.Acked {
+			messages = part.getMessages(now, inbox.Acked, messages)
+		}
+	}
+
+	return messages, nil
+}
+
+// Removes inbox parts that no longer contain any unacknowledged messages.
+// The acknowledgement of the remaining messages is remembered in the `acked` file.
+func (inbox *FsInbox) ack(seq uint64) *RestAPIError {
+	// The client cannot acknowledge messages it hasn't received yet
+	seq = min(seq, inbox.NextSeq-1)
+	if seq <= inbox.Acked {
+		return nil
+	}
+
+	inbox.Acked = seq
+	err := inbox.saveAcked()
+	if err != nil {
+		return NewError("saving ack: "+err.Error(), http.StatusInternalServerError)
+	}
+
+	// Note that inbox parts are sorted by their sequence numbers
+	firstUnacked := find_first(
+		inbox.Parts,
+		func(p InboxPart) bool { return p.LastSeq > seq },
+	)
+	for i := 0; i < firstUnacked; i++ {
+		_ = os.Remove(inbox.Parts[i].File)
+	}
+	inbox.Parts = shift(inbox.Parts, firstUnacked)
+
+	return nil
+}
+
+func (inbox *FsInbox) ackedFile() string {
+	return filepath.Join(inbox.Dir, "acked")
+}
+
+func (inbox *FsInbox) saveAcked() error {
+	return writeFileAtomic(inbox.ackedFile(), []byte(fmt.Sprintf("%d\n", inbox.Acked)), 0644)
+}
+
+func (inbox *FsInbox) loadAcked() error {
+	var err error
+	inbox.Acked, err = readAcked(inbox.ackedFile())
+	return err
+}
+
+func readAcked(file string) (uint64, error) {
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(bytes)), 10, 64)
+}
+
+type InboxPart struct {
+	FirstMessageTimestamp int64
+	File                  string
+
+	// `Seq` of the last message in the part
+	LastSeq uint64
+}
+
+func newInboxPart(dir string, now int64) InboxPart {
+	return InboxPart{
+		FirstMessageTimestamp: now,
+		File:                  inboxFile(dir, now),
+	}
+}
+
+func (p *InboxPart) canAdd(now int64) bool {
+	return timeRange(p.FirstMessageTimestamp, SWITCH_INBOX_SEC).contains(now)
+}
+
+func (p *InboxPart) canContainUnexpiredMessages(now int64) bool {
+	msgValidRange := messageValidRange(now)
+	partRange := timeRange(p.FirstMessageTimestamp, SWITCH_INBOX_SEC+1)
+	return partRange.overlaps(msgValidRange)
+}
+
+func inboxFile(dir string, time int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d", time))
+}
+
+// Reads an inbox part file while loading the inbox.
+// Old text files are converted to the binary format, a torn record at the end is cut off.
+// Damaged records elsewhere are skipped, but stay in the file.
+func (inbox *FsInbox) loadPartFile(file string) ([]Message, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isBinaryInbox(data) {
+		Log.i("loadInbox(): converting %s to the binary format", redactPath(file))
+		messages, err := decodeTextInboxFile(data)
+		if err != nil {
+			// Converting would drop whatever couldn't be read
+			return nil, err
+		}
+		// The text format has no sequence numbers
+		for i := range messages {
+			messages[i].Seq = inbox.NextSeq
+			inbox.NextSeq++
+		}
+		return messages, writeInboxFile(file, messages)
+	}
+
+	messages, validLen, err := decodeInboxFile(data)
+	if err == errInboxVersion {
+		return nil, err
+	}
+	if err != nil {
+		Log.w("loadInbox(): %s: %s", redactPath(file), err.Error())
+		if validLen < len(data) {
+			err = os.Truncate(file, int64(validLen))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return messages, nil
+}
+
+func loadFsInbox(dir string) (*FsInbox, error) {
+	inbox := newFsInbox(dir)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := inbox.loadAcked(); err != nil {
+		return nil, err
+	}
+	inbox.NextSeq = inbox.Acked + 1
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		timestampStr := filepath.Base(file)
+		timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		messages, err := inbox.loadPartFile(file)
+		if err != nil {
+			Log.e("loadInbox(): skipping %s: %s", redactPath(file), redactError(err))
+			continue
+		}
+		for i := range messages {
+			inbox.NextSeq = max(inbox.NextSeq, messages[i].Seq+1)
+		}
+
+		part := InboxPart{
+			FirstMessageTimestamp: timestamp,
+			File:                  file,
+		}
+		if len(messages) > 0 {
+			part.LastSeq = messages[len(messages)-1].Seq
+		}
+		inbox.Parts = append(inbox.Parts, part)
+	}
+
+	return inbox, nil
+}
+
+// Read-only counterpart of `loadFsInbox()`, see `Storage.inspectInbox()`
+func inspectFsInbox(dir string, now int64) (InboxStats, error) {
+	stats := InboxStats{Problems: make([]string, 0)}
+	acked, err := readAcked(filepath.Join(dir, "acked"))
+	if err != nil {
+		return stats, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return stats, err
+	}
+
+	validRange := messageValidRange(now)
+	for _, file := range files {
+		name := filepath.Base(file)
+		if _, err := strconv.ParseInt(name, 10, 64); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			stats.Problems = append(stats.Problems, fmt.Sprintf("%s: %s", name, redactError(err)))
+			continue
+		}
+
+		var messages []Message
+		if isBinaryInbox(data) {
+			messages, _, err = decodeInboxFile(data)
+		} else {
+			messages, err = decodeTextInboxFile(data)
+		}
+		if err != nil {
+			stats.Problems = append(stats.Problems, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+		for i := range messages {
+			// Not converted yet. They get sequence numbers after `acked` when they are.
+			if messages[i].Seq == 0 {
+				messages[i].Seq = acked + 1
+			}
+			stats.count(&messages[i], acked, validRange)
+		}
+	}
+	return stats, nil
+}
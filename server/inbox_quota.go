@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Limits on what a device's inbox can hold, configured in `config.json` under `inbox_quota`.
+// Only unacknowledged messages that haven't expired count.
+//
+// When a message doesn't fit, `Policy` decides what happens:
+//
+//   - `reject_newest`: the new message is rejected.
+//   - `drop_oldest`: the oldest messages are removed to make room, as if they had been
+//     acknowledged. Useful when newer messages make older ones obsolete, e.g., location updates.
+//
+// Independently of the policy, one sender can have at most `MaxPerSender` messages in
+// an inbox. Further messages from that sender are rejected, so one contact can't crowd
+// out everyone else.
+type InboxQuota struct {
+	MaxMessages  int    `json:"max_messages"`
+	MaxBytes     int64  `json:"max_bytes"`
+	MaxPerSender int    `json:"max_per_sender"` // 0 means no limit
+	Policy       string `json:"policy"`
+}
+
+const INBOX_QUOTA_REJECT_NEWEST = "reject_newest"
+const INBOX_QUOTA_DROP_OLDEST = "drop_oldest"
+
+func defaultInboxQuota() *InboxQuota {
+	return &InboxQuota{
+		MaxMessages:  5000,
+		MaxBytes:     16 * 1024 * 1024,
+		MaxPerSender: 1000,
+		Policy:       INBOX_QUOTA_DROP_OLDEST,
+	}
+}
+
+func (quota *InboxQuota) validate() error {
+	if quota.MaxMessages < 1 || quota.MaxBytes < 1 || quota.MaxPerSender < 0 {
+		return fmt.Errorf("limits must be positive")
+	}
+	if quota.Policy != INBOX_QUOTA_REJECT_NEWEST && quota.Policy != INBOX_QUOTA_DROP_OLDEST {
+		return fmt.Errorf("unknown policy: %s", quota.Policy)
+	}
+	return nil
+}
+
+// Returned by `addMessages()` when the message doesn't fit into the inbox.
+// Not a failure of the request, the sender gets it as the result of the item.
+var errInboxQuotaExceeded = NewError("inbox quota exceeded", http.StatusTooManyRequests)
+
+type QuotaInboxEntry struct {
+	Seq  uint64
+	Time int64 // seconds since `referenceTime`
+	From string
+	Size int64
+}
+
+// Enforces `config.InboxQuota` on top of the inbox of a storage backend.
+//
+// Keeps track of the unacknowledged messages in memory. The list is built on the first
+// `addMessages()` and refreshed by every `getMessages()`, which returns all of them anyway.
+type QuotaInbox struct {
+	Inbox
+
+	loaded    bool
+	entries   []QuotaInboxEntry // sorted by `Seq`
+	bytes     int64
+	perSender map[string]int
+}
+
+func newQuotaInbox(inbox Inbox) *QuotaInbox {
+	return &QuotaInbox{Inbox: inbox}
+}
+
+func messageSize(msg *Message) int64 {
+	return int64(len(msg.From) + len(msg.Type) + len(msg.Msg))
+}
+
+func (inbox *QuotaInbox) reset() {
+	inbox.loaded = true
+	inbox.entries = inbox.entries[:0]
+	inbox.bytes = 0
+	inbox.perSender = make(map[string]int)
+}
+
+func (inbox *QuotaInbox) push(entry QuotaInboxEntry) {
+	inbox.entries = append(inbox.entries, entry)
+	inbox.bytes += entry.Size
+	inbox.perSender[entry.From]++
+}
+
+func (inbox *QuotaInbox) forget(entries []QuotaInboxEntry) {
+	for _, entry := range entries {
+		inbox.bytes -= entry.Size
+		inbox.perSender[entry.From]--
+		if inbox.perSender[entry.From] == 0 {
+			delete(inbox.perSender, entry.From)
+		}
+	}
+}
+
+// Removes the first `n` entries
+func (inbox *QuotaInbox) shift(n int) {
+	inbox.forget(inbox.entries[:n])
+	inbox.entries = shift(inbox.entries, n)
+}
+
+func (inbox *QuotaInbox) removeExpired(now int64) {
+	validRange := messageValidRange(now)
+	expired := slices.IndexFunc(inbox.entries, func(e QuotaInboxEntry) bool { return validRange.contains(e.Time) })
+	if expired < 0 {
+		expired = len(inbox.entries)
+	}
+	inbox.shift(expired)
+}
+
+func (inbox *QuotaInbox) getMessages(now int64) ([]Message, *RestAPIError) {
+	msgs, err := inbox.Inbox.getMessages(now)
+	if err != nil {
+		return nil, err
+	}
+	inbox.reset()
+	for i := range msgs {
+		inbox.push(QuotaInboxEntry{
+			Seq:  msgs[i].Seq,
+			Time: now - msgs[i].Time,
+			From: msgs[i].From,
+			Size: messageSize(&msgs[i]),
+		})
+	}
+	return msgs, nil
+}
+
+func (inbox *QuotaInbox) ack(seq uint64) *RestAPIError {
+	err := inbox.Inbox.ack(seq)
+	if err != nil {
+		return err
+	}
+	acked := slices.IndexFunc(inbox.entries, func(e QuotaInboxEntry) bool { return e.Seq > seq })
+	if acked < 0 {
+		acked = len(inbox.entries)
+	}
+	inbox.shift(acked)
+	return nil
+}
+
+func (inbox *QuotaInbox) clear() {
+	inbox.Inbox.clear()
+	inbox.reset()
+}
+
+// Adds the messages that fit into the quota in one write.
+// Returns the result for each message: nil if it was added, `errInboxQuotaExceeded`,
+// or the error of the write. On success, the `Seq` field of the message is set.
+func (inbox *QuotaInbox) addMessages(msgs []Message) []*RestAPIError {
+	results := make([]*RestAPIError, len(msgs))
+	if len(msgs) == 0 {
+		return results
+	}
+
+	now := msgs[0].Time
+	if !inbox.loaded {
+		_, err := inbox.getMessages(now)
+		if err != nil {
+			for i := range results {
+				results[i] = err
+			}
+			return results
+		}
+	}
+	inbox.removeExpired(now)
+
+	// The accepted messages are added to `entries` right away, with `Seq` 0,
+	// so that the next ones are checked against them.
+	pending := len(inbox.entries)
+	accepted := make([]Message, 0, len(msgs))
+	acceptedIndex := make([]int, 0, len(msgs))
+	first := firstThatFit(msgs)
+	for i := range msgs {
+		size := messageSize(&msgs[i])
+		ok := i >= first
+		if ok {
+			var dropped int
+			dropped, ok = inbox.makeRoom(msgs[i].From, size, pending)
+			pending -= dropped
+		}
+		if !ok {
+			metrics.InboxQuotaRejected.inc()
+			results[i] = errInboxQuotaExceeded
+			continue
+		}
+		inbox.push(QuotaInboxEntry{
+			Time: msgs[i].Time,
+			From: msgs[i].From,
+			Size: size,
+		})
+		accepted = append(accepted, msgs[i])
+		acceptedIndex = append(acceptedIndex, i)
+	}
+
+	err := inbox.Inbox.addMessages(accepted)
+	if err != nil {
+		inbox.dropPending(pending)
+		for _, i := range acceptedIndex {
+			results[i] = err
+		}
+		return results
+	}
+	for j, i := range acceptedIndex {
+		msgs[i].Seq = accepted[j].Seq
+		inbox.entries[pending+j].Seq = accepted[j].Seq
+	}
+	return results
+}
+
+// Under `drop_oldest`, the newest messages win, also within one batch. Returns the index
+// of the first message of the batch that can stay. The ones before it would be dropped
+// by the later ones right away.
+func firstThatFit(msgs []Message) int {
+	quota := config.InboxQuota
+	if quota.Policy != INBOX_QUOTA_DROP_OLDEST {
+		return 0
+	}
+	count, bytes := 0, int64(0)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		size := messageSize(&msgs[i])
+		if size > quota.MaxBytes {
+			continue
+		}
+		if count+1 > quota.MaxMessages || bytes+size > quota.MaxBytes {
+			return i + 1
+		}
+		count++
+		bytes += size
+	}
+	return 0
+}
+
+// Checks whether a message fits into the quota. Under the `drop_oldest` policy,
+// removes old messages to make room and returns how many. Only the first `pending`
+// entries can be removed, the others are not written yet.
+func (inbox *QuotaInbox) makeRoom(from string, size int64, pending int) (int, bool) {
+	quota := config.InboxQuota
+	if size > quota.MaxBytes {
+		return 0, false
+	}
+	if quota.MaxPerSender > 0 && inbox.perSender[from] >= quota.MaxPerSender {
+		return 0, false
+	}
+
+	// How many of the oldest messages have to go
+	drop := 0
+	count, bytes := len(inbox.entries), inbox.bytes
+	for count >= quota.MaxMessages || bytes+size > quota.MaxBytes {
+		count--
+		bytes -= inbox.entries[drop].Size
+		drop++
+	}
+	if drop == 0 {
+		return 0, true
+	}
+	if quota.Policy != INBOX_QUOTA_DROP_OLDEST || drop > pending {
+		return 0, false
+	}
+	err := inbox.Inbox.ack(inbox.entries[drop-1].Seq)
+	if err != nil {
+		Log.e("Error dropping old messages: %s", err.Error())
+		return 0, false
+	}
+	inbox.shift(drop)
+	metrics.InboxQuotaDropped.add(drop)
+	return drop, true
+}
+
+// Removes the entries of messages that failed to be written
+func (inbox *QuotaInbox) dropPending(pending int) {
+	inbox.forget(inbox.entries[pending:])
+	inbox.entries = inbox.entries[:pending]
+}
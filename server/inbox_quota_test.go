@@ -0,0 +1,178 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func newTestQuotaInbox(t *testing.T, quota InboxQuota) *QuotaInbox {
+	t.Helper()
+	setupTest(t)
+	config.InboxQuota = &quota
+
+	inbox, err := storage.openInbox(&User{Id: 42}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newQuotaInbox(inbox)
+}
+
+// Adds the messages in one batch and returns which of them were accepted
+func addQuotaMessages(t *testing.T, inbox *QuotaInbox, now int64, from string, payloads ...string) []bool {
+	t.Helper()
+	msgs := make([]Message, 0, len(payloads))
+	for _, payload := range payloads {
+		msgs = append(msgs, Message{Time: now, From: from, Type: "msg", Msg: payload, FromDevice: 1})
+	}
+	accepted := make([]bool, 0, len(payloads))
+	for _, err := range inbox.addMessages(msgs) {
+		if err != nil && err != errInboxQuotaExceeded {
+			t.Fatal(err)
+		}
+		accepted = append(accepted, err == nil)
+	}
+	return accepted
+}
+
+func TestInboxQuotaRejectNewest(t *testing.T) {
+	inbox := newTestQuotaInbox(t, InboxQuota{MaxMessages: 3, MaxBytes: 1000, Policy: INBOX_QUOTA_REJECT_NEWEST})
+	now := int64(100 * DAY)
+
+	addQuotaMessages(t, inbox, now, "alice", "a", "b", "c")
+	if accepted := addQuotaMessages(t, inbox, now, "alice", "d"); accepted[0] {
+		t.Error("message over the quota accepted")
+	}
+	if got := getTestMessages(t, inbox, now); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("got %v", got)
+	}
+
+	// Acknowledged messages make room
+	if err := inbox.ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if accepted := addQuotaMessages(t, inbox, now, "alice", "e"); !accepted[0] {
+		t.Error("message rejected after ack")
+	}
+}
+
+func TestInboxQuotaDropOldest(t *testing.T) {
+	inbox := newTestQuotaInbox(t, InboxQuota{MaxMessages: 3, MaxBytes: 1000, Policy: INBOX_QUOTA_DROP_OLDEST})
+	now := int64(100 * DAY)
+
+	for _, payload := range []string{"a", "b", "c", "d"} {
+		if accepted := addQuotaMessages(t, inbox, now, "alice", payload); !accepted[0] {
+			t.Errorf("%s rejected", payload)
+		}
+	}
+	if got := getTestMessages(t, inbox, now); !slices.Equal(got, []string{"b", "c", "d"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestInboxQuotaDropOldestInBatch(t *testing.T) {
+	inbox := newTestQuotaInbox(t, InboxQuota{MaxMessages: 3, MaxBytes: 1000, Policy: INBOX_QUOTA_DROP_OLDEST})
+	now := int64(100 * DAY)
+
+	addQuotaMessages(t, inbox, now, "alice", "a")
+	accepted := addQuotaMessages(t, inbox, now, "alice", "b", "c", "d", "e", "f")
+	if !slices.Equal(accepted, []bool{false, false, true, true, true}) {
+		t.Errorf("accepted %v", accepted)
+	}
+	if got := getTestMessages(t, inbox, now); !slices.Equal(got, []string{"d", "e", "f"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestInboxQuotaBytes(t *testing.T) {
+	for _, policy := range []string{INBOX_QUOTA_REJECT_NEWEST, INBOX_QUOTA_DROP_OLDEST} {
+		t.Run(policy, func(t *testing.T) {
+			// "alice" + "msg" + payload, so each message below takes 10 bytes
+			inbox := newTestQuotaInbox(t, InboxQuota{MaxMessages: 100, MaxBytes: 25, Policy: policy})
+			now := int64(100 * DAY)
+
+			if accepted := addQuotaMessages(t, inbox, now, "alice", "this one is too big"); accepted[0] {
+				t.Error("message bigger than the quota accepted")
+			}
+			addQuotaMessages(t, inbox, now, "alice", "aa", "bb")
+			accepted := addQuotaMessages(t, inbox, now, "alice", "cc")
+			if accepted[0] != (policy == INBOX_QUOTA_DROP_OLDEST) {
+				t.Errorf("accepted = %t", accepted[0])
+			}
+		})
+	}
+}
+
+func TestInboxQuotaPerSender(t *testing.T) {
+	for _, policy := range []string{INBOX_QUOTA_REJECT_NEWEST, INBOX_QUOTA_DROP_OLDEST} {
+		t.Run(policy, func(t *testing.T) {
+			inbox := newTestQuotaInbox(t, InboxQuota{MaxMessages: 100, MaxBytes: 1000, MaxPerSender: 2, Policy: policy})
+			now := int64(100 * DAY)
+
+			// Even under `drop_oldest`, a sender can't push out its own messages
+			accepted := addQuotaMessages(t, inbox, now, "alice", "a", "b", "c")
+			if !slices.Equal(accepted, []bool{true, true, false}) {
+				t.Errorf("alice: accepted %v", accepted)
+			}
+			if accepted := addQuotaMessages(t, inbox, now, "bob", "d"); !accepted[0] {
+				t.Error("bob rejected")
+			}
+		})
+	}
+}
+
+func TestInboxQuotaCountsStoredMessages(t *testing.T) {
+	inbox := newTestQuotaInbox(t, InboxQuota{MaxMessages: 2, MaxBytes: 1000, Policy: INBOX_QUOTA_REJECT_NEWEST})
+	now := int64(100 * DAY)
+	addQuotaMessages(t, inbox, now, "alice", "a", "b")
+
+	// As after a restart: the messages are only in the inbox of the storage
+	reloaded := newQuotaInbox(inbox.Inbox)
+	if accepted := addQuotaMessages(t, reloaded, now, "alice", "c"); accepted[0] {
+		t.Error("message over the quota accepted")
+	}
+
+	// Expired messages don't count
+	later := now + MSG_EXPIRE_SEC + HOUR
+	if accepted := addQuotaMessages(t, reloaded, later, "alice", "d"); !accepted[0] {
+		t.Error("message rejected, although the others expired")
+	}
+}
+
+func TestSendItemResults(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bob := addTestUser(t, "bob")
+	config.InboxQuota = &InboxQuota{MaxMessages: 1, MaxBytes: 1000, Policy: INBOX_QUOTA_REJECT_NEWEST}
+
+	missing := UserID{Id: bob.Id + 1, Sn: bob.Sn}.encrypt()
+	resp, err := send_restAPI_handler(alice, TEST_DEVICE, SendRequest{Items: []SendItem{
+		{To: bob.EncryptedID, Type: "msg", Msg: "a"},
+		{To: bob.EncryptedID, Type: "msg", Msg: "b"},
+		{To: missing, Type: "msg", Msg: "c"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make([]string, 0)
+	for _, item := range resp.Items {
+		statuses = append(statuses, item.Status)
+	}
+	if !slices.Equal(statuses, []string{SEND_DELIVERED, SEND_QUOTA_EXCEEDED, SEND_UNKNOWN_RECIPIENT}) {
+		t.Errorf("statuses %v", statuses)
+	}
+}
+
+func TestInboxQuotaValidate(t *testing.T) {
+	if err := defaultInboxQuota().validate(); err != nil {
+		t.Error(err)
+	}
+	for _, quota := range []InboxQuota{
+		{MaxMessages: 0, MaxBytes: 1, Policy: INBOX_QUOTA_DROP_OLDEST},
+		{MaxMessages: 1, MaxBytes: 1, MaxPerSender: -1, Policy: INBOX_QUOTA_DROP_OLDEST},
+		{MaxMessages: 1, MaxBytes: 1, Policy: "drop_newest"},
+	} {
+		if err := quota.validate(); err == nil {
+			t.Errorf("%+v accepted", quota)
+		}
+	}
+}
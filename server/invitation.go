@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// In the `invite` registration mode (see `registration.go`), registration requires
+// an invitation code. Invitations are created by the admin
+// (`loky invite`, `-add-inv`, `/admin/invite`) or by users for their friends (`/api/invite`).
+//
+// An invitation can be used `MaxUses` times until it expires. It is removed from
+// `ServerState.Invitations` when it's used up or expired, and each registration is recorded
+// in `ServerState.UsedInvitations`, so it's known who invited whom.
+
+type Invitation struct {
+	Code    string `json:"code"`
+	Created int64  `json:"created"`           // seconds since `referenceTime`
+	Expires int64  `json:"expires,omitempty"` // seconds since `referenceTime`, 0 means never
+	MaxUses int    `json:"max_uses"`
+	Uses    int    `json:"uses"`
+	Note    string `json:"note,omitempty"`
+
+	// ID of the user who created the invitation, 0 for the admin
+	CreatedBy uint64 `json:"created_by,omitempty"`
+}
+
+type UsedInvitation struct {
+	Code      string `json:"code"`
+	Username  string `json:"username"`
+	InvitedBy uint64 `json:"invited_by,omitempty"` // `Invitation.CreatedBy`
+	Time      int64  `json:"time"`                 // seconds since `referenceTime`
+}
+
+// Limits for invitations created by users, configured in `config.json` under `user_invitations`
+type UserInvitationConfig struct {
+	// How many unused invitations a user can have at a time. 0 means users cannot invite.
+	MaxActive int   `json:"max_active"`
+	ExpireSec int64 `json:"expire_sec"`
+}
+
+func defaultUserInvitations() *UserInvitationConfig {
+	return &UserInvitationConfig{
+		MaxActive: 5,
+		ExpireSec: 7 * DAY,
+	}
+}
+
+func (cfg *UserInvitationConfig) validate() error {
+	if cfg.MaxActive < 0 || cfg.ExpireSec < 1 {
+		return fmt.Errorf("max_active must not be negative and expire_sec must be positive")
+	}
+	return nil
+}
+
+// Configs written before invitations were structured have plain codes,
+// which never expire and can be used once.
+func (inv *Invitation) UnmarshalJSON(data []byte) error {
+	var code string
+	if json.Unmarshal(data, &code) == nil {
+		*inv = Invitation{Code: code, MaxUses: 1}
+		return nil
+	}
+	type plain Invitation
+	return json.Unmarshal(data, (*plain)(inv))
+}
+
+// Configs written before invitations were structured have "username: code"
+func (used *UsedInvitation) UnmarshalJSON(data []byte) error {
+	var legacy string
+	if json.Unmarshal(data, &legacy) == nil {
+		username, code, _ := strings.Cut(legacy, ": ")
+		*used = UsedInvitation{Code: code, Username: username}
+		return nil
+	}
+	type plain UsedInvitation
+	return json.Unmarshal(data, (*plain)(used))
+}
+
+// `expireSec` 0 means the invitation never expires
+func newInvitation(createdBy uint64, maxUses int, expireSec int64, note string, now int64) (Invitation, error) {
+	code, err := randBytes(16)
+	if err != nil {
+		return Invitation{}, fmt.Errorf("error generating invitation code: %s", err)
+	}
+	inv := Invitation{
+		Code:      base64Encode(code),
+		Created:   now,
+		MaxUses:   max(maxUses, 1),
+		Note:      note,
+		CreatedBy: createdBy,
+	}
+	if expireSec > 0 {
+		inv.Expires = now + expireSec
+	}
+	return inv, nil
+}
+
+func (inv *Invitation) valid(now int64) bool {
+	return inv.Uses < inv.MaxUses && (inv.Expires == 0 || now < inv.Expires)
+}
+
+// Returns a copy of the list without expired and used up invitations
+func validInvitations(invitations []Invitation, now int64) []Invitation {
+	return filter(slices.Clone(invitations), func(inv Invitation) bool { return inv.valid(now) })
+}
+
+func findInvitation(invitations []Invitation, code string) int {
+	return slices.IndexFunc(invitations, func(inv Invitation) bool { return inv.Code == code })
+}
+
+var errInvitationNotFound = errors.New("invalid invitation")
+
+// Takes one use of the invitation and records the registration
+func useInvitation(code string, username string, now int64) *RestAPIError {
+	err := storage.updateState(func(state *ServerState) error {
+		state.Invitations = validInvitations(state.Invitations, now)
+		i := findInvitation(state.Invitations, code)
+		if i < 0 {
+			return errInvitationNotFound
+		}
+		inv := &state.Invitations[i]
+		inv.Uses++
+		state.UsedInvitations = append(state.UsedInvitations, UsedInvitation{
+			Code:      code,
+			Username:  username,
+			InvitedBy: inv.CreatedBy,
+			Time:      now,
+		})
+		if !inv.valid(now) {
+			state.Invitations = slices.Delete(state.Invitations, i, i+1)
+		}
+		return nil
+	})
+	if err == errInvitationNotFound {
+		return NewError(err.Error(), http.StatusForbidden)
+	}
+	if err != nil {
+		return NewError("saving state: "+err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// Adds the invitations and removes the ones that can't be used anymore
+func addInvitations(invitations []Invitation, now int64) error {
+	return storage.updateState(func(state *ServerState) error {
+		state.Invitations = append(validInvitations(state.Invitations, now), invitations...)
+		return nil
+	})
+}
+
+// Lets users invite their friends, up to `config.UserInvitations.MaxActive` at a time
+
+type InviteRequest struct {
+	Note string `json:"note"` // for the user's own reference, e.g., who the invitation is for
+}
+
+type InviteResponse struct {
+	Code      string `json:"code"`
+	ExpireSec int64  `json:"expire_sec"`
+}
+
+func invite_http_handler(w http.ResponseWriter, r *http.Request) {
+	restAPI_handler(w, r, "invite", 1024, invite_restAPI_handler)
+}
+
+var errTooManyInvitations = errors.New("too many unused invitations")
+
+func invite_restAPI_handler(user *User, _ uint64, req InviteRequest) (InviteResponse, *RestAPIError) {
+	limits := config.UserInvitations
+	now := monotonicSeconds()
+	inv, err := newInvitation(user.Id, 1, limits.ExpireSec, req.Note, now)
+	if err != nil {
+		return InviteResponse{}, NewError("invite: "+err.Error(), http.StatusInternalServerError)
+	}
+
+	// Counted in the same transaction, so parallel requests can't exceed the limit
+	err = storage.updateState(func(state *ServerState) error {
+		state.Invitations = validInvitations(state.Invitations, now)
+		active := 0
+		for _, inv := range state.Invitations {
+			if inv.CreatedBy == user.Id {
+				active++
+			}
+		}
+		if active >= limits.MaxActive {
+			return errTooManyInvitations
+		}
+		state.Invitations = append(state.Invitations, inv)
+		return nil
+	})
+	if err == errTooManyInvitations {
+		return InviteResponse{}, NewError("invite: "+err.Error(), http.StatusForbidden)
+	}
+	if err != nil {
+		return InviteResponse{}, NewError("invite: saving state: "+err.Error(), http.StatusInternalServerError)
+	}
+	Log.i("Invitation created by %s", redact(user.Username))
+
+	return InviteResponse{Code: inv.Code, ExpireSec: limits.ExpireSec}, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func addTestInvitation(t *testing.T, createdBy uint64, maxUses int, expireSec int64, now int64) string {
+	t.Helper()
+	inv, err := newInvitation(createdBy, maxUses, expireSec, "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = addInvitations([]Invitation{inv}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inv.Code
+}
+
+func loadTestState(t *testing.T) ServerState {
+	t.Helper()
+	state, err := storage.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestInvitationUseLimit(t *testing.T) {
+	setupTest(t)
+	now := int64(100 * DAY)
+	code := addTestInvitation(t, 0, 2, 0, now)
+
+	for _, username := range []string{"alice", "bob"} {
+		if restAPIerr := useInvitation(code, username, now); restAPIerr != nil {
+			t.Fatalf("%s: %s", username, restAPIerr)
+		}
+	}
+	restAPIerr := useInvitation(code, "carol", now)
+	if restAPIerr == nil || restAPIerr.Code != http.StatusForbidden {
+		t.Errorf("used up invitation: %v", restAPIerr)
+	}
+
+	state := loadTestState(t)
+	if findInvitation(state.Invitations, code) >= 0 {
+		t.Error("used up invitation kept")
+	}
+	if len(state.UsedInvitations) != 2 || state.UsedInvitations[1].Username != "bob" || state.UsedInvitations[1].Code != code {
+		t.Errorf("used invitations = %+v", state.UsedInvitations)
+	}
+}
+
+func TestInvitationExpiry(t *testing.T) {
+	setupTest(t)
+	now := int64(100 * DAY)
+	code := addTestInvitation(t, 0, 1, HOUR, now)
+	forever := addTestInvitation(t, 0, 1, 0, now)
+
+	restAPIerr := useInvitation(code, "alice", now+HOUR)
+	if restAPIerr == nil || restAPIerr.Code != http.StatusForbidden {
+		t.Errorf("expired invitation: %v", restAPIerr)
+	}
+	if restAPIerr := useInvitation(forever, "alice", now+1000*DAY); restAPIerr != nil {
+		t.Errorf("invitation without expiry: %s", restAPIerr)
+	}
+
+	// Expired invitations are dropped with the next change
+	addTestInvitation(t, 0, 1, 0, now+HOUR)
+	state := loadTestState(t)
+	if findInvitation(state.Invitations, code) >= 0 {
+		t.Error("expired invitation kept")
+	}
+}
+
+func TestUserInvitationLimit(t *testing.T) {
+	setupTest(t)
+	config.UserInvitations = &UserInvitationConfig{MaxActive: 2, ExpireSec: DAY}
+	alice := addTestUser(t, "alice")
+	bob := addTestUser(t, "bob")
+
+	codes := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		resp, restAPIerr := invite_restAPI_handler(alice, 1, InviteRequest{})
+		if restAPIerr != nil {
+			t.Fatal(restAPIerr)
+		}
+		if resp.ExpireSec != DAY {
+			t.Errorf("expire_sec = %d", resp.ExpireSec)
+		}
+		codes = append(codes, resp.Code)
+	}
+	if _, restAPIerr := invite_restAPI_handler(alice, 1, InviteRequest{}); restAPIerr == nil {
+		t.Error("invitation over the limit created")
+	}
+	// The limit is per user
+	if _, restAPIerr := invite_restAPI_handler(bob, 1, InviteRequest{}); restAPIerr != nil {
+		t.Errorf("bob: %s", restAPIerr)
+	}
+
+	// A used invitation frees its place and records the inviter
+	now := monotonicSeconds()
+	if restAPIerr := useInvitation(codes[0], "carol", now); restAPIerr != nil {
+		t.Fatal(restAPIerr)
+	}
+	if _, restAPIerr := invite_restAPI_handler(alice, 1, InviteRequest{}); restAPIerr != nil {
+		t.Errorf("after use: %s", restAPIerr)
+	}
+	state := loadTestState(t)
+	if used := state.UsedInvitations[0]; used.Username != "carol" || used.InvitedBy != alice.Id {
+		t.Errorf("used invitation = %+v", used)
+	}
+
+	info, restAPIerr := adminUserInfo_handler(context.Background(), AdminUserRequest{Username: "alice"})
+	if restAPIerr != nil {
+		t.Fatal(restAPIerr)
+	}
+	if info.InvitedBy != "" {
+		t.Errorf("alice invited by %q", info.InvitedBy)
+	}
+	listed, restAPIerr := adminInvitations_handler(context.Background(), AdminInvitationsRequest{})
+	if restAPIerr != nil {
+		t.Fatal(restAPIerr)
+	}
+	for _, inv := range listed.Invitations {
+		if inv.CreatedBy != "alice" && inv.CreatedBy != "bob" {
+			t.Errorf("invitation created by %q", inv.CreatedBy)
+		}
+	}
+}
+
+func TestLegacyInvitations(t *testing.T) {
+	var state ServerState
+	err := json.Unmarshal([]byte(`{"invitations": ["abc"], "used_invitations": ["alice: def"]}`), &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv := state.Invitations[0]; inv.Code != "abc" || inv.MaxUses != 1 || !inv.valid(1000*DAY) {
+		t.Errorf("invitation = %+v", inv)
+	}
+	if used := state.UsedInvitations[0]; used.Username != "alice" || used.Code != "def" {
+		t.Errorf("used invitation = %+v", used)
+	}
+}
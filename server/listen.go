@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where and how the server listens.
+//
+// Each setting is taken from the first of these that is set:
+//
+//  1. command-line flag, e.g. `-listen`
+//  2. environment variable, e.g. `LOKY_LISTEN`
+//  3. field in `config.json`, e.g. `listen`
+//  4. built-in default
+//
+// The app directory, where the storage and `config.json` live, cannot be set in the config.
+// It only comes from `-dir` or `LOKY_DIR`, and defaults to the working directory.
+// The same goes for the storage backend (`-storage`, `LOKY_STORAGE`).
+//
+// Relative paths are relative to the app directory.
+
+const DEFAULT_APP_DIR = "."
+const DEFAULT_STORAGE = "fs"
+const DEFAULT_LISTEN = ":9443"
+const DEFAULT_TLS_CERT = "secrets/server.pem"
+const DEFAULT_TLS_KEY = "secrets/server.key"
+
+// The admin listener serves `/metrics` and the admin API, see `admin.go`. It speaks plain HTTP,
+// so by default it's a unix socket in the app directory that only the server's user can connect to.
+// Set it to host:port to scrape `/metrics` over the network, or to `off` to disable it.
+const DEFAULT_ADMIN_LISTEN = UNIX_SOCKET_PREFIX + "admin.sock"
+const ADMIN_LISTEN_OFF = "off"
+
+// Listen addresses with this prefix are unix sockets. The server speaks plain HTTP on them
+// and leaves TLS to a reverse proxy.
+const UNIX_SOCKET_PREFIX = "unix:"
+
+type ListenSettings struct {
+	Listen      string
+	TlsCert     string
+	TlsKey      string
+	AdminListen string
+}
+
+func setting(flagValue string, envName string, configValue string, defaultValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if envValue := os.Getenv(envName); envValue != "" {
+		return envValue
+	}
+	if configValue != "" {
+		return configValue
+	}
+	return defaultValue
+}
+
+func appFile(appDir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(appDir, path)
+}
+
+func resolveListenSettings(
+	appDir string,
+	listenFlag string,
+	tlsCertFlag string,
+	tlsKeyFlag string,
+	adminListenFlag string,
+) ListenSettings {
+	return ListenSettings{
+		Listen:      socketInAppDir(appDir, setting(listenFlag, "LOKY_LISTEN", config.Listen, DEFAULT_LISTEN)),
+		TlsCert:     appFile(appDir, setting(tlsCertFlag, "LOKY_TLS_CERT", config.TlsCert, DEFAULT_TLS_CERT)),
+		TlsKey:      appFile(appDir, setting(tlsKeyFlag, "LOKY_TLS_KEY", config.TlsKey, DEFAULT_TLS_KEY)),
+		AdminListen: socketInAppDir(appDir, setting(adminListenFlag, "LOKY_ADMIN_LISTEN", config.AdminListen, DEFAULT_ADMIN_LISTEN)),
+	}
+}
+
+func socketInAppDir(appDir string, address string) string {
+	if !isUnixSocket(address) {
+		return address
+	}
+	socket := strings.TrimPrefix(address, UNIX_SOCKET_PREFIX)
+	return UNIX_SOCKET_PREFIX + appFile(appDir, socket)
+}
+
+func isUnixSocket(address string) bool {
+	return strings.HasPrefix(address, UNIX_SOCKET_PREFIX)
+}
+
+func (settings *ListenSettings) isUnixSocket() bool {
+	return isUnixSocket(settings.Listen)
+}
+
+func (settings *ListenSettings) adminEnabled() bool {
+	return settings.AdminListen != ADMIN_LISTEN_OFF
+}
+
+// Human-readable description of the address, for the log
+func (settings *ListenSettings) String() string {
+	if settings.isUnixSocket() {
+		return "http+" + settings.Listen
+	}
+	return "https://" + settings.Listen
+}
+
+// Like `String()`, for the admin listener
+func (settings *ListenSettings) adminString() string {
+	if isUnixSocket(settings.AdminListen) {
+		return "http+" + settings.AdminListen
+	}
+	return "http://" + settings.AdminListen
+}
+
+func (settings *ListenSettings) listen() (net.Listener, error) {
+	return listenOn(settings.Listen)
+}
+
+func (settings *ListenSettings) listenAdmin() (net.Listener, error) {
+	listener, err := listenOn(settings.AdminListen)
+	if err != nil || !isUnixSocket(settings.AdminListen) {
+		return listener, err
+	}
+	// Whoever can connect can try admin tokens
+	err = os.Chmod(strings.TrimPrefix(settings.AdminListen, UNIX_SOCKET_PREFIX), 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func listenOn(address string) (net.Listener, error) {
+	if isUnixSocket(address) {
+		socket := strings.TrimPrefix(address, UNIX_SOCKET_PREFIX)
+
+		// A socket left behind by a crashed instance would make `Listen` fail.
+		// If nobody accepts connections on it, it's safe to remove.
+		if info, err := os.Lstat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			conn, err := net.Dial("unix", socket)
+			if err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("another server is listening on %s", socket)
+			}
+			err = os.Remove(socket)
+			if err != nil {
+				return nil, fmt.Errorf("error removing stale socket: %s", err)
+			}
+		}
+		return net.Listen("unix", socket)
+	}
+	return net.Listen("tcp", address)
+}
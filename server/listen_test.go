@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveListenSettings(t *testing.T) {
+	setupTest(t)
+	appDir := "/srv/loky"
+
+	settings := resolveListenSettings(appDir, "", "", "", "")
+	want := ListenSettings{
+		Listen:      DEFAULT_LISTEN,
+		TlsCert:     "/srv/loky/secrets/server.pem",
+		TlsKey:      "/srv/loky/secrets/server.key",
+		AdminListen: "unix:/srv/loky/admin.sock",
+	}
+	if settings != want {
+		t.Errorf("defaults: %+v", settings)
+	}
+
+	config.Listen = ":1000"
+	config.TlsCert = "/etc/ssl/loky.pem"
+	config.TlsKey = "tls/loky.key"
+	config.AdminListen = ADMIN_LISTEN_OFF
+	settings = resolveListenSettings(appDir, "", "", "", "")
+	want = ListenSettings{
+		Listen:      ":1000",
+		TlsCert:     "/etc/ssl/loky.pem",
+		TlsKey:      "/srv/loky/tls/loky.key",
+		AdminListen: ADMIN_LISTEN_OFF,
+	}
+	if settings != want || settings.adminEnabled() {
+		t.Errorf("config: %+v", settings)
+	}
+
+	// The environment overrides the config, and flags override both
+	t.Setenv("LOKY_LISTEN", ":2000")
+	t.Setenv("LOKY_TLS_KEY", "env.key")
+	settings = resolveListenSettings(appDir, "", "", "flag.key", "")
+	if settings.Listen != ":2000" || settings.TlsKey != "/srv/loky/flag.key" {
+		t.Errorf("env: %+v", settings)
+	}
+
+	settings = resolveListenSettings(appDir, "unix:run/loky.sock", "", "", "unix:/run/loky-admin.sock")
+	if !settings.isUnixSocket() || settings.Listen != "unix:/srv/loky/run/loky.sock" ||
+		settings.AdminListen != "unix:/run/loky-admin.sock" {
+		t.Errorf("unix socket: %+v", settings)
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "loky.sock")
+	settings := ListenSettings{Listen: UNIX_SOCKET_PREFIX + socket}
+
+	listener, err := settings.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settings.listen(); err == nil {
+		t.Error("listening twice on the same socket")
+	}
+
+	// Left behind as after a crash
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = settings.listen()
+	if err != nil {
+		t.Fatalf("stale socket not removed: %s", err)
+	}
+	listener.Close()
+}
+
+func TestListenAdminUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	settings := ListenSettings{AdminListen: UNIX_SOCKET_PREFIX + socket}
+
+	listener, err := settings.listenAdmin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode %v", info.Mode().Perm())
+	}
+}
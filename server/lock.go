@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const LOCK_FILE = "loky.lock"
+
+// Kept open for the lifetime of the process. If it was garbage collected,
+// the file would be closed and the lock released.
+var appDirLock *os.File
+
+var errAppDirInUse = errors.New("in use by another loky process, e.g., the running server")
+
+// Only one loky process can use an app directory at a time: either the server,
+// or a command that works with the data, like `loky users`. The lock is held until
+// the process exits. While the server holds it, commands go through its admin API.
+func lockAppDir(appDir string) error {
+	file := filepath.Join(appDir, LOCK_FILE)
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		f.Close()
+		return fmt.Errorf("%s is %w", appDir, errAppDirInUse)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	appDirLock = f
+	return nil
+}
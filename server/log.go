@@ -1,31 +1,150 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+)
 
-type LogType struct{}
+// Logging goes through `log/slog` to stdout.
+//
+// The level and format are settings like the ones in `ListenSettings`:
+// `-log-level`, `LOKY_LOG_LEVEL`, `log_level` in `config.json`, default info;
+// `-log-format`, `LOKY_LOG_FORMAT`, `log_format` in `config.json`, default text.
+
+const DEFAULT_LOG_LEVEL = "info"
+const DEFAULT_LOG_FORMAT = "text"
+
+// Sent back with every response, so a client report can be matched with the log
+const REQUEST_ID_HEADER = "X-Request-Id"
+
+var logLevel = new(slog.LevelVar)
+var logger = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
+
+// Key for `redact()`. A new one on every start, so the redacted values can't be
+// matched across restarts, or with a list of known usernames.
+var redactKey = func() []byte {
+	key, err := randBytes(32)
+	if err != nil {
+		panic("error generating log redaction key: " + err.Error())
+	}
+	return key
+}()
+
+// Log records that belong to a request carry its ID. `Log` itself has none.
+type LogType struct {
+	requestId string
+}
 
 var Log LogType
 
-func (LogType) d(format string, args ...interface{}) {
-	fmt.Print("[DEBUG] ")
-	fmt.Printf(format, args...)
-	fmt.Println()
+func configureLogging(levelFlag string, formatFlag string) error {
+	var level slog.Level
+	levelName := setting(levelFlag, "LOKY_LOG_LEVEL", config.LogLevel, DEFAULT_LOG_LEVEL)
+	err := level.UnmarshalText([]byte(levelName))
+	if err != nil {
+		return fmt.Errorf("invalid log level: %s", levelName)
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	format := setting(formatFlag, "LOKY_LOG_FORMAT", config.LogFormat, DEFAULT_LOG_FORMAT)
+	switch format {
+	case "text":
+		logger = slog.New(slog.NewTextHandler(os.Stdout, options))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stdout, options))
+	default:
+		return fmt.Errorf("invalid log format: %s", format)
+	}
+
+	logLevel.Set(level)
+	return nil
+}
+
+func debugEnabled() bool {
+	return logLevel.Level() <= slog.LevelDebug
+}
+
+// Usernames and encrypted IDs identify users, so they only go to the log as they are
+// when debug is on. Otherwise they are replaced by a keyed hash, which is still enough
+// to follow one user through the log.
+func redact(value string) string {
+	if debugEnabled() {
+		return value
+	}
+	mac := hmac.New(sha256.New, redactKey)
+	mac.Write([]byte(value))
+	return "~" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+func redactId(id uint64) string {
+	return redact(fmt.Sprintf("%020d", id))
+}
+
+// Paths of user data contain the user ID. The directory is redacted, the file name stays.
+func redactPath(path string) string {
+	return redact(filepath.Dir(path)) + string(filepath.Separator) + filepath.Base(path)
+}
+
+// Errors of file operations contain the path, see `fs.PathError`
+func redactError(err error) string {
+	var pathErr *fs.PathError
+	if !debugEnabled() && errors.As(err, &pathErr) {
+		return pathErr.Op + " " + redactPath(pathErr.Path) + ": " + pathErr.Err.Error()
+	}
+	return err.Error()
+}
+
+// Gives the request an ID, returns it to the client in the `X-Request-Id` header,
+// and returns a logger for the request.
+// `restAPIerror()` picks the ID up from the header.
+func startRequest(w http.ResponseWriter, r *http.Request, handlerName string) LogType {
+	requestId := fmt.Sprintf("%016x", rand.Uint64())
+	w.Header().Set(REQUEST_ID_HEADER, requestId)
+
+	log := Log.request(requestId)
+	log.d("%s from %s", handlerName, r.RemoteAddr)
+	return log
+}
+
+func (LogType) request(requestId string) LogType {
+	return LogType{requestId: requestId}
+}
+
+func (log LogType) log(level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if log.requestId != "" {
+		logger.Log(ctx, level, msg, "request_id", log.requestId)
+	} else {
+		logger.Log(ctx, level, msg)
+	}
+}
+
+func (log LogType) d(format string, args ...interface{}) {
+	log.log(slog.LevelDebug, format, args...)
 }
 
-func (LogType) e(format string, args ...interface{}) {
-	fmt.Print("[ERROR] ")
-	fmt.Printf(format, args...)
-	fmt.Println()
+func (log LogType) e(format string, args ...interface{}) {
+	log.log(slog.LevelError, format, args...)
 }
 
-func (LogType) i(format string, args ...interface{}) {
-	fmt.Print("[INFO] ")
-	fmt.Printf(format, args...)
-	fmt.Println()
+func (log LogType) i(format string, args ...interface{}) {
+	log.log(slog.LevelInfo, format, args...)
 }
 
-func (LogType) w(format string, args ...interface{}) {
-	fmt.Print("[WARNING] ")
-	fmt.Printf(format, args...)
-	fmt.Println()
+func (log LogType) w(format string, args ...interface{}) {
+	log.log(slog.LevelWarn, format, args...)
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Sends the log to the returned buffer as JSON, until the test ends
+func captureTestLog(t *testing.T, level slog.Level) *bytes.Buffer {
+	oldLogger, oldLevel := logger, logLevel.Level()
+	t.Cleanup(func() {
+		logger = oldLogger
+		logLevel.Set(oldLevel)
+	})
+	var buf bytes.Buffer
+	logger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: logLevel}))
+	logLevel.Set(level)
+	return &buf
+}
+
+func TestConfigureLogging(t *testing.T) {
+	setupTest(t)
+	captureTestLog(t, slog.LevelInfo)
+
+	config.LogLevel = "warn"
+	if err := configureLogging("", ""); err != nil {
+		t.Fatal(err)
+	}
+	if logLevel.Level() != slog.LevelWarn {
+		t.Errorf("level from config: %s", logLevel.Level())
+	}
+	t.Setenv("LOKY_LOG_LEVEL", "error")
+	if err := configureLogging("debug", "json"); err != nil {
+		t.Fatal(err)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("level from flag: %s", logLevel.Level())
+	}
+
+	if err := configureLogging("loud", ""); err == nil {
+		t.Error("invalid level accepted")
+	}
+	if err := configureLogging("", "xml"); err == nil {
+		t.Error("invalid format accepted")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	captureTestLog(t, slog.LevelInfo)
+	redacted := redact("alice")
+	if redacted == "alice" || !strings.HasPrefix(redacted, "~") {
+		t.Errorf("redacted: %q", redacted)
+	}
+	// Stable, so one user can be followed through the log
+	if again := redact("alice"); again != redacted {
+		t.Errorf("%q, then %q", redacted, again)
+	}
+	if other := redact("bob"); other == redacted {
+		t.Error("different values redacted the same")
+	}
+
+	logLevel.Set(slog.LevelDebug)
+	if got := redact("alice"); got != "alice" {
+		t.Errorf("redacted at debug level: %q", got)
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	captureTestLog(t, slog.LevelInfo)
+	dir := filepath.Join(t.TempDir(), "00000000000000000042")
+	_, err := os.ReadFile(filepath.Join(dir, "prekeys"))
+
+	redacted := redactError(err)
+	if strings.Contains(redacted, dir) || !strings.Contains(redacted, "prekeys") {
+		t.Errorf("redacted: %q", redacted)
+	}
+	if other := errors.New("not a path"); redactError(other) != other.Error() {
+		t.Errorf("other error redacted: %q", redactError(other))
+	}
+
+	logLevel.Set(slog.LevelDebug)
+	if got := redactError(err); got != err.Error() {
+		t.Errorf("redacted at debug level: %q", got)
+	}
+}
+
+func TestRequestIdInLog(t *testing.T) {
+	buf := captureTestLog(t, slog.LevelInfo)
+
+	w := httptest.NewRecorder()
+	startRequest(w, httptest.NewRequest(http.MethodPost, "/api/recv", nil), "recv")
+	restAPIerror(w, NewError("recv: something failed", http.StatusInternalServerError))
+
+	requestId := w.Header().Get(REQUEST_ID_HEADER)
+	if requestId == "" {
+		t.Fatal("no request ID")
+	}
+	var record struct {
+		Level     string `json:"level"`
+		Msg       string `json:"msg"`
+		RequestId string `json:"request_id"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%s: %q", err, buf.String())
+	}
+	if record.Level != "ERROR" || !strings.HasSuffix(record.Msg, "recv: something failed") || record.RequestId != requestId {
+		t.Errorf("logged %+v", record)
+	}
+}
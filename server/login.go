@@ -16,16 +16,24 @@ type LoginRequest struct {
 
 type LoginResponse struct {
 	Bearer      Bearer `json:"bearer"`
+	Device      uint64 `json:"device"`
 	NeedPrekeys bool   `json:"needPrekeys"`
 
 	Err *RestAPIError `json:"-"`
 }
 
 func login_http_handler(w http.ResponseWriter, r *http.Request) {
-	Log.i("=================================================================================")
-	Log.i("login_handler")
+	w, done := meterRequest(w, "login")
+	defer done()
+	startRequest(w, r, "login")
 	r.Body = http.MaxBytesReader(w, r.Body, 2048)
 
+	restAPIerr := limitIp(r, "login")
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
 	var req LoginRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
@@ -34,8 +42,15 @@ func login_http_handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Also for unknown usernames, so the responses don't tell which users exist
+	restAPIerr = limitLoginAttempt(req.Username)
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
 	user := usersList.Load().userByName(req.Username)
-	if user == nil || !user.check_passwd(req.Passwd) {
+	if user == nil {
 		msg := "login: invalid user/password"
 		restAPIerror(w, NewError(msg, http.StatusUnauthorized))
 		return
@@ -45,12 +60,19 @@ func login_http_handler(w http.ResponseWriter, r *http.Request) {
 	defer close(respChan)
 
 	req.Response = respChan
-	user.Login <- req
-	resp := <-respChan
+	resp, ok := callUserHandler(user, user.Login, req, respChan)
+	if !ok {
+		refundLoginAttempt(req.Username)
+		restAPIerror(w, errUserStopped("login"))
+		return
+	}
 
+	// Only wrong passwords count
+	if resp.Err == nil || resp.Err.Code != http.StatusUnauthorized {
+		refundLoginAttempt(req.Username)
+	}
 	if resp.Err != nil {
-		msg := "login: error: " + resp.Err.Error()
-		restAPIerror(w, NewError(msg, http.StatusInternalServerError))
+		restAPIerror(w, resp.Err)
 		return
 	}
 
@@ -62,29 +84,56 @@ func login_http_handler(w http.ResponseWriter, r *http.Request) {
 }
 
 func login_synchronized_handler(user *User, req LoginRequest) LoginResponse {
-	if req.SigningKey != user.SigningKey || req.MasterKey != user.MasterKey {
-		// user changed their keys
-		user.SigningKey = req.SigningKey
-		user.MasterKey = req.MasterKey
-		user.Prekeys = user.Prekeys[:0]
-		user.Inbox.clear()
-		user.Sn++
-		user.EncryptedID = UserID{Id: user.Id, Sn: user.Sn}.encrypt()
+	// The password is checked here rather than in `login_http_handler()`,
+	// because rehashing changes it.
+	ok, rehash := user.check_passwd(req.Passwd)
+	if !ok {
+		return LoginResponse{
+			Err: NewError("login: invalid user/password", http.StatusUnauthorized),
+		}
+	}
+	if user.Disabled {
+		return LoginResponse{
+			Err: NewError("login: account disabled", http.StatusForbidden),
+		}
+	}
+	if rehash {
+		user.rehash_passwd(req.Passwd)
 	}
 
-	var err error
-	user.Bearer, err = makeBearer(user.EncryptedID)
+	now := monotonicSeconds()
+	device := user.deviceByKeys(req.SigningKey, req.MasterKey)
+	if device == nil {
+		// Logging in with new keys means a new device.
+		// The other devices keep their keys, prekeys and inboxes.
+		var err error
+		device, err = user.addDevice(req.SigningKey, req.MasterKey, now)
+		if err != nil {
+			return LoginResponse{
+				Err: NewError("login: adding device: "+err.Error(), http.StatusInternalServerError),
+			}
+		}
+		Log.i("New device %d of %s", device.Id, redact(user.Username))
+	} else {
+		// `LastLogin` decides which device is removed when there are too many.
+		// It's not worth failing the login if we cannot save it.
+		device.LastLogin = now
+		err := user.save()
+		if err != nil {
+			Log.e("login: saving user: %s", err.Error())
+		}
+	}
+
+	bearer, err := makeBearer(user, device.Id)
 	if err != nil {
 		return LoginResponse{
 			Err: NewError("login: creating bearer", http.StatusInternalServerError),
 		}
 	}
 
-	// persist the new credentials
-	user.save()
-
 	return LoginResponse{
-		Bearer:      user.Bearer,
-		NeedPrekeys: user.needPrekeys(),
+		Bearer:      bearer,
+		Device:      device.Id,
+		NeedPrekeys: device.needPrekeys(),
 	}
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Revokes the bearer used to authorize the request.
+// Other bearers of the same user, e.g., on other devices, stay valid.
+
+type LogoutResponse struct {
+}
+
+func logout_http_handler(w http.ResponseWriter, r *http.Request) {
+	w, done := meterRequest(w, "logout")
+	defer done()
+	startRequest(w, r, "logout")
+
+	restAPIerr := limitIp(r, "logout")
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
+	_, claims, restAPIerr := authorize(r, "logout")
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
+	restAPIerr = limitBearer(claims, "logout", 1)
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
+	err := revokeBearer(claims)
+	if err != nil {
+		msg := "logout: error revoking bearer: " + err.Error()
+		restAPIerror(w, NewError(msg, http.StatusInternalServerError))
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(LogoutResponse{})
+	if err != nil {
+		msg := "logout: error encoding response: " + err.Error()
+		restAPIerror(w, NewError(msg, http.StatusInternalServerError))
+	}
+}
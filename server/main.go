@@ -1,19 +1,79 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// Canceled when the server starts shutting down. The context of every request is derived
+// from it, so long-running requests, like `recv` and `stream`, return early and don't
+// hold up the shutdown.
+var serverCtx, cancelServerCtx = context.WithCancel(context.Background())
+
 func main() {
-	create_cfg := flag.Bool("create-config", false, "create default config.json")
+	create_cfg := flag.Bool("create-config", false, "create default config")
 	new_user := flag.String("new-user", "", "create new user with given username")
-	add_inv := flag.Int("add-inv", 0, "add n invitations to config")
+	add_inv := flag.Int("add-inv", 0, "add n invitations")
+	storage_type := flag.String("storage", "", "storage backend: fs, bolt or memory (env LOKY_STORAGE, default fs)")
+	app_dir := flag.String("dir", "", "app directory with the config and data (env LOKY_DIR, default .)")
+	listen := flag.String("listen", "", "listen address, host:port or unix:/path/to/socket (env LOKY_LISTEN, default "+DEFAULT_LISTEN+")")
+	tls_cert := flag.String("tls-cert", "", "TLS certificate file (env LOKY_TLS_CERT, default "+DEFAULT_TLS_CERT+")")
+	tls_key := flag.String("tls-key", "", "TLS key file (env LOKY_TLS_KEY, default "+DEFAULT_TLS_KEY+")")
+	admin_listen := flag.String("admin-listen", "", "admin listen address for /metrics and the admin API, host:port, unix:/path/to/socket or off (env LOKY_ADMIN_LISTEN, default "+DEFAULT_ADMIN_LISTEN+")")
+	log_level := flag.String("log-level", "", "log level: debug, info, warn or error (env LOKY_LOG_LEVEL, default "+DEFAULT_LOG_LEVEL+")")
+	log_format := flag.String("log-format", "", "log format: text or json (env LOKY_LOG_FORMAT, default "+DEFAULT_LOG_FORMAT+")")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: loky [flags] [command]\n\nWithout a command, runs the server.\n\nFlags:\n")
+		flag.PrintDefaults()
+		printCommands()
+	}
 	flag.Parse()
 
-	config_json := "config.json"
+	// Before the config is loaded, only the flags and the environment apply
+	err := configureLogging(*log_level, *log_format)
+	if err != nil {
+		Log.e("Error configuring logging: %s", err.Error())
+		return
+	}
+
+	appDir := setting(*app_dir, "LOKY_DIR", "", DEFAULT_APP_DIR)
+	storageType := setting(*storage_type, "LOKY_STORAGE", "", DEFAULT_STORAGE)
+
+	// Also for commands, so they don't change the data under a running server
+	err = lockAppDir(appDir)
+	if errors.Is(err, errAppDirInUse) && flag.NArg() > 0 {
+		err = runRemoteCommand(appDir, *admin_listen, flag.Args())
+		if err != nil {
+			Log.e("%s", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if err != nil {
+		Log.e("Error locking app directory: %s", err.Error())
+		os.Exit(1)
+	}
+
+	storage, err = openStorage(storageType, appDir)
+	if err != nil {
+		Log.e("Error opening storage: %s", err.Error())
+		return
+	}
+	defer storage.close()
+
+	configFile := appFile(appDir, CONFIG_FILE)
 	if *create_cfg {
-		cfg, err := newConfig(config_json)
+		cfg, err := newConfig(configFile)
 		if err != nil {
 			Log.e("Error creating config: %s", err.Error())
 			return
@@ -23,31 +83,57 @@ func main() {
 			Log.e("Error saving config: %s", err.Error())
 			return
 		}
-		Log.i("New config saved in %s", cfg.Filename)
+		Log.i("New config saved")
 		return
 	}
-	cfg, err := loadConfig(config_json)
+	cfg, err := loadConfig(configFile)
 	if err != nil {
 		Log.e("Error loading config: %s", err.Error())
 		return
 	}
 	config = cfg
 
+	err = configureLogging(*log_level, *log_format)
+	if err != nil {
+		Log.e("Error configuring logging: %s", err.Error())
+		return
+	}
+
+	err = initState(&config)
+	if err != nil {
+		Log.e("Error initializing server state: %s", err.Error())
+		return
+	}
+
 	if *add_inv > 0 {
+		now := monotonicSeconds()
+		invitations := make([]Invitation, 0, *add_inv)
 		for i := 0; i < *add_inv; i++ {
-			code, err := randBytes(16)
+			inv, err := newInvitation(0, 1, 0, "", now)
 			if err != nil {
-				Log.e("Error generating invitation code: %s", err.Error())
+				Log.e("%s", err.Error())
 				return
 			}
-			config.Invitations = append(config.Invitations, base64Encode(code))
+			invitations = append(invitations, inv)
 		}
-		err = config.save()
+		err = addInvitations(invitations, now)
 		if err != nil {
-			Log.e("Error saving config: %s", err.Error())
+			Log.e("Error saving invitations: %s", err.Error())
 			return
 		}
-		Log.i("Added %d invitations to config", *add_inv)
+		Log.i("Added %d invitations", *add_inv)
+		return
+	}
+
+	err = loadBearerKey(appDir)
+	if err != nil {
+		Log.e("Error loading bearer key: %s", err.Error())
+		return
+	}
+
+	err = loadRevokedBearers()
+	if err != nil {
+		Log.e("Error loading revoked bearers: %s", err.Error())
 		return
 	}
 
@@ -59,6 +145,11 @@ func main() {
 
 	if *new_user != "" {
 		username := *new_user
+		err = validateUsername(username)
+		if err != nil {
+			Log.e("Error adding user: %s", err.Error())
+			return
+		}
 		passwdBytes, err := randBytes(16)
 		if err != nil {
 			Log.e("Error generating password: %s", err.Error())
@@ -70,7 +161,21 @@ func main() {
 			Log.e("Error adding user: %s", err.Error())
 			return
 		}
-		Log.i("Created user %s with password %s", username, passwd)
+		// Not logged, the log may be collected somewhere
+		Log.i("Created user %s", redact(username))
+		fmt.Printf("Password of %s: %s\n", username, passwd)
+		return
+	}
+
+	if flag.NArg() > 0 {
+		usersList.Store(users)
+		err = runCommand(localAdminClient(), flag.Args())
+		stopUserHandlers()
+		if err != nil {
+			Log.e("%s", err.Error())
+			storage.close()
+			os.Exit(1)
+		}
 		return
 	}
 
@@ -78,22 +183,136 @@ func main() {
 		Log.w("Warning: no users loaded")
 	}
 	usersList.Store(users)
-	for _, user := range users.id_map {
-		go user_handler(user)
-	}
+	go evictIdleUsers()
+	go rateLimiter.cleanup()
 
 	http.HandleFunc("/api/login", login_http_handler)
+	http.HandleFunc("/api/logout", logout_http_handler)
 	http.HandleFunc("/api/reg", reg_http_handler)
+	http.HandleFunc("/api/regChallenge", regChallenge_http_handler)
+	http.HandleFunc("/api/changePasswd", changePasswd_http_handler)
+	http.HandleFunc("/api/deleteAccount", deleteAccount_http_handler)
 	http.HandleFunc("/api/send", send_http_handler)
 	http.HandleFunc("/api/recv", recv_http_handler)
+	http.HandleFunc("/api/stream", stream_http_handler)
+	http.HandleFunc("/api/ack", ack_http_handler)
 	http.HandleFunc("/api/userInfo", userInfo_http_handler)
 	http.HandleFunc("/api/fetchPrekeys", fetchPrekeys_http_handler)
 	http.HandleFunc("/api/addPrekeys", addPrekeys_http_handler)
+	http.HandleFunc("/api/invite", invite_http_handler)
 
-	Log.i("Starting server at http://localhost:9443")
+	// SIGHUP would kill the server by default. It reloads the TLS certificate,
+	// see `CertReloader.watch()`, and does nothing on a unix socket.
+	signal.Ignore(syscall.SIGHUP)
 
-	err = http.ListenAndServeTLS(":9443", "secrets/server.pem", "secrets/server.key", nil)
+	settings := resolveListenSettings(appDir, *listen, *tls_cert, *tls_key, *admin_listen)
+	listener, err := settings.listen()
 	if err != nil {
+		Log.e("Error listening on %s: %s", settings.Listen, err.Error())
+		stopUserHandlers()
+		return
+	}
+
+	if settings.isUnixSocket() && config.RateLimits.ClientIpHeader == "" {
+		Log.w("rate_limits.client_ip_header is not set, all clients share the per-IP rate limits")
+	}
+
+	server := &http.Server{
+		BaseContext: func(net.Listener) context.Context { return serverCtx },
+	}
+
+	if !settings.isUnixSocket() {
+		certReloader, err := newCertReloader(settings.TlsCert, settings.TlsKey)
+		if err != nil {
+			Log.e("Error loading TLS certificate: %s", err.Error())
+			listener.Close()
+			stopUserHandlers()
+			return
+		}
+		server.TLSConfig = &tls.Config{
+			GetCertificate: certReloader.getCertificate,
+		}
+		go certReloader.watch()
+	}
+
+	// Not exposed to clients, so it gets its own mux instead of `http.DefaultServeMux`
+	var adminServer *http.Server
+	var adminListener net.Listener
+	if settings.adminEnabled() {
+		adminListener, err = settings.listenAdmin()
+		if err != nil {
+			Log.e("Error listening on %s: %s", settings.AdminListen, err.Error())
+			listener.Close()
+			stopUserHandlers()
+			return
+		}
+		err = loadAdminToken(appDir)
+		if err != nil {
+			Log.e("Error loading admin token: %s", err.Error())
+			listener.Close()
+			adminListener.Close()
+			stopUserHandlers()
+			return
+		}
+		adminMux := http.NewServeMux()
+		adminMux.HandleFunc("/metrics", metrics_http_handler)
+		registerAdminHandlers(adminMux)
+		adminServer = &http.Server{
+			Handler:     adminMux,
+			BaseContext: func(net.Listener) context.Context { return serverCtx },
+		}
+	}
+
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	Log.i("Starting server at %s", settings.String())
+
+	serverErr := make(chan error, 2)
+	go func() {
+		if settings.isUnixSocket() {
+			serverErr <- server.Serve(listener)
+		} else {
+			// The certificate comes from `server.TLSConfig`
+			serverErr <- server.ServeTLS(listener, "", "")
+		}
+	}()
+	if adminServer != nil {
+		Log.i("Starting admin server at %s", settings.adminString())
+		go func() {
+			serverErr <- adminServer.Serve(adminListener)
+		}()
+	}
+
+	select {
+	case err = <-serverErr:
 		Log.e("Error starting server: %s", err.Error())
+	case <-signalCtx.Done():
+		Log.i("Shutting down")
+	}
+
+	shutdown(server, adminServer)
+}
+
+// Waits for running requests, then stops all `user_handler()` goroutines.
+// After that, nothing touches the storage anymore and it can be closed.
+// `adminServer` can be nil.
+func shutdown(server *http.Server, adminServer *http.Server) {
+	cancelServerCtx()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(SHUTDOWN_TIMEOUT_SEC)*time.Second)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		Log.e("Error shutting down server: %s", err.Error())
 	}
+	if adminServer != nil {
+		err = adminServer.Shutdown(ctx)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			Log.e("Error shutting down admin server: %s", err.Error())
+		}
+	}
+
+	stopUserHandlers()
+	Log.i("All users stopped")
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Sets up the globals the server code works with: a new config, the storage in memory
+// with a new state, a bearer key, and no users, revoked bearers or rate limit buckets.
+// They are restored when the test ends, so tests using it must not run in parallel.
+func setupTest(t *testing.T) {
+	t.Helper()
+
+	oldConfig, oldStorage, oldUsers := config, storage, usersList.Load()
+	oldBearerKey, oldBearerKeyFile, oldRevoked := bearerKey.Load(), bearerKeyFile, revokedBearers.Load()
+	t.Cleanup(func() {
+		stopUserHandlers()
+		loadedUsers.mutex.Lock()
+		loadedUsers.closed = false
+		loadedUsers.mutex.Unlock()
+		config, storage = oldConfig, oldStorage
+		usersList.Store(oldUsers)
+		bearerKey.Store(oldBearerKey)
+		bearerKeyFile = oldBearerKeyFile
+		revokedBearers.Store(oldRevoked)
+	})
+
+	var err error
+	storage, err = newMemStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = newConfig(filepath.Join(t.TempDir(), CONFIG_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = initState(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The defaults take too long for tests that add many users
+	config.PasswdHash = PasswdHashParams{Algorithm: PASSWD_ALG_ARGON2ID, Time: 1, Memory: 64, Threads: 1}
+	err = loadBearerKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedBearers.Store(&RevokedBearers{})
+	rateLimiter.mutex.Lock()
+	rateLimiter.buckets = make(map[string]*TokenBucket)
+	rateLimiter.mutex.Unlock()
+	usersList.Store(newUsers())
+}
+
+// The device `addTestUser()` logs in with
+const TEST_DEVICE uint64 = 1
+
+// Adds the user, starts its `user_handler()` and logs in `TEST_DEVICE`. Needs `setupTest()`.
+func addTestUser(t *testing.T, username string) *User {
+	t.Helper()
+	users, err := addUser(usersList.Load(), username, hash("passwd of "+username))
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersList.Store(users)
+	user := users.userByName(username)
+	if resp := loginTestDevice(t, user, ""); resp.Device != TEST_DEVICE {
+		t.Fatalf("logged in as device %d", resp.Device)
+	}
+	return user
+}
+
+// Delivers a message to all devices of the user as `/api/send` does
+func putTestMessage(t *testing.T, user *User, from string, payload string) {
+	t.Helper()
+	respChan := make(chan PutResponse)
+	user.Put <- PutRequest{
+		Items:    []PutItem{{Message: Message{Time: monotonicSeconds(), From: from, Type: "msg", Msg: payload}}},
+		Response: respChan,
+	}
+	if resp := <-respChan; resp.Results[0].Err != nil {
+		t.Fatal(resp.Results[0].Err)
+	}
+}
+
+func messagePayloads(msgs []Message) []string {
+	payloads := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		payloads = append(payloads, msg.Msg)
+	}
+	return payloads
+}
+
+// Logs in as the client does. Different keys mean a different device.
+func loginTestDevice(t *testing.T, user *User, keys string) LoginResponse {
+	t.Helper()
+	respChan := make(chan LoginResponse)
+	user.Login <- LoginRequest{
+		Passwd:     hash("passwd of " + user.Username),
+		SigningKey: keys,
+		MasterKey:  keys,
+		Response:   respChan,
+	}
+	resp := <-respChan
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	return resp
+}
+
+// Logs in `TEST_DEVICE`. Returns the bearer.
+func loginTestUser(t *testing.T, user *User) Bearer {
+	t.Helper()
+	return loginTestDevice(t, user, "").Bearer
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics served at `/metrics` on the admin listener, in the Prometheus text format.
+//
+// Devices running out of prekeys show up as `loky_prekey_fetches_empty_total`.
+// E.g., alert on `increase(loky_prekey_fetches_empty_total[1h]) > 0`.
+
+// Upper bounds in seconds. `recv` can wait up to `RECV_MAX_WAIT_SEC`.
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var queueWaitBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) add(n int) {
+	c.value.Add(uint64(n))
+}
+
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (g *Gauge) inc() {
+	g.value.Add(1)
+}
+
+func (g *Gauge) dec() {
+	g.value.Add(-1)
+}
+
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if i, _ := slices.BinarySearch(h.buckets, value); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += value
+	h.count++
+}
+
+// A metric with one label. The values are created on first use.
+type Family[T any] struct {
+	mutex  sync.Mutex
+	values map[string]*T
+	create func() *T
+}
+
+func newFamily[T any](create func() *T) *Family[T] {
+	return &Family[T]{
+		values: make(map[string]*T),
+		create: create,
+	}
+}
+
+func (f *Family[T]) with(label string) *T {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	value, ok := f.values[label]
+	if !ok {
+		value = f.create()
+		f.values[label] = value
+	}
+	return value
+}
+
+// Sorted by label, so the output is stable
+func (f *Family[T]) each(fn func(label string, value *T)) {
+	f.mutex.Lock()
+	labels := make([]string, 0, len(f.values))
+	for label := range f.values {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+	values := make([]*T, len(labels))
+	for i, label := range labels {
+		values[i] = f.values[label]
+	}
+	f.mutex.Unlock()
+
+	for i, label := range labels {
+		fn(label, values[i])
+	}
+}
+
+type Metrics struct {
+	Requests        *Family[Family[Counter]] // by handler and status code
+	RequestDuration *Family[Histogram]       // by handler
+
+	InboxMessagesWritten     Counter
+	InboxMessagesRead        Counter
+	InboxExpiredPartsDeleted Counter
+	InboxQuotaRejected       Counter
+	InboxQuotaDropped        Counter
+	PrekeyFetches            Counter
+	PrekeyFetchesEmpty       Counter
+	UserHandlers             Gauge
+	UserHandlerQueueWait     *Family[Histogram] // by request type
+}
+
+var metrics = Metrics{
+	Requests: newFamily(func() *Family[Counter] {
+		return newFamily(func() *Counter { return &Counter{} })
+	}),
+	RequestDuration:      newFamily(func() *Histogram { return newHistogram(requestDurationBuckets) }),
+	UserHandlerQueueWait: newFamily(func() *Histogram { return newHistogram(queueWaitBuckets) }),
+}
+
+// Remembers the status code for `meterRequest()`
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (rec *StatusRecorder) WriteHeader(status int) {
+	rec.Status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// For `http.ResponseController`
+func (rec *StatusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Counts the request and measures how long it takes. The handler should use the returned
+// writer and call the returned function when it's done, e.g., with `defer`.
+func meterRequest(w http.ResponseWriter, handlerName string) (http.ResponseWriter, func()) {
+	rec := &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+	start := time.Now()
+	return rec, func() {
+		metrics.Requests.with(handlerName).with(strconv.Itoa(rec.Status)).inc()
+		metrics.RequestDuration.with(handlerName).observe(time.Since(start).Seconds())
+	}
+}
+
+// How long a request waited for the `user_handler()` to take it.
+// Requests are labeled by their type, e.g., `Put` for `PutRequest`.
+func observeQueueWait[Request any](start time.Time) {
+	name := strings.TrimSuffix(reflect.TypeFor[Request]().Name(), "Request")
+	metrics.UserHandlerQueueWait.with(name).observe(time.Since(start).Seconds())
+}
+
+func metrics_http_handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(w)
+}
+
+func (m *Metrics) write(w io.Writer) {
+	writeHeader(w, "loky_requests_total", "counter", "API requests by handler and status code.")
+	m.Requests.each(func(handler string, codes *Family[Counter]) {
+		codes.each(func(code string, c *Counter) {
+			fmt.Fprintf(w, "loky_requests_total{handler=%q,code=%q} %d\n", handler, code, c.value.Load())
+		})
+	})
+
+	writeHeader(w, "loky_request_duration_seconds", "histogram", "API request latency by handler.")
+	m.RequestDuration.each(func(handler string, h *Histogram) {
+		h.write(w, "loky_request_duration_seconds", "handler", handler)
+	})
+
+	writeCounter(w, "loky_inbox_messages_written_total", "Messages added to inboxes.", &m.InboxMessagesWritten)
+	writeCounter(w, "loky_inbox_messages_read_total", "Messages read from inboxes, including repeated reads of unacknowledged messages.", &m.InboxMessagesRead)
+	writeCounter(w, "loky_inbox_expired_parts_deleted_total", "Inbox files deleted because their messages expired (fs storage).", &m.InboxExpiredPartsDeleted)
+	writeCounter(w, "loky_inbox_quota_rejected_total", "Messages rejected because the inbox was full or the sender used up its share.", &m.InboxQuotaRejected)
+	writeCounter(w, "loky_inbox_quota_dropped_total", "Old messages removed to make room for new ones (drop_oldest policy).", &m.InboxQuotaDropped)
+	writeCounter(w, "loky_prekey_fetches_total", "Prekeys requested from devices.", &m.PrekeyFetches)
+	writeCounter(w, "loky_prekey_fetches_empty_total", "Prekey requests for devices that had no prekeys left.", &m.PrekeyFetchesEmpty)
+
+	writeHeader(w, "loky_user_handlers", "gauge", "Running user_handler goroutines, i.e., users loaded in memory.")
+	fmt.Fprintf(w, "loky_user_handlers %d\n", m.UserHandlers.value.Load())
+
+	writeHeader(w, "loky_user_handler_queue_wait_seconds", "histogram", "Time a request waited for its user_handler, by request type.")
+	m.UserHandlerQueueWait.each(func(request string, h *Histogram) {
+		h.write(w, "loky_user_handler_queue_wait_seconds", "request", request)
+	})
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounter(w io.Writer, name string, help string, c *Counter) {
+	writeHeader(w, name, "counter", help)
+	fmt.Fprintf(w, "%s %d\n", name, c.value.Load())
+}
+
+func (h *Histogram) write(w io.Writer, name string, labelName string, label string) {
+	h.mutex.Lock()
+	counts := slices.Clone(h.counts)
+	sum, count := h.sum, h.count
+	h.mutex.Unlock()
+
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", name, labelName, label, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, labelName, label, count)
+	fmt.Fprintf(w, "%s_sum{%s=%q} %s\n", name, labelName, label, strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, labelName, label, count)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testMetricsOutput(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metrics_http_handler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", w.Header().Get("Content-Type"))
+	}
+	return w.Body.String()
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogram([]float64{0.5, 1})
+	h.observe(0.25)
+	h.observe(0.5) // bounds are inclusive
+	h.observe(0.75)
+	h.observe(4)
+
+	var buf bytes.Buffer
+	h.write(&buf, "test_seconds", "handler", "recv")
+	want := `test_seconds_bucket{handler="recv",le="0.5"} 2
+test_seconds_bucket{handler="recv",le="1"} 3
+test_seconds_bucket{handler="recv",le="+Inf"} 4
+test_seconds_sum{handler="recv"} 5.5
+test_seconds_count{handler="recv"} 4
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s", buf.String())
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bearer := loginTestUser(t, alice)
+
+	before := testMetricsOutput(t)
+	for _, auth := range []string{"Bearer " + string(bearer), "Bearer invalid"} {
+		r := httptest.NewRequest(http.MethodPost, "/api/recv", strings.NewReader(`{}`))
+		r.Header.Set("Authorization", auth)
+		recv_http_handler(httptest.NewRecorder(), r)
+	}
+	after := testMetricsOutput(t)
+
+	for _, line := range []string{
+		`loky_requests_total{handler="recv",code="200"}`,
+		`loky_requests_total{handler="recv",code="401"}`,
+		`loky_request_duration_seconds_count{handler="recv"}`,
+		`loky_user_handler_queue_wait_seconds_count{request="Recv"}`,
+	} {
+		if testMetricValue(after, line) <= testMetricValue(before, line) {
+			t.Errorf("%s not increased", line)
+		}
+	}
+	if testMetricValue(after, "loky_user_handlers") < 1 {
+		t.Error("loaded user not counted")
+	}
+}
+
+// Value of the metric line starting with `name`, or -1 if there is none
+func testMetricValue(output string, name string) float64 {
+	for _, line := range strings.Split(output, "\n") {
+		if value, found := strings.CutPrefix(line, name+" "); found {
+			if v, err := strconv.ParseFloat(value, 64); err == nil {
+				return v
+			}
+		}
+	}
+	return -1
+}
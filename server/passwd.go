@@ -1,17 +1,126 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/pbkdf2"
 )
 
-func __hash_passwd(password []byte, salt []byte) []byte {
-	return pbkdf2.Key(password, salt, 16, 32, sha256.New)
+const PASSWD_ALG_PBKDF2 = "pbkdf2-sha256"
+const PASSWD_ALG_ARGON2ID = "argon2id"
+
+const PASSWD_HASH_LEN = 32
+
+// How a password is hashed. It is stored with each user, so the parameters in the config
+// can be changed at any time. Passwords hashed with other parameters are rehashed
+// on the next successful login.
+type PasswdHashParams struct {
+	Algorithm string `json:"alg"`
+	Time      uint32 `json:"time"`              // number of iterations
+	Memory    uint32 `json:"memory,omitempty"`  // KiB, argon2id only
+	Threads   uint8  `json:"threads,omitempty"` // argon2id only
+}
+
+// Used for users stored before the parameters were recorded
+var legacyPasswdHashParams = PasswdHashParams{
+	Algorithm: PASSWD_ALG_PBKDF2,
+	Time:      16,
+}
+
+// The minimum recommended by OWASP for argon2id
+func defaultPasswdHashParams() PasswdHashParams {
+	return PasswdHashParams{
+		Algorithm: PASSWD_ALG_ARGON2ID,
+		Time:      2,
+		Memory:    19 * 1024,
+		Threads:   1,
+	}
+}
+
+func (params *PasswdHashParams) validate() error {
+	switch params.Algorithm {
+	case PASSWD_ALG_PBKDF2:
+		if params.Time < 1 {
+			return fmt.Errorf("pbkdf2: time must be at least 1")
+		}
+	case PASSWD_ALG_ARGON2ID:
+		if params.Time < 1 || params.Threads < 1 || params.Memory < 8*uint32(params.Threads) {
+			return fmt.Errorf("argon2id: invalid parameters")
+		}
+	default:
+		return fmt.Errorf("unknown password hash algorithm: %s", params.Algorithm)
+	}
+	return nil
+}
+
+func (params *PasswdHashParams) hash(passwd []byte, salt []byte) ([]byte, error) {
+	switch params.Algorithm {
+	case PASSWD_ALG_PBKDF2:
+		return pbkdf2.Key(passwd, salt, int(params.Time), PASSWD_HASH_LEN, sha256.New), nil
+	case PASSWD_ALG_ARGON2ID:
+		return argon2.IDKey(passwd, salt, params.Time, params.Memory, params.Threads, PASSWD_HASH_LEN), nil
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm: %s", params.Algorithm)
+	}
 }
 
-func (user *User) check_passwd(passwd []byte) bool {
-	hashed_passwd := __hash_passwd(passwd, user.Salt)
-	return bytes.Equal(hashed_passwd, user.Passwd)
+func (user *User) passwdHashParams() *PasswdHashParams {
+	if user.PasswdHash == nil {
+		return &legacyPasswdHashParams
+	}
+	return user.PasswdHash
+}
+
+// Hashes the password with a new salt and the parameters from the config
+func (user *User) set_passwd(passwd []byte) error {
+	salt, err := randBytes(16)
+	if err != nil {
+		return fmt.Errorf("error generating salt: %s", err.Error())
+	}
+
+	params := config.PasswdHash
+	hashed_passwd, err := params.hash(passwd, salt)
+	if err != nil {
+		return err
+	}
+
+	user.Salt = salt
+	user.Passwd = hashed_passwd
+	user.PasswdHash = &params
+	return nil
+}
+
+// Returns whether the password is correct and whether it should be rehashed,
+// because it was hashed with other parameters than the ones in the config.
+func (user *User) check_passwd(passwd []byte) (ok bool, rehash bool) {
+	params := user.passwdHashParams()
+	hashed_passwd, err := params.hash(passwd, user.Salt)
+	if err != nil {
+		Log.e("check_passwd(): %s: %s", redact(user.Username), err.Error())
+		return false, false
+	}
+	if subtle.ConstantTimeCompare(hashed_passwd, user.Passwd) != 1 {
+		return false, false
+	}
+	return true, *params != config.PasswdHash
+}
+
+// Upgrades the password hash to the parameters from the config.
+// Failure is not fatal, the old hash still works.
+func (user *User) rehash_passwd(passwd []byte) {
+	oldSalt, oldPasswd, oldParams := user.Salt, user.Passwd, user.PasswdHash
+
+	err := user.set_passwd(passwd)
+	if err == nil {
+		err = user.save()
+	}
+	if err != nil {
+		Log.e("rehash_passwd(): %s: %s", redact(user.Username), err.Error())
+		user.Salt, user.Passwd, user.PasswdHash = oldSalt, oldPasswd, oldParams
+		return
+	}
+	Log.i("Rehashed password of %s with %s", redact(user.Username), user.PasswdHash.Algorithm)
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLoginRehashesPasswd(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+
+	// As stored before the parameters were recorded
+	legacy, err := legacyPasswdHashParams.hash(hash("passwd of alice"), alice.Salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Passwd = legacy
+	alice.PasswdHash = nil
+
+	// A wrong password doesn't change anything
+	respChan := make(chan LoginResponse)
+	alice.Login <- LoginRequest{Passwd: hash("wrong"), Response: respChan}
+	if resp := <-respChan; resp.Err == nil || resp.Err.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: %v", resp.Err)
+	}
+	if alice.PasswdHash != nil {
+		t.Fatal("rehashed with a wrong password")
+	}
+
+	loginTestUser(t, alice)
+	if alice.PasswdHash == nil || *alice.PasswdHash != config.PasswdHash {
+		t.Fatalf("not rehashed: %+v", alice.PasswdHash)
+	}
+
+	// The rehashed password is saved
+	saved, err := storage.loadUser(alice.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.PasswdHash == nil || *saved.PasswdHash != config.PasswdHash {
+		t.Errorf("saved %+v", saved.PasswdHash)
+	}
+	loginTestUser(t, alice)
+}
+
+func TestPasswdHashParamsValidate(t *testing.T) {
+	for _, test := range []struct {
+		params PasswdHashParams
+		valid  bool
+	}{
+		{defaultPasswdHashParams(), true},
+		{legacyPasswdHashParams, true},
+		{PasswdHashParams{Algorithm: PASSWD_ALG_PBKDF2}, false},
+		{PasswdHashParams{Algorithm: PASSWD_ALG_ARGON2ID, Time: 1, Memory: 7, Threads: 1}, false},
+		{PasswdHashParams{Algorithm: PASSWD_ALG_ARGON2ID, Time: 1, Memory: 64}, false},
+		{PasswdHashParams{Algorithm: "md5", Time: 1}, false},
+	} {
+		if err := test.params.validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: %v", test.params, err)
+		}
+	}
+}
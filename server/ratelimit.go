@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token bucket rate limits, configured in `config.json` under `rate_limits`.
+//
+// Every API request takes a token from the bucket of its source IP and, once the bearer
+// is verified, from the bucket of its bearer. Both are per endpoint. `send` takes one token
+// per item, since each item is written to disk.
+//
+// Failed logins take a token from the bucket of the username, so guessing passwords
+// is slow no matter how many IPs the guesses come from.
+
+// A bucket holds up to `Burst` tokens and gets `PerMinute` tokens per minute.
+// `PerMinute == 0` means no limit.
+type RateLimit struct {
+	PerMinute float64 `json:"per_min"`
+	Burst     float64 `json:"burst"`
+}
+
+type EndpointRateLimits struct {
+	PerIp     *RateLimit `json:"per_ip,omitempty"`
+	PerBearer *RateLimit `json:"per_bearer,omitempty"`
+}
+
+type RateLimitConfig struct {
+	Default EndpointRateLimits `json:"default"`
+
+	// By handler name, e.g., `send`. Limits that are not set are taken from `Default`.
+	// Endpoints missing here get their built-in limits, see `addMissingEndpoints()`.
+	Endpoints map[string]EndpointRateLimits `json:"endpoints"`
+
+	FailedLoginsPerUser RateLimit `json:"failed_logins_per_user"`
+
+	// On a unix socket, the header in which the reverse proxy passes the client address,
+	// e.g., `X-Forwarded-For` or `X-Real-IP`. Without it, all clients share the per-IP limits.
+	ClientIpHeader string `json:"client_ip_header,omitempty"`
+}
+
+// Buckets that haven't been used for a while are full, so they can be dropped
+const RATE_LIMIT_CLEANUP_SEC int64 = 5 * MINUTE
+
+func defaultRateLimits() *RateLimitConfig {
+	return &RateLimitConfig{
+		Default: EndpointRateLimits{
+			PerIp:     &RateLimit{PerMinute: 600, Burst: 100},
+			PerBearer: &RateLimit{PerMinute: 300, Burst: 50},
+		},
+		Endpoints: map[string]EndpointRateLimits{
+			// Each login hashes a password, which is expensive on purpose
+			"login": {PerIp: &RateLimit{PerMinute: 30, Burst: 10}},
+			"reg":   {PerIp: &RateLimit{PerMinute: 5, Burst: 5}},
+			// Only used in the open registration mode
+			"regChallenge": {PerIp: &RateLimit{PerMinute: 10, Burst: 10}},
+			"send":         {PerBearer: &RateLimit{PerMinute: 600, Burst: 100}},
+		},
+		FailedLoginsPerUser: RateLimit{PerMinute: 1, Burst: 10},
+	}
+}
+
+// Configs saved before an endpoint was added don't have its limits, and it would fall back
+// to `Default`, which is far too lax for endpoints like `regChallenge`. So every endpoint
+// with built-in limits that is missing from the config gets them, in memory only.
+// To lift a built-in limit, set it to `{"per_min": 0}`.
+func (cfg *RateLimitConfig) addMissingEndpoints(defaults *RateLimitConfig) {
+	if cfg.Endpoints == nil {
+		cfg.Endpoints = make(map[string]EndpointRateLimits)
+	}
+	for endpoint, limits := range defaults.Endpoints {
+		if _, ok := cfg.Endpoints[endpoint]; !ok {
+			cfg.Endpoints[endpoint] = limits
+		}
+	}
+}
+
+func (limit *RateLimit) validate() error {
+	if limit.PerMinute < 0 {
+		return fmt.Errorf("per_min must not be negative")
+	}
+	if limit.PerMinute > 0 && limit.Burst < 1 {
+		return fmt.Errorf("burst must be at least 1")
+	}
+	return nil
+}
+
+func (cfg *RateLimitConfig) validate() error {
+	check := func(name string, limit *RateLimit) error {
+		if limit == nil {
+			return nil
+		}
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		return nil
+	}
+	if err := check("default.per_ip", cfg.Default.PerIp); err != nil {
+		return err
+	}
+	if err := check("default.per_bearer", cfg.Default.PerBearer); err != nil {
+		return err
+	}
+	for endpoint, limits := range cfg.Endpoints {
+		if err := check(endpoint+".per_ip", limits.PerIp); err != nil {
+			return err
+		}
+		if err := check(endpoint+".per_bearer", limits.PerBearer); err != nil {
+			return err
+		}
+	}
+	return check("failed_logins_per_user", &cfg.FailedLoginsPerUser)
+}
+
+func (cfg *RateLimitConfig) perIp(endpoint string) RateLimit {
+	if limits, ok := cfg.Endpoints[endpoint]; ok && limits.PerIp != nil {
+		return *limits.PerIp
+	}
+	if cfg.Default.PerIp != nil {
+		return *cfg.Default.PerIp
+	}
+	return RateLimit{}
+}
+
+func (cfg *RateLimitConfig) perBearer(endpoint string) RateLimit {
+	if limits, ok := cfg.Endpoints[endpoint]; ok && limits.PerBearer != nil {
+		return *limits.PerBearer
+	}
+	if cfg.Default.PerBearer != nil {
+		return *cfg.Default.PerBearer
+	}
+	return RateLimit{}
+}
+
+type TokenBucket struct {
+	Limit   RateLimit
+	Tokens  float64
+	Updated time.Time
+}
+
+func (bucket *TokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(bucket.Updated).Minutes()
+	bucket.Tokens = min(bucket.Limit.Burst, bucket.Tokens+elapsed*bucket.Limit.PerMinute)
+	bucket.Updated = now
+}
+
+type RateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*TokenBucket
+}
+
+var rateLimiter = RateLimiter{
+	buckets: make(map[string]*TokenBucket),
+}
+
+// Takes `cost` tokens from the bucket. If there are not enough, takes nothing and
+// returns how long to wait until there are.
+func (limiter *RateLimiter) take(key string, limit RateLimit, cost float64) (bool, time.Duration) {
+	if limit.PerMinute <= 0 {
+		return true, 0
+	}
+	// Otherwise a large `send` could never go through
+	cost = min(cost, limit.Burst)
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &TokenBucket{Limit: limit, Tokens: limit.Burst, Updated: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.refill(now)
+
+	if bucket.Tokens < cost {
+		missing := cost - bucket.Tokens
+		return false, time.Duration(missing / limit.PerMinute * float64(time.Minute))
+	}
+	bucket.Tokens -= cost
+	return true, 0
+}
+
+// Returns tokens taken by `take()`
+func (limiter *RateLimiter) refund(key string, cost float64) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		return
+	}
+	bucket.Tokens = min(bucket.Limit.Burst, bucket.Tokens+cost)
+}
+
+// Drops buckets that have filled up again. Runs until the server shuts down.
+func (limiter *RateLimiter) cleanup() {
+	ticker := time.NewTicker(time.Duration(RATE_LIMIT_CLEANUP_SEC) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-serverCtx.Done():
+			return
+		}
+
+		limiter.mutex.Lock()
+		now := time.Now()
+		for key, bucket := range limiter.buckets {
+			bucket.refill(now)
+			if bucket.Tokens >= bucket.Limit.Burst {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.mutex.Unlock()
+	}
+}
+
+func errRateLimited(handlerName string, retryAfter time.Duration) *RestAPIError {
+	err := NewError(handlerName+": rate limit exceeded", http.StatusTooManyRequests)
+	err.RetryAfterSec = int64(math.Ceil(retryAfter.Seconds()))
+	return err
+}
+
+func limitIp(r *http.Request, handlerName string) *RestAPIError {
+	key := "ip:" + handlerName + ":" + clientIp(r)
+	ok, retryAfter := rateLimiter.take(key, config.RateLimits.perIp(handlerName), 1)
+	if !ok {
+		return errRateLimited(handlerName, retryAfter)
+	}
+	return nil
+}
+
+func limitBearer(claims BearerClaims, handlerName string, cost int) *RestAPIError {
+	key := fmt.Sprintf("bearer:%s:%d", handlerName, claims.TokenId)
+	ok, retryAfter := rateLimiter.take(key, config.RateLimits.perBearer(handlerName), float64(cost))
+	if !ok {
+		return errRateLimited(handlerName, retryAfter)
+	}
+	return nil
+}
+
+func failedLoginKey(username string) string {
+	return "login:" + username
+}
+
+// Takes a token for a login attempt. If the login succeeds, `refundLoginAttempt()`
+// gives it back, so only failed logins count.
+func limitLoginAttempt(username string) *RestAPIError {
+	ok, retryAfter := rateLimiter.take(failedLoginKey(username), config.RateLimits.FailedLoginsPerUser, 1)
+	if !ok {
+		return errRateLimited("login", retryAfter)
+	}
+	return nil
+}
+
+func refundLoginAttempt(username string) {
+	rateLimiter.refund(failedLoginKey(username), 1)
+}
+
+// Requests that cost more than one token implement this
+type RateLimitCost interface {
+	rateLimitCost() int
+}
+
+func requestCost(req any) int {
+	if c, ok := req.(RateLimitCost); ok {
+		return max(c.rateLimitCost(), 1)
+	}
+	return 1
+}
+
+// The address of the client, for per-IP limits.
+//
+// On a unix socket, the server is behind a reverse proxy and `RemoteAddr` doesn't say
+// anything. The proxy passes the client address in `ClientIpHeader`. If it's a list,
+// as in `X-Forwarded-For`, the last entry is the one added by our proxy, the ones before
+// it could be made up by the client. A client header is never used without the setting,
+// any client could send one.
+//
+// IPv6 clients usually get a whole /64, so they are limited by their /64.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || host == "" {
+		header := config.RateLimits.ClientIpHeader
+		if header == "" {
+			return ""
+		}
+		forwarded := r.Header.Get(header)
+		host = strings.TrimSpace(forwarded[strings.LastIndex(forwarded, ",")+1:])
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return ip.String()
+}
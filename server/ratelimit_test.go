@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limiter := RateLimiter{buckets: make(map[string]*TokenBucket)}
+	limit := RateLimit{PerMinute: 60, Burst: 3}
+
+	for i := range 3 {
+		if ok, _ := limiter.take("k", limit, 1); !ok {
+			t.Fatalf("request %d limited", i)
+		}
+	}
+	ok, retryAfter := limiter.take("k", limit, 1)
+	if ok {
+		t.Fatal("burst exceeded")
+	}
+	// One token per second
+	if retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("retry after %s", retryAfter)
+	}
+	// Other keys have their own bucket
+	if ok, _ := limiter.take("other", limit, 1); !ok {
+		t.Error("other key limited")
+	}
+
+	limiter.refund("k", 1)
+	if ok, _ := limiter.take("k", limit, 1); !ok {
+		t.Error("refunded token not available")
+	}
+
+	// A cost above the burst takes the whole bucket instead of never going through
+	if ok, _ := limiter.take("large", limit, 10); !ok {
+		t.Error("large request limited")
+	}
+	if ok, _ := limiter.take("large", limit, 1); ok {
+		t.Error("bucket not emptied")
+	}
+
+	if ok, _ := limiter.take("unlimited", RateLimit{}, 1000); !ok {
+		t.Error("limited without a limit")
+	}
+}
+
+func TestClientIp(t *testing.T) {
+	setupTest(t)
+	config.RateLimits.ClientIpHeader = "X-Forwarded-For"
+	for _, test := range []struct {
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"[2001:db8:1:2:3:4:5:6]:1234", "", "2001:db8:1:2::/64"},
+		// Behind a proxy on a unix socket. Only the last entry is trusted.
+		{"@", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"", "198.51.100.7", "198.51.100.7"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/recv", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if got := clientIp(r); got != test.want {
+			t.Errorf("%q, %q: got %q, want %q", test.remoteAddr, test.forwarded, got, test.want)
+		}
+	}
+
+	// Without the setting, the header could come from anyone
+	config.RateLimits.ClientIpHeader = ""
+	r := httptest.NewRequest(http.MethodPost, "/api/recv", nil)
+	r.RemoteAddr = "@"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if got := clientIp(r); got != "" {
+		t.Errorf("header used without the setting: %q", got)
+	}
+}
+
+func loginTestHttp(username string, passwd string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(LoginRequest{Username: username, Passwd: hash(passwd)})
+	w := httptest.NewRecorder()
+	login_http_handler(w, httptest.NewRequest(http.MethodPost, "/api/login", bytes.NewReader(body)))
+	return w
+}
+
+func TestFailedLoginsLimited(t *testing.T) {
+	setupTest(t)
+	addTestUser(t, "alice")
+	config.RateLimits = &RateLimitConfig{FailedLoginsPerUser: RateLimit{PerMinute: 1, Burst: 2}}
+
+	// Successful logins don't count
+	for range 3 {
+		if w := loginTestHttp("alice", "passwd of alice"); w.Code != http.StatusOK {
+			t.Fatalf("login: %d %s", w.Code, w.Body)
+		}
+	}
+	for range 2 {
+		if w := loginTestHttp("alice", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password: %d", w.Code)
+		}
+	}
+	// Now even the right password is refused for a while
+	w := loginTestHttp("alice", "passwd of alice")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("after failed logins: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Other users are not affected
+	addTestUser(t, "bob")
+	if w := loginTestHttp("bob", "passwd of bob"); w.Code != http.StatusOK {
+		t.Errorf("other user: %d", w.Code)
+	}
+}
+
+func TestRequestsLimitedPerBearer(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bearer := loginTestUser(t, alice)
+	config.RateLimits = &RateLimitConfig{
+		Default: EndpointRateLimits{PerBearer: &RateLimit{PerMinute: 1, Burst: 2}},
+	}
+
+	codes := make([]int, 0)
+	for range 3 {
+		r := httptest.NewRequest(http.MethodPost, "/api/recv", bytes.NewBufferString(`{}`))
+		r.Header.Set("Authorization", "Bearer "+string(bearer))
+		w := httptest.NewRecorder()
+		recv_http_handler(w, r)
+		codes = append(codes, w.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("codes %v", codes)
+	}
+}
+
+func TestRateLimitConfigValidate(t *testing.T) {
+	if err := defaultRateLimits().validate(); err != nil {
+		t.Error(err)
+	}
+	for _, cfg := range []RateLimitConfig{
+		{Default: EndpointRateLimits{PerIp: &RateLimit{PerMinute: -1}}},
+		{Endpoints: map[string]EndpointRateLimits{"send": {PerBearer: &RateLimit{PerMinute: 10}}}},
+		{FailedLoginsPerUser: RateLimit{PerMinute: 1, Burst: 0.5}},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
+
+func TestRateLimitConfigAddMissingEndpoints(t *testing.T) {
+	// Saved before `regChallenge` was added, with the login limit lifted
+	var cfg RateLimitConfig
+	err := json.Unmarshal([]byte(`{"endpoints": {"login": {"per_ip": {"per_min": 0}}}}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.addMissingEndpoints(defaultRateLimits())
+	if limits := cfg.Endpoints["regChallenge"]; limits.PerIp == nil || limits.PerIp.PerMinute != 10 {
+		t.Errorf("regChallenge: %+v", limits)
+	}
+	if limits := cfg.Endpoints["login"]; limits.PerIp == nil || limits.PerIp.PerMinute != 0 {
+		t.Errorf("configured limit replaced: %+v", limits)
+	}
+}
@@ -1,40 +1,177 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"time"
 )
 
 type RecvRequest struct {
+	// Optional. Acknowledges all messages with `seq <= Ack`, so they are removed from the inbox.
+	// Normally, this is the `Cursor` from the previous response.
+	//
+	// Clients that don't send `Ack` get the old behavior. Messages are removed from the inbox
+	// as soon as they are returned, even if the response never reaches the client.
+	Ack *uint64 `json:"ack"`
+
+	// Optional. If the inbox is empty, keep the request open for up to `WaitSec` seconds
+	// and return as soon as a message arrives.
+	WaitSec int64 `json:"wait_sec"`
+
+	// Set when a parked request gives up waiting. The waiter is removed from the device,
+	// unless it was superseded already.
+	Unpark *RecvWaiter `json:"-"`
+
+	Device   uint64              `json:"-"`
 	Response chan<- RecvResponse `json:"-"`
 }
 
 type RecvResponse struct {
 	Items []Message `json:"items"`
 
+	// `seq` of the last item, or 0 if there are no items
+	Cursor uint64 `json:"cursor"`
+
+	// Set instead of `Items` when the inbox is empty and the request wants to wait.
+	Waiter *RecvWaiter `json:"-"`
+
 	Err *RestAPIError `json:"-"`
 }
 
+// A parked long-polling `recv` request.
+type RecvWaiter struct {
+	// Closed when a message arrives or when the waiter is superseded by a newer request.
+	Wake chan struct{}
+
+	// Only valid after `Wake` is closed.
+	Superseded bool
+}
+
 func recv_http_handler(w http.ResponseWriter, r *http.Request) {
-	restAPI_handler(w, r, "recv", 4096, recv_restAPI_handler)
+	restAPI_handler(w, r, "recv", 4096, func(user *User, device uint64, req RecvRequest) (RecvResponse, *RestAPIError) {
+		return recv_restAPI_handler(r.Context(), user, device, req)
+	})
 }
 
-func recv_restAPI_handler(user *User, req RecvRequest) (RecvResponse, *RestAPIError) {
+// `ctx` is the context of the request. It's derived from `serverCtx`, so it's also
+// canceled on shutdown.
+func recv_restAPI_handler(ctx context.Context, user *User, device uint64, req RecvRequest) (RecvResponse, *RestAPIError) {
+	waitSec := min(max(req.WaitSec, 0), RECV_MAX_WAIT_SEC)
+	timer := time.NewTimer(time.Duration(waitSec) * time.Second)
+	defer timer.Stop()
+
 	respChan := make(chan RecvResponse)
 	defer close(respChan)
 
+	req.WaitSec = waitSec
+	req.Device = device
 	req.Response = respChan
 
-	user.Recv <- req
-	resp := <-respChan
+	for {
+		resp, ok := callUserHandler(user, user.Recv, req, respChan)
+		if !ok {
+			return RecvResponse{}, errUserStopped("recv")
+		}
+
+		if resp.Waiter == nil {
+			return resp, resp.Err
+		}
+
+		// The inbox is empty. Wait for a message without blocking the `user_handler()`.
+		select {
+		case <-resp.Waiter.Wake:
+			if resp.Waiter.Superseded {
+				return RecvResponse{Items: make([]Message, 0)}, nil
+			}
+		case <-timer.C:
+			unparkRecvWaiter(user, device, resp.Waiter, respChan)
+			return RecvResponse{Items: make([]Message, 0)}, nil
+		case <-ctx.Done():
+			// The client is gone or the server is shutting down
+			unparkRecvWaiter(user, device, resp.Waiter, respChan)
+			return RecvResponse{Items: make([]Message, 0)}, nil
+		}
+	}
+}
 
-	return resp, resp.Err
+// A parked waiter keeps the user from being evicted, see `User.tryEvict()`
+func unparkRecvWaiter(user *User, device uint64, waiter *RecvWaiter, respChan chan RecvResponse) {
+	req := RecvRequest{
+		Unpark:   waiter,
+		Device:   device,
+		Response: respChan,
+	}
+	callUserHandler(user, user.Recv, req, respChan)
 }
 
-func recv_synchronized_handler(user *User) RecvResponse {
-	msgs, err := user.Inbox.getMessages(monotonicSeconds())
+func recv_synchronized_handler(user *User, req RecvRequest) RecvResponse {
+	device, err := user.deviceOrError(req.Device)
+	if req.Unpark != nil {
+		if device != nil && device.RecvWaiter == req.Unpark {
+			device.RecvWaiter = nil
+		}
+		return RecvResponse{}
+	}
+	if err != nil {
+		return RecvResponse{Err: err}
+	}
+
+	if req.Ack != nil {
+		err := device.Inbox.ack(*req.Ack)
+		if err != nil {
+			return RecvResponse{Err: err}
+		}
+	}
+
+	msgs, err := device.Inbox.getMessages(monotonicSeconds())
+	if err != nil {
+		return RecvResponse{Err: err}
+	}
+	metrics.InboxMessagesRead.add(len(msgs))
 	Log.d("msgs.count = %d", len(msgs))
+
+	if len(msgs) == 0 {
+		if req.WaitSec > 0 {
+			return RecvResponse{
+				Waiter: device.parkRecvWaiter(),
+			}
+		}
+		return RecvResponse{
+			Items: msgs,
+		}
+	}
+
+	cursor := msgs[len(msgs)-1].Seq
+	if req.Ack == nil {
+		err = device.Inbox.ack(cursor)
+		if err != nil {
+			return RecvResponse{Err: err}
+		}
+	}
+
 	return RecvResponse{
-		Items: msgs,
-		Err:   err,
+		Items:  msgs,
+		Cursor: cursor,
+	}
+}
+
+func (device *Device) parkRecvWaiter() *RecvWaiter {
+	// There is at most one parked request per device. The newest one wins,
+	// the older one is released with an empty response.
+	if device.RecvWaiter != nil {
+		device.RecvWaiter.Superseded = true
+		close(device.RecvWaiter.Wake)
+	}
+	waiter := &RecvWaiter{
+		Wake: make(chan struct{}),
+	}
+	device.RecvWaiter = waiter
+	return waiter
+}
+
+func (device *Device) wakeRecvWaiter() {
+	if device.RecvWaiter != nil {
+		close(device.RecvWaiter.Wake)
+		device.RecvWaiter = nil
 	}
 }
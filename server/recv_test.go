@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+type testRecvResult struct {
+	resp    RecvResponse
+	err     *RestAPIError
+	elapsed time.Duration
+}
+
+// Calls `recv` in the background, as concurrent requests do
+func startTestRecv(user *User, waitSec int64) <-chan testRecvResult {
+	return startTestRecvContext(serverCtx, user, waitSec)
+}
+
+// `ctx` is the context of the request, canceled when the client disconnects
+func startTestRecvContext(ctx context.Context, user *User, waitSec int64) <-chan testRecvResult {
+	result := make(chan testRecvResult, 1)
+	go func() {
+		start := time.Now()
+		resp, err := recv_restAPI_handler(ctx, user, TEST_DEVICE, RecvRequest{WaitSec: waitSec})
+		result <- testRecvResult{resp: resp, err: err, elapsed: time.Since(start)}
+	}()
+	return result
+}
+
+func waitTestRecv(t *testing.T, result <-chan testRecvResult) testRecvResult {
+	t.Helper()
+	select {
+	case r := <-result:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("recv didn't return")
+		return testRecvResult{}
+	}
+}
+
+func TestRecvWithoutWait(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+
+	r := waitTestRecv(t, startTestRecv(alice, 0))
+	if len(r.resp.Items) != 0 {
+		t.Errorf("empty inbox: %v", messagePayloads(r.resp.Items))
+	}
+
+	putTestMessage(t, alice, "bob", "hi")
+	r = waitTestRecv(t, startTestRecv(alice, 30))
+	if got := messagePayloads(r.resp.Items); !slices.Equal(got, []string{"hi"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestRecvWakesOnMessage(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+
+	result := startTestRecv(alice, 30)
+	// Let it park
+	time.Sleep(100 * time.Millisecond)
+	putTestMessage(t, alice, "bob", "hi")
+
+	r := waitTestRecv(t, result)
+	if got := messagePayloads(r.resp.Items); !slices.Equal(got, []string{"hi"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestRecvTimeout(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+
+	r := waitTestRecv(t, startTestRecv(alice, 1))
+	if len(r.resp.Items) != 0 {
+		t.Errorf("got %v", messagePayloads(r.resp.Items))
+	}
+	if r.elapsed < time.Second {
+		t.Errorf("returned after %s", r.elapsed)
+	}
+}
+
+func TestRecvSupersededWaiter(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+
+	first := startTestRecv(alice, 30)
+	time.Sleep(100 * time.Millisecond)
+	second := startTestRecv(alice, 30)
+
+	// The older request is released empty, the newer one gets the message
+	r := waitTestRecv(t, first)
+	if len(r.resp.Items) != 0 {
+		t.Errorf("superseded request got %v", messagePayloads(r.resp.Items))
+	}
+	putTestMessage(t, alice, "bob", "hi")
+	r = waitTestRecv(t, second)
+	if got := messagePayloads(r.resp.Items); !slices.Equal(got, []string{"hi"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestRecvNegativeWait(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+
+	parked := startTestRecv(alice, 30)
+	time.Sleep(100 * time.Millisecond)
+
+	// Doesn't wait, so it doesn't replace the parked request either
+	r := waitTestRecv(t, startTestRecv(alice, -1))
+	if r.elapsed > time.Second {
+		t.Errorf("returned after %s", r.elapsed)
+	}
+	putTestMessage(t, alice, "bob", "hi")
+	r = waitTestRecv(t, parked)
+	if got := messagePayloads(r.resp.Items); !slices.Equal(got, []string{"hi"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestRecvClientDisconnect(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	ctx, cancel := context.WithCancel(context.Background())
+	waiter := startTestRecvContext(ctx, alice, 10)
+	// Let it park
+	time.Sleep(100 * time.Millisecond)
+
+	cancel()
+	if r := waitTestRecv(t, waiter); len(r.resp.Items) != 0 || r.elapsed > 5*time.Second {
+		t.Errorf("recv after disconnect: %+v", r)
+	}
+
+	// Doesn't take a message that arrives later, it stays in the inbox
+	putTestMessage(t, alice, "bob", "a")
+	if got := messagePayloads(recvTest(t, alice, nil).Items); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("inbox: %v", got)
+	}
+}
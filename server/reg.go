@@ -5,8 +5,12 @@ import (
 	"net/http"
 )
 
+// Depending on `config.Registration.Mode`, either `Invitation`, or `Challenge` from
+// `/api/regChallenge` and its solution `Nonce` are required. See `registration.go`.
 type RegRequest struct {
 	Invitation string      `json:"invitation"`
+	Challenge  string      `json:"challenge"`
+	Nonce      string      `json:"nonce"`
 	Username   string      `json:"username"`
 	Passwd     Base64Bytes `json:"passwd"`
 }
@@ -15,10 +19,17 @@ type RegResponse struct {
 }
 
 func reg_http_handler(w http.ResponseWriter, r *http.Request) {
-	Log.i("=================================================================================")
-	Log.i("reg_handler")
+	w, done := meterRequest(w, "reg")
+	defer done()
+	log := startRequest(w, r, "reg")
 	r.Body = http.MaxBytesReader(w, r.Body, 1024)
 
+	restAPIerr := limitIp(r, "reg")
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
 	var req RegRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
@@ -27,38 +38,39 @@ func reg_http_handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = validateUsername(req.Username)
+	if err != nil {
+		restAPIerror(w, NewError("reg: "+err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	mode := config.Registration.Mode
+	if mode == REG_MODE_CLOSED {
+		restAPIerror(w, NewError("reg: registration is closed", http.StatusForbidden))
+		return
+	}
+
 	GlobalLock.Lock()
 	defer GlobalLock.Unlock()
 
 	oldUsers := usersList.Load()
-	user := oldUsers.userByName(req.Username)
-	if user != nil {
+	if oldUsers.hasName(req.Username) {
 		msg := "reg: user already exists"
 		restAPIerror(w, NewError(msg, http.StatusConflict))
 		return
 	}
 
-	// check if invitation is in config.Invitations
-	index := -1
-	for i, inv := range config.Invitations {
-		if inv == req.Invitation {
-			index = i
-			break
-		}
+	// Checked after the username, so a taken username doesn't use up the challenge
+	if mode == REG_MODE_INVITE || req.Invitation != "" {
+		restAPIerr = useInvitation(req.Invitation, req.Username, monotonicSeconds())
+	} else {
+		restAPIerr = checkProofOfWork(req.Challenge, req.Nonce)
 	}
-
-	// if invitation is not found, return error
-	if index < 0 {
-		msg := "reg: invalid invitation"
-		restAPIerror(w, NewError(msg, http.StatusForbidden))
+	if restAPIerr != nil {
+		restAPIerror(w, NewError("reg: "+restAPIerr.Err, restAPIerr.Code))
 		return
 	}
 
-	// remove invitation from config and log invitation usage
-	config.Invitations = append(config.Invitations[:index], config.Invitations[index+1:]...)
-	config.UsedInvitations = append(config.UsedInvitations, req.Username+": "+req.Invitation)
-	config.save()
-
 	// create new user
 	newUsers, err := addUser(oldUsers, req.Username, req.Passwd)
 	if err != nil {
@@ -67,6 +79,7 @@ func reg_http_handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	usersList.Store(newUsers)
+	log.i("User registered: %s", redact(req.Username))
 
 	err = json.NewEncoder(w).Encode(RegResponse{})
 	if err != nil {
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Who can register, configured in `config.json` under `registration`:
+//
+//   - `invite`: only with an invitation code, see `invitation.go`. The default.
+//   - `open`: anyone, after solving a proof-of-work challenge from `/api/regChallenge`.
+//     An invitation can be used instead of the challenge, e.g., to record the inviter.
+//   - `closed`: nobody. The admin can still create users.
+//
+// Registrations are also limited per IP, see `rate_limits` and `ratelimit.go`.
+//
+// The challenge is a random value signed by the server, so the server doesn't have to
+// remember issued challenges, only the solved ones until they expire. A solution is a nonce,
+// such that `sha256(challenge + ":" + nonce)` starts with `Bits` zero bits.
+
+type RegistrationConfig struct {
+	Mode string `json:"mode"`
+
+	// Proof-of-work difficulty for `open`. Each bit doubles the expected work.
+	Bits         int   `json:"pow_bits"`
+	ChallengeSec int64 `json:"challenge_sec"`
+}
+
+const REG_MODE_INVITE = "invite"
+const REG_MODE_OPEN = "open"
+const REG_MODE_CLOSED = "closed"
+
+const USERNAME_MIN_LEN = 3
+const USERNAME_MAX_LEN = 32
+
+func defaultRegistration() *RegistrationConfig {
+	return &RegistrationConfig{
+		Mode:         REG_MODE_INVITE,
+		Bits:         20,
+		ChallengeSec: 5 * MINUTE,
+	}
+}
+
+func (cfg *RegistrationConfig) validate() error {
+	if cfg.Mode != REG_MODE_INVITE && cfg.Mode != REG_MODE_OPEN && cfg.Mode != REG_MODE_CLOSED {
+		return fmt.Errorf("unknown mode: %s", cfg.Mode)
+	}
+	if cfg.Bits < 0 || cfg.Bits > 32 {
+		return fmt.Errorf("pow_bits must be between 0 and 32")
+	}
+	if cfg.ChallengeSec < 1 {
+		return fmt.Errorf("challenge_sec must be positive")
+	}
+	return nil
+}
+
+// Letters, digits and `.`, `_`, `-`, starting with a letter or digit.
+// Usernames are shown to other users, so anything that could be confused is out.
+func validateUsername(username string) error {
+	if len(username) < USERNAME_MIN_LEN || len(username) > USERNAME_MAX_LEN {
+		return fmt.Errorf("username must be %d to %d characters long", USERNAME_MIN_LEN, USERNAME_MAX_LEN)
+	}
+	for i, c := range username {
+		alnum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !alnum && (i == 0 || (c != '.' && c != '_' && c != '-')) {
+			return fmt.Errorf("username can only contain letters, digits, '.', '_' and '-', and must start with a letter or digit")
+		}
+	}
+	return nil
+}
+
+// Challenges are signed with a key that changes on restart. Unsolved challenges
+// are then just requested again.
+var challengeKey = func() []byte {
+	key, err := randBytes(32)
+	if err != nil {
+		panic("error generating challenge key: " + err.Error())
+	}
+	return key
+}()
+
+const challengePayloadSize = 16 + 8 + 1
+
+type ChallengeClaims struct {
+	Expires int64 // seconds since `referenceTime`
+	Bits    int
+}
+
+func makeChallenge(bits int, expires int64) (string, error) {
+	payload, err := randBytes(16)
+	if err != nil {
+		return "", err
+	}
+	payload = binary.LittleEndian.AppendUint64(payload, uint64(expires))
+	payload = append(payload, byte(bits))
+	return base64Encode(payload) + "." + base64Encode(signChallenge(payload)), nil
+}
+
+func signChallenge(payload []byte) []byte {
+	mac := hmac.New(sha256.New, challengeKey)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Checks the signature and expiry of the challenge, and that the nonce solves it
+func verifyChallenge(challenge string, nonce string, now int64) (ChallengeClaims, error) {
+	encodedPayload, encodedSignature, found := strings.Cut(challenge, ".")
+	if !found {
+		return ChallengeClaims{}, fmt.Errorf("invalid challenge format")
+	}
+	payload, err := base64Decode(encodedPayload)
+	if err != nil || len(payload) != challengePayloadSize {
+		return ChallengeClaims{}, fmt.Errorf("invalid challenge payload")
+	}
+	signature, err := base64Decode(encodedSignature)
+	if err != nil || !hmac.Equal(signature, signChallenge(payload)) {
+		return ChallengeClaims{}, fmt.Errorf("invalid challenge signature")
+	}
+
+	claims := ChallengeClaims{
+		Expires: int64(binary.LittleEndian.Uint64(payload[16:24])),
+		Bits:    int(payload[24]),
+	}
+	if now >= claims.Expires {
+		return ChallengeClaims{}, fmt.Errorf("challenge expired")
+	}
+	if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) < claims.Bits {
+		return ChallengeClaims{}, fmt.Errorf("challenge not solved")
+	}
+	return claims, nil
+}
+
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	n := 0
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// Solved challenges until they expire, so each one registers only one user
+type UsedChallenges struct {
+	mutex      sync.Mutex
+	challenges map[string]int64 // challenge -> expiry
+}
+
+var usedChallenges = UsedChallenges{
+	challenges: make(map[string]int64),
+}
+
+// Returns false if the challenge was used already
+func (used *UsedChallenges) use(challenge string, expires int64, now int64) bool {
+	used.mutex.Lock()
+	defer used.mutex.Unlock()
+
+	for c, exp := range used.challenges {
+		if now >= exp {
+			delete(used.challenges, c)
+		}
+	}
+	if _, found := used.challenges[challenge]; found {
+		return false
+	}
+	used.challenges[challenge] = expires
+	return true
+}
+
+// Checks the proof of work of an open registration and uses up the challenge
+func checkProofOfWork(challenge string, nonce string) *RestAPIError {
+	now := monotonicSeconds()
+	claims, err := verifyChallenge(challenge, nonce, now)
+	if err != nil {
+		return NewError(err.Error(), http.StatusForbidden)
+	}
+	if !usedChallenges.use(challenge, claims.Expires, now) {
+		return NewError("challenge already used", http.StatusForbidden)
+	}
+	return nil
+}
+
+type RegChallengeResponse struct {
+	Challenge string `json:"challenge"`
+	Bits      int    `json:"bits"`
+	ExpireSec int64  `json:"expire_sec"`
+}
+
+func regChallenge_http_handler(w http.ResponseWriter, r *http.Request) {
+	w, done := meterRequest(w, "regChallenge")
+	defer done()
+	startRequest(w, r, "regChallenge")
+
+	restAPIerr := limitIp(r, "regChallenge")
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
+	reg := config.Registration
+	if reg.Mode != REG_MODE_OPEN {
+		restAPIerror(w, NewError("regChallenge: registration is not open", http.StatusForbidden))
+		return
+	}
+
+	challenge, err := makeChallenge(reg.Bits, monotonicSeconds()+reg.ChallengeSec)
+	if err != nil {
+		msg := "regChallenge: error generating challenge: " + err.Error()
+		restAPIerror(w, NewError(msg, http.StatusInternalServerError))
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(RegChallengeResponse{
+		Challenge: challenge,
+		Bits:      reg.Bits,
+		ExpireSec: reg.ChallengeSec,
+	})
+	if err != nil {
+		msg := "regChallenge: error encoding response: " + err.Error()
+		restAPIerror(w, NewError(msg, http.StatusInternalServerError))
+	}
+}
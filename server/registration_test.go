@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Finds a nonce whose hash has at least `bits` leading zero bits, or, if `solve` is false,
+// one that has fewer
+func findNonce(t *testing.T, challenge string, bits int, solve bool) string {
+	t.Helper()
+	for i := 0; i < 1<<24; i++ {
+		nonce := strconv.Itoa(i)
+		zeros := leadingZeroBits(sha256.Sum256([]byte(challenge + ":" + nonce)))
+		if (zeros >= bits) == solve {
+			return nonce
+		}
+	}
+	t.Fatal("no nonce found")
+	return ""
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	var hash [sha256.Size]byte
+	if n := leadingZeroBits(hash); n != 256 {
+		t.Errorf("all zero: %d", n)
+	}
+	hash[1] = 0x10
+	if n := leadingZeroBits(hash); n != 11 {
+		t.Errorf("0x0010...: %d", n)
+	}
+}
+
+func TestChallengeDifficulty(t *testing.T) {
+	now := int64(100 * DAY)
+	for _, bits := range []int{0, 4, 12} {
+		challenge, err := makeChallenge(bits, now+MINUTE)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		claims, err := verifyChallenge(challenge, findNonce(t, challenge, bits, true), now)
+		if err != nil {
+			t.Errorf("%d bits: solution rejected: %s", bits, err)
+		}
+		if claims.Bits != bits || claims.Expires != now+MINUTE {
+			t.Errorf("%d bits: claims = %+v", bits, claims)
+		}
+		if bits > 0 {
+			if _, err := verifyChallenge(challenge, findNonce(t, challenge, bits, false), now); err == nil {
+				t.Errorf("%d bits: wrong solution accepted", bits)
+			}
+		}
+	}
+}
+
+func TestChallengeTampered(t *testing.T) {
+	now := int64(100 * DAY)
+	challenge, err := makeChallenge(20, now+MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, _ := strings.Cut(challenge, ".")
+
+	// The difficulty is part of the signed payload, so it can't be lowered
+	raw, err := base64Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] = 0
+	easier := base64Encode(raw) + "." + signature
+	if _, err := verifyChallenge(easier, "0", now); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("challenge with lowered difficulty: %v", err)
+	}
+
+	for _, invalid := range []string{payload, payload + ".", "." + signature, "x.y"} {
+		if _, err := verifyChallenge(invalid, "0", now); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+}
+
+func TestChallengeExpiry(t *testing.T) {
+	now := int64(100 * DAY)
+	challenge, err := makeChallenge(0, now+MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := verifyChallenge(challenge, "0", now+MINUTE-1); err != nil {
+		t.Errorf("before expiry: %s", err)
+	}
+	if _, err := verifyChallenge(challenge, "0", now+MINUTE); err == nil {
+		t.Error("expired challenge accepted")
+	}
+}
+
+func TestChallengeReplay(t *testing.T) {
+	challenge, err := makeChallenge(4, monotonicSeconds()+MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := findNonce(t, challenge, 4, true)
+
+	if restAPIerr := checkProofOfWork(challenge, nonce); restAPIerr != nil {
+		t.Fatal(restAPIerr)
+	}
+	if restAPIerr := checkProofOfWork(challenge, nonce); restAPIerr == nil {
+		t.Error("challenge used again")
+	}
+}
+
+func TestUsedChallengesExpire(t *testing.T) {
+	used := UsedChallenges{challenges: make(map[string]int64)}
+	now := int64(100 * DAY)
+
+	if !used.use("a", now+MINUTE, now) {
+		t.Fatal("first use rejected")
+	}
+	if used.use("a", now+MINUTE, now+1) {
+		t.Error("second use accepted")
+	}
+
+	// Dropped once the challenge itself has expired, as it can't be verified anymore
+	used.use("b", now+2*MINUTE, now+MINUTE)
+	if _, found := used.challenges["a"]; found {
+		t.Error("expired challenge kept")
+	}
+	if _, found := used.challenges["b"]; !found {
+		t.Error("challenge dropped before it expired")
+	}
+}
+
+func regTestHttp(req RegRequest) int {
+	body, _ := json.Marshal(req)
+	w := httptest.NewRecorder()
+	reg_http_handler(w, httptest.NewRequest(http.MethodPost, "/api/reg", bytes.NewReader(body)))
+	return w.Code
+}
+
+func TestRegistrationModes(t *testing.T) {
+	setupTest(t)
+	config.Registration = &RegistrationConfig{Mode: REG_MODE_INVITE, Bits: 4, ChallengeSec: MINUTE}
+	// All requests come from the same IP
+	config.RateLimits = &RateLimitConfig{}
+	now := monotonicSeconds()
+	challenge, err := makeChallenge(4, now+MINUTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	solved := RegRequest{Username: "alice", Passwd: hash("p"), Challenge: challenge, Nonce: findNonce(t, challenge, 4, true)}
+
+	if code := regTestHttp(solved); code != http.StatusForbidden {
+		t.Errorf("invite mode without invitation: %d", code)
+	}
+	if code := regTestHttp(RegRequest{Username: "a", Passwd: hash("p")}); code != http.StatusBadRequest {
+		t.Errorf("short username: %d", code)
+	}
+
+	config.Registration.Mode = REG_MODE_CLOSED
+	invitation := addTestInvitation(t, 0, 1, 0, now)
+	if code := regTestHttp(RegRequest{Invitation: invitation, Username: "alice", Passwd: hash("p")}); code != http.StatusForbidden {
+		t.Errorf("closed with invitation: %d", code)
+	}
+
+	config.Registration.Mode = REG_MODE_OPEN
+	if code := regTestHttp(solved); code != http.StatusOK {
+		t.Fatalf("open with solved challenge: %d", code)
+	}
+	// Taken usernames don't use up the challenge or the invitation
+	if code := regTestHttp(RegRequest{Invitation: invitation, Username: "alice", Passwd: hash("p")}); code != http.StatusConflict {
+		t.Errorf("taken username: %d", code)
+	}
+	solved.Username = "bob"
+	if code := regTestHttp(solved); code != http.StatusForbidden {
+		t.Errorf("challenge used twice: %d", code)
+	}
+	if code := regTestHttp(RegRequest{Invitation: invitation, Username: "carol", Passwd: hash("p")}); code != http.StatusOK {
+		t.Errorf("open with invitation: %d", code)
+	}
+}
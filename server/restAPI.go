@@ -3,12 +3,17 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 type RestAPIError struct {
 	Err  string
 	Code int
+
+	// Sent as `Retry-After` if set
+	RetryAfterSec int64
 }
 
 func (e *RestAPIError) Error() string {
@@ -22,10 +27,55 @@ func NewError(err string, code int) *RestAPIError {
 func restAPIerror(w http.ResponseWriter, err *RestAPIError) {
 	msg := err.Error()
 	code := err.Code
-	Log.e(msg)
+	log := Log.request(w.Header().Get(REQUEST_ID_HEADER))
+	if code >= http.StatusInternalServerError {
+		log.e(msg)
+	} else {
+		log.w(msg)
+	}
+	if err.RetryAfterSec > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(err.RetryAfterSec, 10))
+	}
 	http.Error(w, msg, code)
 }
 
+// For requests to a user whose `user_handler()` has stopped in the meantime,
+// because the user was deleted or evicted, or the server is shutting down.
+// The client can retry.
+func errUserStopped(handlerName string) *RestAPIError {
+	return NewError(handlerName+": user stopped", http.StatusServiceUnavailable)
+}
+
+// Finds the user identified by the bearer in the `Authorization` header.
+func authorize(r *http.Request, handlerName string) (*User, BearerClaims, *RestAPIError) {
+	authHeader := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if authHeader == token {
+		msg := handlerName + ": authorization: bearer not found"
+		return nil, BearerClaims{}, NewError(msg, http.StatusUnauthorized)
+	}
+	bearer := Bearer(token)
+
+	claims, err := bearer.verify()
+	if err != nil {
+		msg := handlerName + ": authorization: " + err.Error()
+		return nil, BearerClaims{}, NewError(msg, http.StatusUnauthorized)
+	}
+
+	user := usersList.Load().userById(claims.EncryptedID.decrypt())
+	if user == nil {
+		msg := handlerName + ": authorization: invalid bearer"
+		return nil, BearerClaims{}, NewError(msg, http.StatusUnauthorized)
+	}
+
+	if claims.Issued < atomic.LoadInt64(&user.BearersValidAfter) {
+		msg := handlerName + ": authorization: bearer invalidated"
+		return nil, BearerClaims{}, NewError(msg, http.StatusUnauthorized)
+	}
+
+	return user, claims, nil
+}
+
 func restAPI_handler[
 	Request any,
 	Response any,
@@ -35,44 +85,40 @@ func restAPI_handler[
 
 	handlerName string,
 	maxRequestSize int64,
-	handler func(*User, Request) (Response, *RestAPIError),
+	handler func(user *User, device uint64, req Request) (Response, *RestAPIError),
 ) {
-	Log.d("=================================================================================")
-	Log.d("%d %s", monotonicSeconds(), handlerName)
+	w, done := meterRequest(w, handlerName)
+	defer done()
+	startRequest(w, r, handlerName)
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 
-	authHeader := r.Header.Get("Authorization")
-	token := strings.TrimPrefix(authHeader, "Bearer ")
-	if authHeader == token {
-		msg := handlerName + ": authorization: bearer not found"
-		restAPIerror(w, NewError(msg, http.StatusUnauthorized))
-		return
-	}
-	bearer := Bearer(token)
-
-	userId, err := bearer.toUserID()
-	if err != nil {
-		msg := handlerName + ": authorization: cannot parse bearer: " + err.Error()
-		restAPIerror(w, NewError(msg, http.StatusUnauthorized))
+	restAPIerr := limitIp(r, handlerName)
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
 		return
 	}
 
-	user := usersList.Load().userById(userId)
-	if user == nil || bearer == "" || user.Bearer != bearer {
-		msg := handlerName + ": authorization: invalid bearer"
-		restAPIerror(w, NewError(msg, http.StatusUnauthorized))
+	user, claims, restAPIerr := authorize(r, handlerName)
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
 		return
 	}
 
 	var req Request
-	err = json.NewDecoder(r.Body).Decode(&req)
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		msg := handlerName + ": decoding request: " + err.Error()
 		restAPIerror(w, NewError(msg, http.StatusBadRequest))
 		return
 	}
 
-	resp, restAPIerr := handler(user, req)
+	restAPIerr = limitBearer(claims, handlerName, requestCost(req))
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
+	resp, restAPIerr := handler(user, claims.Device, req)
 	if restAPIerr != nil {
 		restAPIerror(w, restAPIerr)
 		return
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// Fails to save users, e.g., because the disk is full
+type failingStorage struct {
+	Storage
+}
+
+func (s failingStorage) saveUser(user *User) error {
+	return errors.New("disk full")
+}
+
+func TestAddPrekeysSaveError(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	working := storage
+	storage = failingStorage{working}
+
+	_, restAPIerr := addPrekeys_restAPI_handler(alice, TEST_DEVICE, AddPrekeysRequest{Prekeys: []string{"k1", "k2"}})
+	if restAPIerr == nil {
+		t.Fatal("save error not reported")
+	}
+	storage = working
+
+	// Not added, so the client uploads them again
+	respChan := make(chan FetchPrekeyResponse)
+	alice.FetchPrekey <- FetchPrekeyRequest{Response: respChan}
+	if resp := <-respChan; resp.Prekey != "" {
+		t.Errorf("prekey %q kept", resp.Prekey)
+	}
+}
+
+func TestLoginSaveError(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	putTestMessage(t, alice, "bob", "a")
+	storage = failingStorage{storage}
+
+	respChan := make(chan LoginResponse)
+	alice.Login <- LoginRequest{SigningKey: "new", Response: respChan}
+	if resp := <-respChan; resp.Err == nil {
+		t.Fatal("save error not reported")
+	}
+
+	// The device wasn't added, and the inbox of the other one is untouched
+	if len(alice.Devices) != 1 {
+		t.Errorf("%d devices", len(alice.Devices))
+	}
+	var none uint64
+	if got := messagePayloads(recvTest(t, alice, &none).Items); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("inbox: %v", got)
+	}
+}
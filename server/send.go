@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"sync"
+	"time"
 )
 
 func send_http_handler(w http.ResponseWriter, r *http.Request) {
@@ -9,69 +12,256 @@ func send_http_handler(w http.ResponseWriter, r *http.Request) {
 }
 
 type SendItem struct {
-	To   EncryptedID `json:"to"`
-	Type string      `json:"type"`
-	Msg  string      `json:"msg"`
+	To EncryptedID `json:"to"`
+
+	// Optional. If set, the message is delivered only to this device of the recipient.
+	// Otherwise, it is delivered to all of the recipient's devices.
+	Device *uint64 `json:"device"`
+
+	Type string `json:"type"`
+	Msg  string `json:"msg"`
 }
 
 type SendRequest struct {
 	Items []SendItem `json:"items"`
 }
 
-type SendResponse struct {
-	NeedPrekeys bool `json:"needPrekeys"`
+// Each item is written to disk, so each one counts against the rate limit
+func (req SendRequest) rateLimitCost() int {
+	return len(req.Items)
 }
 
-func send_restAPI_handler(user *User, req SendRequest) (SendResponse, *RestAPIError) {
-	respChan := make(chan PutResponse)
-	defer close(respChan)
+// Result of one `SendItem`. For recipients with several devices, the item counts as
+// delivered if at least one device got it.
+const SEND_DELIVERED = "delivered"
+
+// The recipient's account doesn't exist (anymore). The app can stop sending to them.
+const SEND_UNKNOWN_RECIPIENT = "unknown_recipient"
+
+// The keys the message was encrypted for are gone: the recipient reset their keys,
+// or the device the item was for was removed. The app should fetch the recipient's
+// keys again with `userInfo`.
+const SEND_KEY_RESET = "key_reset"
+
+// The recipient's inbox is full. Try again later.
+const SEND_QUOTA_EXCEEDED = "quota_exceeded"
 
-	var err *RestAPIError = nil
+// Something went wrong on the server. Try again later.
+const SEND_ERROR = "error"
 
+type SendItemResult struct {
+	Status string `json:"status"`
+}
+
+type SendResponse struct {
+	NeedPrekeys bool `json:"needPrekeys"`
+
+	// In the order of `SendRequest.Items`
+	Items []SendItemResult `json:"items"`
+}
+
+// Failed items don't fail the request. Their status says what happened.
+//
+// The items are grouped by recipient, and each group is delivered with one `PutRequest`,
+// so each inbox is written once. Up to `SEND_MAX_WORKERS` recipients are served at the same
+// time, so a busy recipient doesn't hold up the others. Items for recipients that don't take
+// their request within `SEND_TIMEOUT_SEC` get `SEND_ERROR`.
+func send_restAPI_handler(user *User, device uint64, req SendRequest) (SendResponse, *RestAPIError) {
 	Log.d("msg count = %d", len(req.Items))
 	now := monotonicSeconds()
 	from := user.EncryptedID.toString()
-	users := usersList.Load()
-	for _, item := range req.Items {
-		toUser := users.userById(item.To.decrypt())
-		if toUser == nil {
-			//err = NewError("User not found", http.StatusNotFound)
-			continue
-		}
 
-		toUser.Put <- PutRequest{
+	batches := make(map[UserID]*SendBatch)
+	order := make([]*SendBatch, 0)
+	for i, item := range req.Items {
+		to := item.To.decrypt()
+		batch, found := batches[to]
+		if !found {
+			batch = &SendBatch{To: to}
+			batches[to] = batch
+			order = append(order, batch)
+		}
+		batch.Index = append(batch.Index, i)
+		batch.Items = append(batch.Items, PutItem{
 			Message: Message{
-				Time: now,
-				From: from,
-				Type: item.Type,
-				Msg:  item.Msg,
+				Time:       now,
+				From:       from,
+				FromDevice: device,
+				Type:       item.Type,
+				Msg:        item.Msg,
 			},
-			Response: respChan,
-		}
-		resp := <-respChan
+			Device: item.Device,
+		})
+	}
 
-		if resp.Err != nil {
-			err = resp.Err
-		}
+	ctx, cancel := context.WithTimeout(serverCtx, time.Duration(SEND_TIMEOUT_SEC)*time.Second)
+	defer cancel()
+
+	users := usersList.Load()
+	results := make([]SendItemResult, len(req.Items))
+	jobs := make(chan *SendBatch)
+	var workers sync.WaitGroup
+	for range min(len(order), SEND_MAX_WORKERS) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for batch := range jobs {
+				for j, status := range batch.send(ctx, users) {
+					results[batch.Index[j]].Status = status
+				}
+			}
+		}()
+	}
+	for _, batch := range order {
+		jobs <- batch
+	}
+	close(jobs)
+	workers.Wait()
+
+	needPrekeys, needPrekeysErr := needPrekeys(user, device)
+	if needPrekeysErr != nil {
+		return SendResponse{}, needPrekeysErr
 	}
 
 	return SendResponse{
-		NeedPrekeys: user.needPrekeys(),
-	}, err
+		NeedPrekeys: needPrekeys,
+		Items:       results,
+	}, nil
 }
 
-type PutRequest struct {
+// Items of one `send` request with the same recipient
+type SendBatch struct {
+	To    UserID
+	Items []PutItem
+	Index []int // of each item in `SendRequest.Items`
+}
+
+func (batch *SendBatch) statuses(status string) []string {
+	statuses := make([]string, len(batch.Items))
+	for i := range statuses {
+		statuses[i] = status
+	}
+	return statuses
+}
+
+// Delivers the items to the recipient and returns the status of each item
+func (batch *SendBatch) send(ctx context.Context, users *Users) []string {
+	if !users.hasId(batch.To.Id) {
+		return batch.statuses(SEND_UNKNOWN_RECIPIENT)
+	}
+	toUser := getUser(batch.To.Id)
+	if toUser == nil {
+		// The ID is in the index, so the user exists, but cannot be loaded right now
+		return batch.statuses(SEND_ERROR)
+	}
+	if toUser.Sn != batch.To.Sn {
+		return batch.statuses(SEND_KEY_RESET)
+	}
+
+	respChan := make(chan PutResponse)
+	defer close(respChan)
+
+	put := PutRequest{
+		Items:    batch.Items,
+		Response: respChan,
+	}
+	resp, ok := callUserHandlerContext(ctx, toUser, toUser.Put, put, respChan)
+	if !ok {
+		// The recipient deleted their account in the meantime, the deadline passed,
+		// or the server is shutting down
+		if !usersList.Load().hasId(batch.To.Id) {
+			return batch.statuses(SEND_UNKNOWN_RECIPIENT)
+		}
+		return batch.statuses(SEND_ERROR)
+	}
+
+	statuses := make([]string, len(resp.Results))
+	for i, result := range resp.Results {
+		statuses[i] = result.status()
+	}
+	return statuses
+}
+
+type PutItem struct {
 	Message Message
 
+	// nil to deliver the message to all devices
+	Device *uint64
+}
+
+type PutRequest struct {
+	Items []PutItem
+
 	Response chan<- PutResponse
 }
 
 type PutResponse struct {
+	// In the order of `PutRequest.Items`
+	Results []PutResult
+}
+
+type PutResult struct {
 	Err *RestAPIError
+
+	// Number of devices that got the message, and that didn't because of their quota
+	Delivered     int
+	QuotaExceeded int
+}
+
+func (result *PutResult) status() string {
+	switch {
+	case result.Delivered > 0:
+		return SEND_DELIVERED
+	case result.QuotaExceeded > 0:
+		return SEND_QUOTA_EXCEEDED
+	case result.Err != nil:
+		// Storage errors contain paths of user data, so the details are only logged at debug level
+		Log.e("send: storing a message failed with status %d", result.Err.Code)
+		Log.d("send: %s", result.Err.Error())
+		return SEND_ERROR
+	default:
+		// No device to deliver to
+		return SEND_KEY_RESET
+	}
 }
 
 func put_synchronized_handler(user *User, req PutRequest) PutResponse {
+	results := make([]PutResult, len(req.Items))
+	for _, device := range user.Devices {
+		// Each inbox assigns its own `Seq`, so every device gets its own copies
+		msgs := make([]Message, 0, len(req.Items))
+		index := make([]int, 0, len(req.Items))
+		for i, item := range req.Items {
+			if item.Device != nil && *item.Device != device.Id {
+				continue
+			}
+			msgs = append(msgs, item.Message)
+			index = append(index, i)
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+
+		delivered := false
+		for j, err := range device.Inbox.addMessages(msgs) {
+			result := &results[index[j]]
+			switch {
+			case err == errInboxQuotaExceeded:
+				result.QuotaExceeded++
+			case err != nil:
+				result.Err = err
+			default:
+				result.Delivered++
+				delivered = true
+				metrics.InboxMessagesWritten.inc()
+				device.pushToSubscriber(msgs[j])
+			}
+		}
+		if delivered {
+			device.wakeRecvWaiter()
+		}
+	}
 	return PutResponse{
-		Err: user.Inbox.addMessage(&req.Message),
+		Results: results,
 	}
 }
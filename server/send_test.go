@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sendTestStatuses(t *testing.T, from *User, items ...SendItem) []string {
+	t.Helper()
+	resp, err := send_restAPI_handler(from, TEST_DEVICE, SendRequest{Items: items})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make([]string, 0, len(resp.Items))
+	for _, item := range resp.Items {
+		statuses = append(statuses, item.Status)
+	}
+	return statuses
+}
+
+func TestSendStatuses(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bob := addTestUser(t, "bob")
+	removed := uint64(99)
+
+	statuses := sendTestStatuses(t, alice,
+		SendItem{To: bob.EncryptedID, Type: "msg", Msg: "a"},
+		SendItem{To: UserID{Id: bob.Id, Sn: bob.Sn + 1}.encrypt(), Type: "msg", Msg: "b"},
+		SendItem{To: bob.EncryptedID, Device: &removed, Type: "msg", Msg: "c"},
+		SendItem{To: UserID{Id: bob.Id + 1, Sn: bob.Sn}.encrypt(), Type: "msg", Msg: "d"},
+	)
+	want := []string{SEND_DELIVERED, SEND_KEY_RESET, SEND_KEY_RESET, SEND_UNKNOWN_RECIPIENT}
+	if !slices.Equal(statuses, want) {
+		t.Errorf("statuses %v, want %v", statuses, want)
+	}
+	if got := messagePayloads(recvTest(t, bob, nil).Items); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("bob got %v", got)
+	}
+}
+
+func TestSendToDeletedUser(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bob := addTestUser(t, "bob")
+	_, err := deleteAccount_restAPI_handler(bob, TEST_DEVICE, DeleteAccountRequest{Passwd: hash("passwd of bob")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := sendTestStatuses(t, alice, SendItem{To: bob.EncryptedID, Type: "msg", Msg: "a"})
+	if !slices.Equal(statuses, []string{SEND_UNKNOWN_RECIPIENT}) {
+		t.Errorf("statuses %v", statuses)
+	}
+}
+
+func TestSendBatchesPerRecipient(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bob := addTestUser(t, "bob")
+	carol := addTestUser(t, "carol")
+
+	statuses := sendTestStatuses(t, alice,
+		SendItem{To: bob.EncryptedID, Type: "msg", Msg: "b1"},
+		SendItem{To: carol.EncryptedID, Type: "msg", Msg: "c1"},
+		SendItem{To: bob.EncryptedID, Type: "msg", Msg: "b2"},
+	)
+	if !slices.Equal(statuses, []string{SEND_DELIVERED, SEND_DELIVERED, SEND_DELIVERED}) {
+		t.Errorf("statuses %v", statuses)
+	}
+	// In the order they were sent
+	if got := messagePayloads(recvTest(t, bob, nil).Items); !slices.Equal(got, []string{"b1", "b2"}) {
+		t.Errorf("bob got %v", got)
+	}
+	if got := messagePayloads(recvTest(t, carol, nil).Items); !slices.Equal(got, []string{"c1"}) {
+		t.Errorf("carol got %v", got)
+	}
+}
+
+func TestSendBusyRecipient(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bob := addTestUser(t, "bob")
+	carol := addTestUser(t, "carol")
+
+	oldCtx, oldCancel := serverCtx, cancelServerCtx
+	serverCtx, cancelServerCtx = context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		serverCtx, cancelServerCtx = oldCtx, oldCancel
+	})
+
+	// Carol's `user_handler()` is stuck until the response is read
+	stuck := make(chan PutResponse)
+	carol.Put <- PutRequest{Response: stuck}
+	defer func() { <-stuck }()
+
+	bobRecv := startTestRecv(bob, 10)
+	// Let it park
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan []string, 1)
+	go func() {
+		resp, _ := send_restAPI_handler(alice, TEST_DEVICE, SendRequest{Items: []SendItem{
+			{To: carol.EncryptedID, Type: "msg", Msg: "c"},
+			{To: bob.EncryptedID, Type: "msg", Msg: "b"},
+		}})
+		statuses := make([]string, 0)
+		for _, item := range resp.Items {
+			statuses = append(statuses, item.Status)
+		}
+		done <- statuses
+	}()
+
+	// Bob doesn't wait for carol
+	if got := messagePayloads(waitTestRecv(t, bobRecv).resp.Items); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("bob got %v", got)
+	}
+
+	cancelServerCtx()
+	select {
+	case statuses := <-done:
+		if !slices.Equal(statuses, []string{SEND_ERROR, SEND_DELIVERED}) {
+			t.Errorf("statuses %v", statuses)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("send didn't return")
+	}
+}
+
+func TestPutResultErrorLog(t *testing.T) {
+	buf := captureTestLog(t, slog.LevelInfo)
+	result := PutResult{Err: NewError("writing messages: open /srv/loky/users/00000000000000000042/inbox: no space left on device", http.StatusInternalServerError)}
+
+	if status := result.status(); status != SEND_ERROR {
+		t.Errorf("status %q", status)
+	}
+	if strings.Contains(buf.String(), "/srv/loky") {
+		t.Errorf("path logged: %s", buf.String())
+	}
+
+	logLevel.Set(slog.LevelDebug)
+	result.status()
+	if !strings.Contains(buf.String(), "/srv/loky") {
+		t.Errorf("no details at debug level: %s", buf.String())
+	}
+}
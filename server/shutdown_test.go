@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStopUserHandlers(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	waiter := startTestRecv(alice, 10)
+	// Let it park
+	time.Sleep(100 * time.Millisecond)
+	sub := subscribeTestStream(t, alice).Subscriber
+
+	stopUserHandlers()
+
+	waitTestRecv(t, waiter)
+	select {
+	case <-sub.Done:
+	case <-time.After(5 * time.Second):
+		t.Error("stream not closed")
+	}
+	_, err := recv_restAPI_handler(context.Background(), alice, TEST_DEVICE, RecvRequest{})
+	if err == nil || err.Code != http.StatusServiceUnavailable {
+		t.Errorf("recv after stop: %v", err)
+	}
+	// Stopping again doesn't block
+	alice.stop()
+}
+
+func TestShutdownReleasesRecv(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bearer := loginTestUser(t, alice)
+
+	oldCtx, oldCancel := serverCtx, cancelServerCtx
+	serverCtx, cancelServerCtx = context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		serverCtx, cancelServerCtx = oldCtx, oldCancel
+	})
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(recv_http_handler))
+	server.Config.BaseContext = func(net.Listener) context.Context { return serverCtx }
+	server.Start()
+	t.Cleanup(server.Close)
+
+	done := make(chan error, 1)
+	go func() {
+		req, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString(`{"wait_sec": 60}`))
+		if err != nil {
+			done <- err
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+string(bearer))
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	// Let the request park
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	shutdown(server.Config, nil)
+	if elapsed := time.Since(start); elapsed > time.Duration(SHUTDOWN_TIMEOUT_SEC)*time.Second/2 {
+		t.Errorf("shutdown took %s", elapsed)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("recv not released")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Data the server changes while it runs, kept in the storage apart from the config.
+// The server never writes the config, so it can be read-only and managed by
+// configuration management.
+//
+// Each change is a transaction, see `Storage.updateState()`.
+type ServerState struct {
+	LastId          uint64           `json:"last_id"`
+	Invitations     []Invitation     `json:"invitations"`
+	UsedInvitations []UsedInvitation `json:"used_invitations"`
+}
+
+var errStateNotInitialized = errors.New("server state not initialized")
+
+// Creates the state on the first start. Configs written before the state was separated
+// carry `last_id` and the invitations, they are moved over.
+func initState(cfg *Config) error {
+	_, err := storage.loadState()
+	if err == nil {
+		if cfg.hasLegacyState() {
+			Log.w("last_id, invitations and used_invitations in the config are ignored, they are kept in the storage now")
+		}
+		return nil
+	}
+	if err != errStateNotInitialized {
+		return err
+	}
+
+	state := ServerState{
+		LastId:          cfg.LegacyLastId,
+		Invitations:     cfg.LegacyInvitations,
+		UsedInvitations: cfg.LegacyUsedInvitations,
+	}
+	if !cfg.hasLegacyState() {
+		// Random, so user IDs don't tell how many users there are
+		idBytes, err := randBytes(8)
+		if err != nil {
+			return err
+		}
+		state.LastId = binary.LittleEndian.Uint64(idBytes)
+	}
+	if state.Invitations == nil {
+		state.Invitations = []Invitation{}
+	}
+	if state.UsedInvitations == nil {
+		state.UsedInvitations = []UsedInvitation{}
+	}
+	err = storage.initState(&state)
+	if err != nil {
+		return err
+	}
+
+	if cfg.hasLegacyState() {
+		Log.i("Moved last_id and invitations from the config to the storage")
+		cfg.LegacyLastId = 0
+		cfg.LegacyInvitations = nil
+		cfg.LegacyUsedInvitations = nil
+		cfg.trySave()
+	}
+	return nil
+}
+
+func genUserId() (UserID, error) {
+	var id uint64
+	err := storage.updateState(func(state *ServerState) error {
+		state.LastId++
+		id = state.LastId
+		return nil
+	})
+	if err != nil {
+		return UserID{}, fmt.Errorf("error saving state: %s", err)
+	}
+
+	snBytes, err := randBytes(8)
+	if err != nil {
+		return UserID{}, fmt.Errorf("error generating sn: %s", err)
+	}
+	sn := binary.LittleEndian.Uint64(snBytes)
+
+	return UserID{
+		Id: id,
+		Sn: sn,
+	}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// Persistent state of the server: the `ServerState`, user records including
+// their prekeys, inboxes and revoked bearers. The config is not part of it,
+// it's always `CONFIG_FILE` in the app directory.
+//
+// Storage methods can be called from any goroutine. However, a user's record and inbox
+// are only ever accessed by the user's `user_handler()` (or before it is started).
+type Storage interface {
+	// Returns `errStateNotInitialized` if `initState()` wasn't called yet
+	loadState() (ServerState, error)
+	initState(state *ServerState) error
+
+	// Runs `fn` on the current state and saves the result in one transaction.
+	// Updates are serialized. If `fn` returns an error, nothing is saved and the error is returned.
+	updateState(fn func(state *ServerState) error) error
+
+	// Returns the username -> user ID index of all users
+	loadUsernames() (map[string]uint64, error)
+
+	// Returns the user record. Only the persistent fields are filled in.
+	// Returns `errUserNotFound` if there is no such user.
+	loadUser(id uint64) (*User, error)
+
+	// Creates or updates the user record
+	saveUser(user *User) error
+
+	// Removes the user record and the inboxes of all devices
+	deleteUser(user *User) error
+
+	// Opens the inbox of the user's device, creating it if it doesn't exist yet.
+	// The inbox of `LEGACY_DEVICE_ID` takes over the user's inbox from before multi-device support.
+	openInbox(user *User, device uint64) (Inbox, error)
+
+	// Removes the inbox of a device that was removed from the user
+	deleteInbox(user *User, device uint64) error
+
+	// Reads the inbox of the user's device without changing anything: nothing is migrated,
+	// cleaned up or repaired, unlike `openInbox()`. Safe to call while the user is loaded.
+	// An inbox that doesn't exist yet is empty.
+	inspectInbox(user *User, device uint64, now int64) (InboxStats, error)
+
+	loadRevokedBearers() (RevokedBearers, error)
+	saveRevokedBearers(revoked RevokedBearers) error
+
+	close() error
+}
+
+var storage Storage
+
+var errUserNotFound = errors.New("user not found")
+
+func openStorage(kind string, dir string) (Storage, error) {
+	switch kind {
+	case "fs":
+		return newFsStorage(dir)
+	case "bolt":
+		return newBoltStorage(filepath.Join(dir, "loky.db"))
+	case "memory":
+		return newMemStorage()
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", kind)
+	}
+}
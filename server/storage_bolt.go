@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Stores everything in a single bbolt database file. Unlike `FsStorage`, it doesn't need
+// a directory per user and a file per inbox part, so it scales to many users.
+//
+// Buckets:
+//
+//	config:  "state" -> server state JSON
+//	users:   user ID -> user JSON
+//	usernames: username -> user ID
+//	inboxes: user ID -> bucket
+//	             "devices" -> bucket, device ID -> bucket
+//	                 "acked"    -> last acknowledged seq
+//	                 "next_seq" -> seq of the next message
+//	                 "messages" -> bucket, seq -> record (see `encodeRecord()`)
+//	revoked_bearers: token ID -> expiry
+//
+// IDs, sequence numbers and times are stored as big-endian uint64, so keys are sorted numerically.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+var boltConfigBucket = []byte("config")
+var boltUsersBucket = []byte("users")
+var boltUsernamesBucket = []byte("usernames")
+var boltInboxesBucket = []byte("inboxes")
+var boltRevokedBearersBucket = []byte("revoked_bearers")
+var boltStateKey = []byte("state")
+var boltAckedKey = []byte("acked")
+var boltNextSeqKey = []byte("next_seq")
+var boltMessagesBucket = []byte("messages")
+var boltDevicesBucket = []byte("devices")
+
+func boltKey(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+func boltUint64(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func newBoltStorage(file string) (*BoltStorage, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %s", file, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		buckets := [][]byte{boltConfigBucket, boltUsersBucket, boltUsernamesBucket, boltInboxesBucket, boltRevokedBearersBucket}
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error initializing %s: %s", file, err)
+	}
+
+	return &BoltStorage{db: db}, nil
+}
+
+func boltLoadState(tx *bolt.Tx) (ServerState, error) {
+	bytes := tx.Bucket(boltConfigBucket).Get(boltStateKey)
+	if bytes == nil {
+		return ServerState{}, errStateNotInitialized
+	}
+	state := ServerState{}
+	err := json.Unmarshal(bytes, &state)
+	if err != nil {
+		return ServerState{}, fmt.Errorf("error parsing state: %s", err)
+	}
+	return state, nil
+}
+
+func boltSaveState(tx *bolt.Tx, state *ServerState) error {
+	jsonData, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltConfigBucket).Put(boltStateKey, jsonData)
+}
+
+func (s *BoltStorage) loadState() (ServerState, error) {
+	var state ServerState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		state, err = boltLoadState(tx)
+		return err
+	})
+	return state, err
+}
+
+func (s *BoltStorage) initState(state *ServerState) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltSaveState(tx, state)
+	})
+}
+
+// Bolt allows one read-write transaction at a time, so updates are serialized
+func (s *BoltStorage) updateState(fn func(state *ServerState) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		state, err := boltLoadState(tx)
+		if err != nil {
+			return err
+		}
+		err = fn(&state)
+		if err != nil {
+			return err
+		}
+		return boltSaveState(tx, &state)
+	})
+}
+
+func (s *BoltStorage) loadUsernames() (map[string]uint64, error) {
+	usernames := make(map[string]uint64)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsernamesBucket).ForEach(func(k, v []byte) error {
+			usernames[string(k)] = boltUint64(v)
+			return nil
+		})
+	})
+	return usernames, err
+}
+
+func (s *BoltStorage) loadUser(id uint64) (*User, error) {
+	var user *User
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltUsersBucket).Get(boltKey(id))
+		if data == nil {
+			return errUserNotFound
+		}
+		user = &User{}
+		return json.Unmarshal(data, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.Id = id
+	return user, nil
+}
+
+func (s *BoltStorage) saveUser(user *User) error {
+	jsonData, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltUsersBucket).Put(boltKey(user.Id), jsonData)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltUsernamesBucket).Put([]byte(user.Username), boltKey(user.Id))
+	})
+}
+
+func (s *BoltStorage) deleteUser(user *User) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltUsersBucket).Delete(boltKey(user.Id))
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(boltUsernamesBucket).Delete([]byte(user.Username))
+		if err != nil {
+			return err
+		}
+		inboxes := tx.Bucket(boltInboxesBucket)
+		if inboxes.Bucket(boltKey(user.Id)) == nil {
+			return nil
+		}
+		return inboxes.DeleteBucket(boltKey(user.Id))
+	})
+}
+
+func (s *BoltStorage) openInbox(user *User, device uint64) (Inbox, error) {
+	inbox := &BoltInbox{
+		db:        s.db,
+		userKey:   boltKey(user.Id),
+		deviceKey: boltKey(device),
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		userBucket, err := tx.Bucket(boltInboxesBucket).CreateBucketIfNotExists(inbox.userKey)
+		if err != nil {
+			return err
+		}
+		devices, err := userBucket.CreateBucketIfNotExists(boltDevicesBucket)
+		if err != nil {
+			return err
+		}
+		b, err := devices.CreateBucketIfNotExists(inbox.deviceKey)
+		if err != nil {
+			return err
+		}
+		_, err = b.CreateBucketIfNotExists(boltMessagesBucket)
+		if err != nil {
+			return err
+		}
+
+		inbox.Acked = boltUint64(b.Get(boltAckedKey))
+		inbox.NextSeq = max(inbox.Acked+1, boltUint64(b.Get(boltNextSeqKey)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inbox, nil
+}
+
+func (s *BoltStorage) inspectInbox(user *User, device uint64, now int64) (InboxStats, error) {
+	stats := InboxStats{Problems: make([]string, 0)}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		userBucket := tx.Bucket(boltInboxesBucket).Bucket(boltKey(user.Id))
+		if userBucket == nil {
+			return nil
+		}
+		var b *bolt.Bucket
+		if devices := userBucket.Bucket(boltDevicesBucket); devices != nil {
+			b = devices.Bucket(boltKey(device))
+		}
+		if b == nil || b.Bucket(boltMessagesBucket) == nil {
+			return nil
+		}
+
+		acked := boltUint64(b.Get(boltAckedKey))
+		validRange := messageValidRange(now)
+		return b.Bucket(boltMessagesBucket).ForEach(func(k, v []byte) error {
+			msg, err := decodeRecord(v)
+			if err != nil {
+				stats.Problems = append(stats.Problems, fmt.Sprintf("record %d: %s", boltUint64(k), err.Error()))
+				return nil
+			}
+			stats.count(&msg, acked, validRange)
+			return nil
+		})
+	})
+	return stats, err
+}
+
+func (s *BoltStorage) deleteInbox(user *User, device uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		userBucket := tx.Bucket(boltInboxesBucket).Bucket(boltKey(user.Id))
+		if userBucket == nil {
+			return nil
+		}
+		devices := userBucket.Bucket(boltDevicesBucket)
+		if devices == nil || devices.Bucket(boltKey(device)) == nil {
+			return nil
+		}
+		return devices.DeleteBucket(boltKey(device))
+	})
+}
+
+func (s *BoltStorage) loadRevokedBearers() (RevokedBearers, error) {
+	revoked := make(RevokedBearers)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRevokedBearersBucket).ForEach(func(k, v []byte) error {
+			revoked[boltUint64(k)] = int64(boltUint64(v))
+			return nil
+		})
+	})
+	return revoked, err
+}
+
+func (s *BoltStorage) saveRevokedBearers(revoked RevokedBearers) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(boltRevokedBearersBucket)
+		if err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(boltRevokedBearersBucket)
+		if err != nil {
+			return err
+		}
+		for tokenId, expires := range revoked {
+			err = b.Put(boltKey(tokenId), boltKey(uint64(expires)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) close() error {
+	return s.db.Close()
+}
+
+type BoltInbox struct {
+	db        *bolt.DB
+	userKey   []byte
+	deviceKey []byte
+
+	// `Seq` of the next message added to the inbox
+	NextSeq uint64
+
+	// All messages with `Seq <= Acked` were acknowledged by the client
+	Acked uint64
+}
+
+// Runs `fn` in a read-write transaction with the bucket of this inbox
+func (inbox *BoltInbox) update(fn func(b *bolt.Bucket) error) error {
+	return inbox.db.Update(func(tx *bolt.Tx) error {
+		devices := tx.Bucket(boltInboxesBucket).Bucket(inbox.userKey).Bucket(boltDevicesBucket)
+		return fn(devices.Bucket(inbox.deviceKey))
+	})
+}
+
+func (inbox *BoltInbox) addMessages(msgs []Message) *RestAPIError {
+	if len(msgs) == 0 {
+		return nil
+	}
+	err := inbox.update(func(b *bolt.Bucket) error {
+		bucket := b.Bucket(boltMessagesBucket)
+		for i := range msgs {
+			msgs[i].Seq = inbox.NextSeq + uint64(i)
+			err := bucket.Put(boltKey(msgs[i].Seq), encodeRecord(&msgs[i]))
+			if err != nil {
+				return err
+			}
+		}
+		// Expired messages are deleted, so the last message doesn't tell the next seq.
+		// Without it, seqs would be given out again after a reload.
+		return b.Put(boltNextSeqKey, boltKey(inbox.NextSeq+uint64(len(msgs))))
+	})
+	if err != nil {
+		return NewError("writing messages: "+err.Error(), http.StatusInternalServerError)
+	}
+	inbox.NextSeq += uint64(len(msgs))
+	return nil
+}
+
+func (inbox *BoltInbox) getMessages(now int64) ([]Message, *RestAPIError) {
+	messages := make([]Message, 0)
+	validRange := messageValidRange(now)
+	err := inbox.update(func(b *bolt.Bucket) error {
+		bucket := b.Bucket(boltMessagesBucket)
+		expired := make([][]byte, 0)
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			msg, err := decodeRecord(v)
+			if err != nil {
+				Log.e("Skipping invalid inbox record %d: %s", boltUint64(k), err.Error())
+				continue
+			}
+			if !validRange.contains(msg.Time) {
+				expired = append(expired, k)
+				continue
+			}
+			msg.Time = now - msg.Time
+			messages = append(messages, msg)
+		}
+		// Deleting while iterating would confuse the cursor
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, NewError("reading messages: "+err.Error(), http.StatusInternalServerError)
+	}
+	return messages, nil
+}
+
+func (inbox *BoltInbox) ack(seq uint64) *RestAPIError {
+	// The client cannot acknowledge messages it hasn't received yet
+	seq = min(seq, inbox.NextSeq-1)
+	if seq <= inbox.Acked {
+		return nil
+	}
+
+	err := inbox.update(func(b *bolt.Bucket) error {
+		bucket := b.Bucket(boltMessagesBucket)
+		acked := make([][]byte, 0)
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil && boltUint64(k) <= seq; k, _ = c.Next() {
+			acked = append(acked, k)
+		}
+		for _, k := range acked {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return b.Put(boltAckedKey, boltKey(seq))
+	})
+	if err != nil {
+		return NewError("saving ack: "+err.Error(), http.StatusInternalServerError)
+	}
+	inbox.Acked = seq
+	return nil
+}
+
+func (inbox *BoltInbox) clear() {
+	acked := inbox.NextSeq - 1
+	err := inbox.update(func(b *bolt.Bucket) error {
+		if err := b.DeleteBucket(boltMessagesBucket); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucket(boltMessagesBucket); err != nil {
+			return err
+		}
+		return b.Put(boltAckedKey, boltKey(acked))
+	})
+	if err != nil {
+		Log.e("Error clearing inbox: %s", err.Error())
+		return
+	}
+	inbox.Acked = acked
+}
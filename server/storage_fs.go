@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Stores everything as plain files:
+//
+//	state.json
+//	revoked_bearers.json
+//	users/<id>/user.json
+//	users/<id>/devices/<device>/inbox/<part files>
+type FsStorage struct {
+	Dir string
+
+	// Serializes `updateState()`
+	stateMutex sync.Mutex
+}
+
+func newFsStorage(dir string) (*FsStorage, error) {
+	s := &FsStorage{
+		Dir: dir,
+	}
+	err := s.recover()
+	if err != nil {
+		return nil, fmt.Errorf("error recovering unfinished writes: %s", err)
+	}
+	return s, nil
+}
+
+// Cleans up after writes interrupted by a crash. See `recoverTempFile()`.
+func (s *FsStorage) recover() error {
+	patterns := []string{
+		s.stateFile() + TEMP_SUFFIX,
+		s.revokedBearersFile() + TEMP_SUFFIX,
+		filepath.Join(s.usersDir(), "*", "user.json"+TEMP_SUFFIX),
+		filepath.Join(s.usersDir(), "*", "inbox", "*"+TEMP_SUFFIX),
+		filepath.Join(s.usersDir(), "*", "devices", "*", "inbox", "*"+TEMP_SUFFIX),
+	}
+
+	// Finish deletions. See `deleteUser()`.
+	deleted, err := filepath.Glob(filepath.Join(s.usersDir(), "*"+DELETED_SUFFIX))
+	if err != nil {
+		return err
+	}
+	for _, dir := range deleted {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			var valid func([]byte) bool
+			if filepath.Ext(strings.TrimSuffix(file, TEMP_SUFFIX)) == ".json" {
+				valid = json.Valid
+			}
+			err := recoverTempFile(file, valid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *FsStorage) stateFile() string {
+	return filepath.Join(s.Dir, "state.json")
+}
+
+func (s *FsStorage) revokedBearersFile() string {
+	return filepath.Join(s.Dir, "revoked_bearers.json")
+}
+
+func (s *FsStorage) usersDir() string {
+	return filepath.Join(s.Dir, "users")
+}
+
+func (s *FsStorage) userDir(id uint64) string {
+	return filepath.Join(s.usersDir(), fmt.Sprintf("%020d", id))
+}
+
+func (s *FsStorage) deviceDir(id uint64, device uint64) string {
+	return filepath.Join(s.userDir(id), "devices", strconv.FormatUint(device, 10))
+}
+
+func (s *FsStorage) inboxDir(id uint64, device uint64) string {
+	return filepath.Join(s.deviceDir(id, device), "inbox")
+}
+
+// Inbox of the user from before multi-device support
+func (s *FsStorage) legacyInboxDir(id uint64) string {
+	return filepath.Join(s.userDir(id), "inbox")
+}
+
+// Moves the legacy inbox to `LEGACY_DEVICE_ID`. Each step can be repeated,
+// so the migration finishes on the next start if it's interrupted.
+func (s *FsStorage) migrateLegacyInbox(id uint64) error {
+	legacyDir := s.legacyInboxDir(id)
+	if _, err := os.Stat(legacyDir); os.IsNotExist(err) {
+		return nil
+	}
+	dir := s.inboxDir(id, LEGACY_DEVICE_ID)
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+
+	Log.i("openInbox(): moving %s to %s", redactPath(legacyDir), redactPath(dir))
+	err := os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(legacyDir, dir)
+	if err != nil {
+		return err
+	}
+	return syncDir(s.userDir(id))
+}
+
+func (s *FsStorage) loadState() (ServerState, error) {
+	bytes, err := os.ReadFile(s.stateFile())
+	if os.IsNotExist(err) {
+		return ServerState{}, errStateNotInitialized
+	}
+	if err != nil {
+		return ServerState{}, fmt.Errorf("error reading state: %s", err)
+	}
+
+	state := ServerState{}
+	err = json.Unmarshal(bytes, &state)
+	if err != nil {
+		return ServerState{}, fmt.Errorf("error parsing state: %s", err)
+	}
+	return state, nil
+}
+
+func (s *FsStorage) saveState(state *ServerState) error {
+	jsonData, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	jsonData = append(jsonData, '\n')
+	return writeFileAtomic(s.stateFile(), jsonData, 0644)
+}
+
+func (s *FsStorage) initState(state *ServerState) error {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.saveState(state)
+}
+
+func (s *FsStorage) updateState(fn func(state *ServerState) error) error {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	state, err := s.loadState()
+	if err != nil {
+		return err
+	}
+	err = fn(&state)
+	if err != nil {
+		return err
+	}
+	return s.saveState(&state)
+}
+
+func (s *FsStorage) loadUser(id uint64) (*User, error) {
+	json_file := filepath.Join(s.userDir(id), "user.json")
+	bytes, err := os.ReadFile(json_file)
+	if os.IsNotExist(err) {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{}
+	err = json.Unmarshal(bytes, user)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Id = id
+	return user, nil
+}
+
+// There is no separate index. The usernames are read from the `user.json` files.
+// Inboxes are not touched.
+func (s *FsStorage) loadUsernames() (map[string]uint64, error) {
+	// Find all subdirs of `dir` whose name can be converted to UserID
+	topdir := s.usersDir()
+	dirs, err := os.ReadDir(topdir)
+	if err != nil {
+		return nil, err
+	}
+
+	usernames := make(map[string]uint64, len(dirs))
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			Log.i("load_users(): Not a dir: %s", dir.Name())
+			continue
+		}
+		if len(dir.Name()) != 20 {
+			Log.i("load_users(): Invalid user ID: %s", dir.Name())
+			continue
+		}
+		id, err := strconv.ParseUint(dir.Name(), 10, 64)
+		if err != nil {
+			Log.i("load_users(): Invalid user ID: %s", dir.Name())
+			continue
+		}
+		bytes, err := os.ReadFile(filepath.Join(s.userDir(id), "user.json"))
+		if err != nil {
+			Log.e("load_users(): Error loading user: %s", redactError(err))
+			continue
+		}
+		var record struct {
+			Username string `json:"username"`
+		}
+		err = json.Unmarshal(bytes, &record)
+		if err != nil {
+			Log.e("load_users(): Error loading user %s: %s", redact(dir.Name()), err.Error())
+			continue
+		}
+		usernames[record.Username] = id
+	}
+	return usernames, nil
+}
+
+func (s *FsStorage) saveUser(user *User) error {
+	jsonData, err := json.MarshalIndent(user, "", "\t")
+	if err != nil {
+		return err
+	}
+	jsonData = append(jsonData, '\n')
+
+	dir := s.userDir(user.Id)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		err = os.MkdirAll(dir, 0755)
+		if err == nil {
+			err = syncDir(s.usersDir())
+		}
+		if err != nil {
+			return fmt.Errorf("error creating user dir: %s", err.Error())
+		}
+	}
+
+	json_file := filepath.Join(dir, "user.json")
+	return writeFileAtomic(json_file, jsonData, 0644)
+}
+
+// Suffix of user dirs that are being deleted
+const DELETED_SUFFIX = ".deleted"
+
+func (s *FsStorage) deleteUser(user *User) error {
+	// Renaming is atomic, so the user is either loaded completely or not at all,
+	// even if we crash in the middle of `os.RemoveAll()`.
+	dir := s.userDir(user.Id)
+	deletedDir := dir + DELETED_SUFFIX
+	err := os.Rename(dir, deletedDir)
+	if err != nil {
+		return err
+	}
+	err = syncDir(s.usersDir())
+	if err != nil {
+		return err
+	}
+
+	// The user is gone at this point. Whatever is left is removed by `recover()`.
+	err = os.RemoveAll(deletedDir)
+	if err != nil {
+		Log.e("deleteUser(): %s", redactError(err))
+	}
+	return nil
+}
+
+func (s *FsStorage) openInbox(user *User, device uint64) (Inbox, error) {
+	if device == LEGACY_DEVICE_ID {
+		err := s.migrateLegacyInbox(user.Id)
+		if err != nil {
+			return nil, fmt.Errorf("error moving legacy inbox: %s", err.Error())
+		}
+	}
+
+	inbox, err := loadFsInbox(s.inboxDir(user.Id, device))
+	if err != nil {
+		return nil, err
+	}
+	return inbox, nil
+}
+
+func (s *FsStorage) inspectInbox(user *User, device uint64, now int64) (InboxStats, error) {
+	dir := s.inboxDir(user.Id, device)
+	if device == LEGACY_DEVICE_ID {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			dir = s.legacyInboxDir(user.Id)
+		}
+	}
+	return inspectFsInbox(dir, now)
+}
+
+func (s *FsStorage) deleteInbox(user *User, device uint64) error {
+	return os.RemoveAll(s.deviceDir(user.Id, device))
+}
+
+func (s *FsStorage) loadRevokedBearers() (RevokedBearers, error) {
+	revoked := make(RevokedBearers)
+	bytes, err := os.ReadFile(s.revokedBearersFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return revoked, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(bytes, &revoked)
+	if err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+func (s *FsStorage) saveRevokedBearers(revoked RevokedBearers) error {
+	jsonData, err := json.Marshal(revoked)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.revokedBearersFile(), jsonData, 0644)
+}
+
+func (s *FsStorage) close() error {
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sync"
+)
+
+// Keeps everything in memory, only the config is read from `CONFIG_FILE` as usual.
+// Nothing survives a restart. Meant for tests and local development.
+type MemStorage struct {
+	mutex   sync.Mutex
+	state   []byte
+	users   map[uint64][]byte
+	inboxes map[MemInboxKey]*MemInbox
+	revoked RevokedBearers
+}
+
+func newMemStorage() (*MemStorage, error) {
+	s := &MemStorage{
+		users:   make(map[uint64][]byte),
+		inboxes: make(map[MemInboxKey]*MemInbox),
+		revoked: make(RevokedBearers),
+	}
+	return s, nil
+}
+
+func (s *MemStorage) loadUsernames() (map[string]uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	usernames := make(map[string]uint64, len(s.users))
+	for id, jsonData := range s.users {
+		var record struct {
+			Username string `json:"username"`
+		}
+		err := json.Unmarshal(jsonData, &record)
+		if err != nil {
+			return nil, err
+		}
+		usernames[record.Username] = id
+	}
+	return usernames, nil
+}
+
+func (s *MemStorage) loadState() (ServerState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.unmarshalState()
+}
+
+func (s *MemStorage) unmarshalState() (ServerState, error) {
+	if s.state == nil {
+		return ServerState{}, errStateNotInitialized
+	}
+	state := ServerState{}
+	err := json.Unmarshal(s.state, &state)
+	if err != nil {
+		return ServerState{}, fmt.Errorf("error parsing state: %s", err)
+	}
+	return state, nil
+}
+
+func (s *MemStorage) initState(state *ServerState) error {
+	jsonData, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state = jsonData
+	return nil
+}
+
+func (s *MemStorage) updateState(fn func(state *ServerState) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state, err := s.unmarshalState()
+	if err != nil {
+		return err
+	}
+	err = fn(&state)
+	if err != nil {
+		return err
+	}
+	jsonData, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	s.state = jsonData
+	return nil
+}
+
+func (s *MemStorage) loadUser(id uint64) (*User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	jsonData, found := s.users[id]
+	if !found {
+		return nil, errUserNotFound
+	}
+	user := &User{}
+	err := json.Unmarshal(jsonData, user)
+	if err != nil {
+		return nil, err
+	}
+	user.Id = id
+	return user, nil
+}
+
+func (s *MemStorage) saveUser(user *User) error {
+	jsonData, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.users[user.Id] = jsonData
+	return nil
+}
+
+func (s *MemStorage) deleteUser(user *User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.users, user.Id)
+	for key := range s.inboxes {
+		if key.User == user.Id {
+			delete(s.inboxes, key)
+		}
+	}
+	return nil
+}
+
+type MemInboxKey struct {
+	User   uint64
+	Device uint64
+}
+
+func (s *MemStorage) openInbox(user *User, device uint64) (Inbox, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := MemInboxKey{User: user.Id, Device: device}
+	inbox, found := s.inboxes[key]
+	if !found {
+		inbox = &MemInbox{
+			Messages: make([]Message, 0),
+			NextSeq:  1,
+		}
+		s.inboxes[key] = inbox
+	}
+	return inbox, nil
+}
+
+func (s *MemStorage) inspectInbox(user *User, device uint64, now int64) (InboxStats, error) {
+	s.mutex.Lock()
+	inbox, found := s.inboxes[MemInboxKey{User: user.Id, Device: device}]
+	s.mutex.Unlock()
+
+	stats := InboxStats{Problems: make([]string, 0)}
+	if !found {
+		return stats, nil
+	}
+
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+	validRange := messageValidRange(now)
+	for i := range inbox.Messages {
+		// Acknowledged messages are removed right away
+		stats.count(&inbox.Messages[i], 0, validRange)
+	}
+	return stats, nil
+}
+
+func (s *MemStorage) deleteInbox(user *User, device uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.inboxes, MemInboxKey{User: user.Id, Device: device})
+	return nil
+}
+
+func (s *MemStorage) loadRevokedBearers() (RevokedBearers, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return maps.Clone(s.revoked), nil
+}
+
+func (s *MemStorage) saveRevokedBearers(revoked RevokedBearers) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.revoked = maps.Clone(revoked)
+	return nil
+}
+
+func (s *MemStorage) close() error {
+	return nil
+}
+
+type MemInbox struct {
+	// Only for `inspectInbox()`, the other methods are called by the `user_handler()` as usual
+	mutex sync.Mutex
+
+	// Sorted by `Seq`
+	Messages []Message
+
+	// `Seq` of the next message added to the inbox
+	NextSeq uint64
+}
+
+func (inbox *MemInbox) addMessages(msgs []Message) *RestAPIError {
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+	for i := range msgs {
+		msgs[i].Seq = inbox.NextSeq
+		inbox.NextSeq++
+		inbox.Messages = append(inbox.Messages, msgs[i])
+	}
+	return nil
+}
+
+func (inbox *MemInbox) getMessages(now int64) ([]Message, *RestAPIError) {
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+	validRange := messageValidRange(now)
+	inbox.Messages = filter(inbox.Messages, func(msg Message) bool {
+		return validRange.contains(msg.Time)
+	})
+
+	messages := make([]Message, 0, len(inbox.Messages))
+	for _, msg := range inbox.Messages {
+		msg.Time = now - msg.Time
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+func (inbox *MemInbox) ack(seq uint64) *RestAPIError {
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+	firstUnacked := find_first(
+		inbox.Messages,
+		func(msg Message) bool { return msg.Seq > seq },
+	)
+	inbox.Messages = shift(inbox.Messages, firstUnacked)
+	return nil
+}
+
+func (inbox *MemInbox) clear() {
+	inbox.mutex.Lock()
+	defer inbox.mutex.Unlock()
+	inbox.Messages = inbox.Messages[:0]
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// Backends that keep their data across restarts. Tests reopen the storage
+// to see what a restarted server would load.
+var persistentStorages = []string{"fs", "bolt"}
+
+type testStorage struct {
+	t    *testing.T
+	kind string
+	dir  string
+	s    Storage
+}
+
+func newTestStorage(t *testing.T, kind string) *testStorage {
+	ts := &testStorage{t: t, kind: kind, dir: t.TempDir()}
+	ts.reopen()
+	t.Cleanup(func() { ts.s.close() })
+	return ts
+}
+
+func (ts *testStorage) reopen() {
+	ts.t.Helper()
+	if ts.s != nil {
+		ts.s.close()
+	}
+	s, err := openStorage(ts.kind, ts.dir)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.s = s
+}
+
+func (ts *testStorage) inbox() Inbox {
+	ts.t.Helper()
+	inbox, err := ts.s.openInbox(&User{Id: 42}, 1)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return inbox
+}
+
+func addTestMessages(t *testing.T, inbox Inbox, now int64, payloads ...string) []uint64 {
+	t.Helper()
+	seqs := make([]uint64, 0, len(payloads))
+	for _, payload := range payloads {
+		msgs := []Message{{Time: now, From: "alice", Type: "msg", Msg: payload}}
+		if err := inbox.addMessages(msgs); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, msgs[0].Seq)
+	}
+	return seqs
+}
+
+func getTestMessages(t *testing.T, inbox interface {
+	getMessages(now int64) ([]Message, *RestAPIError)
+}, now int64) []string {
+	t.Helper()
+	msgs, err := inbox.getMessages(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messagePayloads(msgs)
+}
+
+func TestConfigFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), CONFIG_FILE)
+	cfg, err := newConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.IdleUserSec = 123
+	if err := cfg.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same with every storage backend, it isn't part of the storage
+	loaded, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.AesKey.Key, cfg.AesKey.Key) || loaded.IdleUserSec != cfg.IdleUserSec || loaded.File != file {
+		t.Errorf("loaded %+v, want %+v", loaded, cfg)
+	}
+}
+
+func TestStorageState(t *testing.T) {
+	for _, kind := range persistentStorages {
+		t.Run(kind, func(t *testing.T) {
+			ts := newTestStorage(t, kind)
+			if _, err := ts.s.loadState(); err != errStateNotInitialized {
+				t.Fatalf("new storage: %v", err)
+			}
+			err := ts.s.initState(&ServerState{LastId: 10, Invitations: []Invitation{}, UsedInvitations: []UsedInvitation{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = ts.s.updateState(func(state *ServerState) error {
+				state.LastId++
+				state.Invitations = append(state.Invitations, Invitation{Code: "abc", MaxUses: 1})
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Failed updates are not saved
+			failed := errors.New("failed")
+			err = ts.s.updateState(func(state *ServerState) error {
+				state.LastId++
+				return failed
+			})
+			if err != failed {
+				t.Fatalf("error of the update: %v", err)
+			}
+
+			ts.reopen()
+			state, err := ts.s.loadState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.LastId != 11 || len(state.Invitations) != 1 || state.Invitations[0].Code != "abc" {
+				t.Errorf("loaded %+v", state)
+			}
+		})
+	}
+}
+
+func TestInitStateFromLegacyConfig(t *testing.T) {
+	setupTest(t)
+	storage, _ = newMemStorage()
+	config.LegacyLastId = 42
+	config.LegacyInvitations = []Invitation{{Code: "abc", MaxUses: 1}}
+
+	err := initState(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := storage.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.LastId != 42 || findInvitation(state.Invitations, "abc") < 0 {
+		t.Errorf("state %+v", state)
+	}
+	if config.hasLegacyState() {
+		t.Error("legacy state left in the config")
+	}
+
+	// The state in the storage wins from now on
+	config.LegacyLastId = 1
+	err = initState(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := storage.loadState(); state.LastId != 42 {
+		t.Errorf("last_id %d", state.LastId)
+	}
+}
+
+func TestStorageUsers(t *testing.T) {
+	for _, kind := range persistentStorages {
+		t.Run(kind, func(t *testing.T) {
+			ts := newTestStorage(t, kind)
+			for i, name := range []string{"alice", "bob"} {
+				user := &User{Id: uint64(i + 1), Sn: 7, Username: name, Devices: []*Device{{Id: 1, Prekeys: []string{"k"}}}}
+				if err := ts.s.saveUser(user); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Updated in place
+			if err := ts.s.saveUser(&User{Id: 2, Sn: 8, Username: "bob", Devices: []*Device{}}); err != nil {
+				t.Fatal(err)
+			}
+
+			ts.reopen()
+			usernames, err := ts.s.loadUsernames()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(usernames, map[string]uint64{"alice": 1, "bob": 2}) {
+				t.Errorf("usernames = %v", usernames)
+			}
+			alice, err := ts.s.loadUser(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bob, err := ts.s.loadUser(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if alice.Username != "alice" || len(alice.Devices) != 1 || !slices.Equal(alice.Devices[0].Prekeys, []string{"k"}) ||
+				bob.Username != "bob" || bob.Sn != 8 || len(bob.Devices) != 0 {
+				t.Errorf("loaded %+v, %+v", alice, bob)
+			}
+			if _, err := ts.s.loadUser(3); err != errUserNotFound {
+				t.Errorf("missing user: %v", err)
+			}
+		})
+	}
+}
+
+func TestInboxAckAcrossReload(t *testing.T) {
+	for _, kind := range persistentStorages {
+		t.Run(kind, func(t *testing.T) {
+			ts := newTestStorage(t, kind)
+			now := monotonicSeconds()
+
+			seqs := addTestMessages(t, ts.inbox(), now, "a", "b", "c")
+			if !slices.Equal(seqs, []uint64{1, 2, 3}) {
+				t.Fatalf("seqs = %v", seqs)
+			}
+			if err := ts.inbox().ack(2); err != nil {
+				t.Fatal(err)
+			}
+
+			ts.reopen()
+			inbox := ts.inbox()
+			if got := getTestMessages(t, inbox, now); !slices.Equal(got, []string{"c"}) {
+				t.Errorf("after reload: %v", got)
+			}
+			if seqs := addTestMessages(t, inbox, now, "d"); seqs[0] != 4 {
+				t.Errorf("next seq = %d, want 4", seqs[0])
+			}
+		})
+	}
+}
+
+func TestInboxSeqNotReusedAfterExpiry(t *testing.T) {
+	for _, kind := range persistentStorages {
+		t.Run(kind, func(t *testing.T) {
+			ts := newTestStorage(t, kind)
+			now := int64(100 * DAY)
+
+			addTestMessages(t, ts.inbox(), now, "a", "b")
+
+			// The messages expire unacknowledged and are removed
+			later := now + MSG_EXPIRE_SEC + SWITCH_INBOX_SEC + HOUR
+			if got := getTestMessages(t, ts.inbox(), later); len(got) != 0 {
+				t.Fatalf("expired messages returned: %v", got)
+			}
+
+			ts.reopen()
+			inbox := ts.inbox()
+			seqs := addTestMessages(t, inbox, later, "c")
+			if seqs[0] != 3 {
+				t.Errorf("next seq = %d, want 3", seqs[0])
+			}
+
+			// A client still holding the cursor of the expired messages
+			if err := inbox.ack(2); err != nil {
+				t.Fatal(err)
+			}
+			if got := getTestMessages(t, inbox, later); !slices.Equal(got, []string{"c"}) {
+				t.Errorf("after late ack: %v", got)
+			}
+		})
+	}
+}
+
+func TestInboxSeqNotReusedAfterClear(t *testing.T) {
+	for _, kind := range persistentStorages {
+		t.Run(kind, func(t *testing.T) {
+			ts := newTestStorage(t, kind)
+			now := int64(100 * DAY)
+
+			addTestMessages(t, ts.inbox(), now, "a", "b")
+			ts.inbox().clear()
+
+			ts.reopen()
+			inbox := ts.inbox()
+			if got := getTestMessages(t, inbox, now); len(got) != 0 {
+				t.Errorf("cleared messages returned: %v", got)
+			}
+			if seqs := addTestMessages(t, inbox, now, "c"); seqs[0] != 3 {
+				t.Errorf("next seq = %d, want 3", seqs[0])
+			}
+		})
+	}
+}
+
+func TestInboxAckBeyondNextSeq(t *testing.T) {
+	for _, kind := range append(persistentStorages, "memory") {
+		t.Run(kind, func(t *testing.T) {
+			ts := newTestStorage(t, kind)
+			now := monotonicSeconds()
+			inbox := ts.inbox()
+
+			addTestMessages(t, inbox, now, "a")
+			// The client cannot acknowledge messages that don't exist yet
+			if err := inbox.ack(5); err != nil {
+				t.Fatal(err)
+			}
+			addTestMessages(t, inbox, now, "b")
+			if got := getTestMessages(t, inbox, now); !slices.Equal(got, []string{"b"}) {
+				t.Errorf("got %v", got)
+			}
+		})
+	}
+}
+
+func TestFsStorageRecoversUnfinishedWrites(t *testing.T) {
+	ts := newTestStorage(t, "fs")
+	if err := ts.s.saveUser(&User{Id: 1, Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	fs := ts.s.(*FsStorage)
+
+	// Crashed before the rename of an update, and while creating a new user
+	aliceFile := filepath.Join(fs.userDir(1), "user.json")
+	writeTestFile(t, aliceFile+TEMP_SUFFIX, []byte(`{"username": "al`))
+	bobFile := filepath.Join(fs.userDir(2), "user.json")
+	if err := os.MkdirAll(filepath.Dir(bobFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, bobFile+TEMP_SUFFIX, []byte(`{"id": 2, "username": "bob"}`))
+
+	ts.reopen()
+	usernames, err := ts.s.loadUsernames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(usernames, map[string]uint64{"alice": 1, "bob": 2}) {
+		t.Errorf("usernames = %v", usernames)
+	}
+	for _, file := range []string{aliceFile, bobFile} {
+		if _, err := os.Stat(file + TEMP_SUFFIX); !os.IsNotExist(err) {
+			t.Errorf("%s left behind", file+TEMP_SUFFIX)
+		}
+	}
+}
+
+func TestGenUserIdConcurrent(t *testing.T) {
+	setupTest(t)
+	ids := make(chan uint64, 20)
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := genUserId()
+			if err != nil {
+				t.Error(err)
+			}
+			ids <- id.Id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[uint64]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("ID %d assigned twice", id)
+		}
+		seen[id] = true
+	}
+}
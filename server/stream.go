@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Server-sent events endpoint. Messages are pushed to the client as soon as they arrive,
+// without waiting for the next `recv`.
+//
+// The `id` of each event is the `seq` of the message. Messages stay in the inbox until
+// the client acknowledges them, either with `/api/ack` or with the standard `Last-Event-ID`
+// header when it reconnects.
+//
+// Only one stream per device is active. A new stream supersedes the old one.
+
+type StreamRequest struct {
+	// nil to subscribe. Otherwise the subscriber to remove.
+	Unsubscribe *StreamSubscriber
+
+	// Optional acknowledgement sent when subscribing
+	Ack *uint64
+
+	Device   uint64
+	Response chan<- StreamResponse
+}
+
+type StreamResponse struct {
+	Subscriber *StreamSubscriber
+
+	// Messages that were waiting in the inbox when the stream was opened
+	Items []Message
+
+	Err *RestAPIError
+}
+
+type StreamSubscriber struct {
+	// Filled by `put_synchronized_handler()`.
+	// The `Time` field of the messages contains seconds since `referenceTime`.
+	Messages chan Message
+
+	// Closed when the subscriber is superseded by a newer stream or can't keep up
+	Done chan struct{}
+}
+
+func stream_http_handler(w http.ResponseWriter, r *http.Request) {
+	log := startRequest(w, r, "stream")
+
+	restAPIerr := limitIp(r, "stream")
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
+	user, claims, restAPIerr := authorize(r, "stream")
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
+	restAPIerr = limitBearer(claims, "stream", 1)
+	if restAPIerr != nil {
+		restAPIerror(w, restAPIerr)
+		return
+	}
+
+	var ack *uint64
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		seq, err := strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			restAPIerror(w, NewError("stream: invalid Last-Event-ID", http.StatusBadRequest))
+			return
+		}
+		ack = &seq
+	}
+
+	respChan := make(chan StreamResponse)
+	defer close(respChan)
+
+	req := StreamRequest{Ack: ack, Device: claims.Device, Response: respChan}
+	resp, ok := callUserHandler(user, user.Stream, req, respChan)
+	if !ok {
+		restAPIerror(w, errUserStopped("stream"))
+		return
+	}
+	if resp.Err != nil {
+		restAPIerror(w, resp.Err)
+		return
+	}
+	sub := resp.Subscriber
+
+	defer func() {
+		req := StreamRequest{
+			Unsubscribe: sub,
+			Device:      claims.Device,
+			Response:    respChan,
+		}
+		callUserHandler(user, user.Stream, req, respChan)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	write := func(data string) error {
+		err := rc.SetWriteDeadline(time.Now().Add(time.Duration(STREAM_WRITE_TIMEOUT_SEC) * time.Second))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte(data))
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	for _, msg := range resp.Items {
+		err := write(messageEvent(msg))
+		if err != nil {
+			log.i("stream: %s", err.Error())
+			return
+		}
+	}
+
+	// Without waiting messages, nothing would be written until the first keep-alive.
+	// Send the headers now, so the client knows the stream is open.
+	err := rc.Flush()
+	if err != nil {
+		Log.i("stream: %s", err.Error())
+		return
+	}
+
+	keepAlive := time.NewTicker(time.Duration(STREAM_KEEPALIVE_SEC) * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case msg := <-sub.Messages:
+			msg.Time = monotonicSeconds() - msg.Time
+			err := write(messageEvent(msg))
+			if err != nil {
+				log.i("stream: %s", err.Error())
+				return
+			}
+		case <-keepAlive.C:
+			err := write(": keep-alive\n\n")
+			if err != nil {
+				log.i("stream: %s", err.Error())
+				return
+			}
+		case <-sub.Done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func messageEvent(msg Message) string {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		// Cannot happen. `Message` contains only strings and numbers.
+		panic(err)
+	}
+	return fmt.Sprintf("id: %d\nevent: message\ndata: %s\n\n", msg.Seq, data)
+}
+
+func stream_synchronized_handler(user *User, req StreamRequest) StreamResponse {
+	device, err := user.deviceOrError(req.Device)
+	if req.Unsubscribe != nil {
+		if device != nil && device.Subscriber == req.Unsubscribe {
+			device.Subscriber = nil
+		}
+		return StreamResponse{}
+	}
+	if err != nil {
+		return StreamResponse{Err: err}
+	}
+
+	if device.Subscriber != nil {
+		device.dropSubscriber()
+	}
+
+	if req.Ack != nil {
+		err := device.Inbox.ack(*req.Ack)
+		if err != nil {
+			return StreamResponse{Err: err}
+		}
+	}
+
+	msgs, err := device.Inbox.getMessages(monotonicSeconds())
+	if err != nil {
+		return StreamResponse{Err: err}
+	}
+	metrics.InboxMessagesRead.add(len(msgs))
+
+	device.Subscriber = &StreamSubscriber{
+		Messages: make(chan Message, STREAM_BUFFER_SIZE),
+		Done:     make(chan struct{}),
+	}
+	return StreamResponse{
+		Subscriber: device.Subscriber,
+		Items:      msgs,
+	}
+}
+
+// Hands the message directly to the connected stream, if any
+func (device *Device) pushToSubscriber(msg Message) {
+	if device.Subscriber == nil {
+		return
+	}
+	select {
+	case device.Subscriber.Messages <- msg:
+	default:
+		// The client is not reading fast enough. Disconnect it.
+		// It will get the unacknowledged messages from the inbox when it reconnects.
+		Log.i("stream: subscriber of device %d can't keep up", device.Id)
+		device.dropSubscriber()
+	}
+}
+
+func (device *Device) dropSubscriber() {
+	close(device.Subscriber.Done)
+	device.Subscriber = nil
+}
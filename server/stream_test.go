@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Opens `/api/stream` and decodes the events. The channel is closed when the server ends the stream.
+func openTestStream(t *testing.T, server *httptest.Server, bearer Bearer, lastEventId string) <-chan Message {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+string(bearer))
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	// Before the server is closed, which waits for the stream to end
+	t.Cleanup(func() { resp.Body.Close() })
+
+	events := make(chan Message, 16)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, found := strings.CutPrefix(scanner.Text(), "data: ")
+			if !found {
+				continue
+			}
+			var msg Message
+			if json.Unmarshal([]byte(data), &msg) == nil {
+				events <- msg
+			}
+		}
+	}()
+	return events
+}
+
+func nextTestEvent(t *testing.T, events <-chan Message) Message {
+	t.Helper()
+	select {
+	case msg, ok := <-events:
+		if !ok {
+			t.Fatal("stream closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+		return Message{}
+	}
+}
+
+func newTestStreamServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(stream_http_handler))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func subscribeTestStream(t *testing.T, user *User) StreamResponse {
+	t.Helper()
+	respChan := make(chan StreamResponse)
+	user.Stream <- StreamRequest{Device: TEST_DEVICE, Response: respChan}
+	resp := <-respChan
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	return resp
+}
+
+func unsubscribeTestStream(user *User, sub *StreamSubscriber) {
+	respChan := make(chan StreamResponse)
+	user.Stream <- StreamRequest{Unsubscribe: sub, Device: TEST_DEVICE, Response: respChan}
+	<-respChan
+}
+
+func TestStreamDeliversMessages(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bearer := loginTestUser(t, alice)
+	server := newTestStreamServer(t)
+
+	putTestMessage(t, alice, "bob", "waiting")
+	events := openTestStream(t, server, bearer, "")
+	if msg := nextTestEvent(t, events); msg.Msg != "waiting" || msg.From != "bob" {
+		t.Errorf("waiting message: %+v", msg)
+	}
+
+	putTestMessage(t, alice, "bob", "live")
+	if msg := nextTestEvent(t, events); msg.Msg != "live" {
+		t.Errorf("live message: %+v", msg)
+	}
+
+	// They stay in the inbox until they are acknowledged
+	r := waitTestRecv(t, startTestRecv(alice, 0))
+	if got := messagePayloads(r.resp.Items); !slices.Equal(got, []string{"waiting", "live"}) {
+		t.Errorf("inbox: %v", got)
+	}
+}
+
+func TestStreamUnauthorized(t *testing.T) {
+	setupTest(t)
+	addTestUser(t, "alice")
+	server := newTestStreamServer(t)
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+func TestStreamSuperseded(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bearer := loginTestUser(t, alice)
+	server := newTestStreamServer(t)
+
+	first := openTestStream(t, server, bearer, "")
+	// Make sure the first stream is subscribed before the second one
+	putTestMessage(t, alice, "bob", "first")
+	ackTest(t, alice, nextTestEvent(t, first).Seq)
+
+	second := openTestStream(t, server, bearer, "")
+	select {
+	case _, ok := <-first:
+		if ok {
+			t.Error("event on the superseded stream")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("superseded stream not closed")
+	}
+
+	putTestMessage(t, alice, "bob", "second")
+	if msg := nextTestEvent(t, second); msg.Msg != "second" {
+		t.Errorf("got %+v", msg)
+	}
+}
+
+func TestStreamLastEventIdAcks(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+	bearer := loginTestUser(t, alice)
+	server := newTestStreamServer(t)
+
+	putTestMessage(t, alice, "bob", "a")
+	putTestMessage(t, alice, "bob", "b")
+	events := openTestStream(t, server, bearer, "")
+	first := nextTestEvent(t, events)
+	nextTestEvent(t, events)
+
+	// Reconnecting after the first event was processed
+	events = openTestStream(t, server, bearer, strconv.FormatUint(first.Seq, 10))
+	if msg := nextTestEvent(t, events); msg.Msg != "b" {
+		t.Errorf("after reconnect: %+v", msg)
+	}
+}
+
+func TestStreamSlowSubscriberDropped(t *testing.T) {
+	setupTest(t)
+	alice := addTestUser(t, "alice")
+
+	sub := subscribeTestStream(t, alice).Subscriber
+	for i := 0; i <= STREAM_BUFFER_SIZE; i++ {
+		putTestMessage(t, alice, "bob", "m")
+	}
+	select {
+	case <-sub.Done:
+	default:
+		t.Fatal("subscriber not dropped")
+	}
+
+	// As the stream handler does when it sees `Done`. The client gets the messages
+	// from the inbox when it reconnects.
+	unsubscribeTestStream(alice, sub)
+	r := waitTestRecv(t, startTestRecv(alice, 0))
+	if len(r.resp.Items) != STREAM_BUFFER_SIZE+1 {
+		t.Errorf("%d messages in the inbox", len(r.resp.Items))
+	}
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
-	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type UserID struct {
@@ -82,27 +82,71 @@ type User struct {
 	Salt     Base64Bytes `json:"salt"`   // salt for password hashing
 	Passwd   Base64Bytes `json:"passwd"` // hashed password
 
-	// TODO - bearer should be verified with signature, we shouldn't store it
-	Bearer Bearer `json:"bearer"`
-
-	SigningKey string `json:"sign_key"`   // public key for signing
-	MasterKey  string `json:"master_key"` // master public key for diffie-hellman key exchange
-
-	Prekeys     []string                `json:"prekeys"` // public keys for diffie-hellman key exchange
-	Inbox       Inbox                   `json:"-"`
-	Login       chan LoginRequest       `json:"-"`
-	Put         chan PutRequest         `json:"-"`
-	Recv        chan RecvRequest        `json:"-"`
-	UserInfo    chan UserInfoRequest    `json:"-"`
-	FetchPrekey chan FetchPrekeyRequest `json:"-"`
-	AddPrekeys  chan AddPrekeysRequest  `json:"-"`
+	// nil for passwords hashed before the parameters were recorded
+	PasswdHash *PasswdHashParams `json:"passwd_hash,omitempty"`
+
+	// Bearers issued before this time are rejected. Set when the password changes.
+	// Seconds since `referenceTime`.
+	// Written only by `user_handler()`, but read by `authorize()`, so use atomic access.
+	BearersValidAfter int64 `json:"bearers_valid_after"`
+
+	// Set by `loky disable`. Disabled users cannot log in.
+	Disabled bool `json:"disabled,omitempty"`
+
+	Devices      []*Device `json:"devices"`
+	NextDeviceId uint64    `json:"next_device_id"`
+
+	// Stored by versions without multi-device support. See `migrateLegacyDevice()`.
+	LegacySigningKey string   `json:"sign_key,omitempty"`
+	LegacyMasterKey  string   `json:"master_key,omitempty"`
+	LegacyPrekeys    []string `json:"prekeys,omitempty"`
+
+	Login         chan LoginRequest         `json:"-"`
+	Put           chan PutRequest           `json:"-"`
+	Recv          chan RecvRequest          `json:"-"`
+	UserInfo      chan UserInfoRequest      `json:"-"`
+	FetchPrekey   chan FetchPrekeyRequest   `json:"-"`
+	AddPrekeys    chan AddPrekeysRequest    `json:"-"`
+	Stream        chan StreamRequest        `json:"-"`
+	Ack           chan AckRequest           `json:"-"`
+	NeedPrekeys   chan NeedPrekeysRequest   `json:"-"`
+	ChangePasswd  chan ChangePasswdRequest  `json:"-"`
+	DeleteAccount chan DeleteAccountRequest `json:"-"`
+	Evict         chan EvictRequest         `json:"-"`
+	Admin         chan AdminRequest         `json:"-"`
+
+	// Last time the user was returned by `getUser()`. Seconds since `referenceTime`.
+	// Accessed atomically.
+	LastAccess int64 `json:"-"`
+
+	// Closed by `stop()` to ask `user_handler()` to exit
+	Quit     chan struct{} `json:"-"`
+	stopOnce sync.Once
+
+	// Closed when `user_handler()` stops. Requests must not be sent after that.
+	// See `callUserHandler()`.
+	Done chan struct{} `json:"-"`
 }
 
-func (user *User) needPrekeys() bool {
-	return len(user.Prekeys) < PREKEY_COUNT
+// Running `user_handler()` goroutines. See `stopUserHandlers()`.
+var userHandlers sync.WaitGroup
+
+func startUserHandler(user *User) {
+	userHandlers.Add(1)
+	metrics.UserHandlers.inc()
+	go func() {
+		defer userHandlers.Done()
+		defer metrics.UserHandlers.dec()
+		user_handler(user)
+	}()
 }
 
+// Runs until the account is deleted, the user is evicted or `stop()` is called.
+// Each request is handled completely before the next one is taken, so stopping
+// never cuts off a write in the middle.
 func user_handler(user *User) {
+	defer close(user.Done)
+	defer user.unload()
 	for {
 		select {
 		case login := <-user.Login:
@@ -110,38 +154,124 @@ func user_handler(user *User) {
 		case put := <-user.Put:
 			put.Response <- put_synchronized_handler(user, put)
 		case recv := <-user.Recv:
-			recv.Response <- recv_synchronized_handler(user)
+			recv.Response <- recv_synchronized_handler(user, recv)
 		case userInfo := <-user.UserInfo:
 			userInfo.Response <- userInfo_synchronized_handler(user)
 		case fetchPrekey := <-user.FetchPrekey:
 			fetchPrekey.Response <- fetchPrekey_synchronized_handler(user, fetchPrekey)
 		case addPrekeys := <-user.AddPrekeys:
 			addPrekeys.Response <- addPrekeys_synchronized_handler(user, addPrekeys)
+		case stream := <-user.Stream:
+			stream.Response <- stream_synchronized_handler(user, stream)
+		case ack := <-user.Ack:
+			ack.Response <- ack_synchronized_handler(user, ack)
+		case needPrekeys := <-user.NeedPrekeys:
+			needPrekeys.Response <- needPrekeys_synchronized_handler(user, needPrekeys)
+		case changePasswd := <-user.ChangePasswd:
+			changePasswd.Response <- changePasswd_synchronized_handler(user, changePasswd)
+		case deleteAccount := <-user.DeleteAccount:
+			resp := deleteAccount_synchronized_handler(user, deleteAccount)
+			deleteAccount.Response <- resp
+			if resp.Err == nil {
+				return
+			}
+		case evict := <-user.Evict:
+			evicted := user.tryEvict(evict.IdleBefore)
+			evict.Response <- evicted
+			if evicted {
+				return
+			}
+		case admin := <-user.Admin:
+			resp := admin_synchronized_handler(user, admin)
+			admin.Response <- resp
+			if admin.Op == ADMIN_OP_DELETE && resp.Err == nil {
+				return
+			}
+		case <-user.Quit:
+			user.disconnectDevices()
+			return
 		}
 	}
 }
 
-func usersDir() string {
-	return filepath.Join(config.appPath(), "users")
+// Hands the request to the `user_handler()` of the user and waits for the response.
+// Returns false if the handler has stopped, e.g., because the account was deleted
+// or the user was evicted.
+func callUserHandler[Request any, Response any](
+	user *User,
+	requests chan<- Request,
+	req Request,
+	responses <-chan Response,
+) (Response, bool) {
+	return callUserHandlerContext(context.Background(), user, requests, req, responses)
+}
+
+// Like `callUserHandler()`, but also returns false if `ctx` is done before the handler
+// takes the request. Once it has taken the request, waits for the response.
+func callUserHandlerContext[Request any, Response any](
+	ctx context.Context,
+	user *User,
+	requests chan<- Request,
+	req Request,
+	responses <-chan Response,
+) (Response, bool) {
+	start := time.Now()
+	select {
+	case requests <- req:
+		observeQueueWait[Request](start)
+		return <-responses, true
+	case <-user.Done:
+		var resp Response
+		return resp, false
+	case <-ctx.Done():
+		var resp Response
+		return resp, false
+	}
+}
+
+// Asks `user_handler()` to exit and waits until it does.
+// Requests sent afterwards fail, see `callUserHandler()`.
+func (user *User) stop() {
+	user.stopOnce.Do(func() {
+		close(user.Quit)
+	})
+	<-user.Done
 }
 
-func (user *User) userDir() string {
-	return filepath.Join(usersDir(), fmt.Sprintf("%020d", user.Id))
+// Stops the `user_handler()` of every loaded user. No users are loaded afterwards.
+func stopUserHandlers() {
+	loadedUsers.mutex.Lock()
+	loadedUsers.closed = true
+	users := make([]*User, 0, len(loadedUsers.users))
+	for _, user := range loadedUsers.users {
+		users = append(users, user)
+	}
+	loadedUsers.mutex.Unlock()
+
+	for _, user := range users {
+		user.stop()
+	}
+	userHandlers.Wait()
 }
 
-func (user *User) inboxDir() string {
-	return filepath.Join(user.userDir(), "inbox")
+// Releases parked `recv` requests and event streams of all devices
+func (user *User) disconnectDevices() {
+	for _, device := range user.Devices {
+		device.disconnect()
+	}
 }
 
+// Index of all users: username <-> user ID.
+// The users themselves are loaded when they are first needed, see `getUser()`.
 type Users struct {
-	name_map map[string]*User
-	id_map   map[uint64]*User
+	name_map map[string]uint64
+	id_map   map[uint64]string
 }
 
 func newUsers() *Users {
 	return &Users{
-		name_map: make(map[string]*User),
-		id_map:   make(map[uint64]*User),
+		name_map: make(map[string]uint64),
+		id_map:   make(map[uint64]string),
 	}
 }
 
@@ -153,114 +283,255 @@ func newUsers() *Users {
 // Modifying user data still requires synchronization.
 var usersList atomic.Pointer[Users]
 
+func (users *Users) hasName(name string) bool {
+	_, found := users.name_map[name]
+	return found
+}
+
+func (users *Users) hasId(id uint64) bool {
+	_, found := users.id_map[id]
+	return found
+}
+
 func (users *Users) userByName(name string) *User {
-	user, found := users.name_map[name]
+	id, found := users.name_map[name]
 	if !found {
 		return nil
 	}
-	return user
+	return getUser(id)
 }
 
 func (users *Users) userById(id UserID) *User {
-	user, found := users.id_map[id.Id]
-	if !found || user.Sn != id.Sn {
+	// Don't touch the storage for IDs that don't exist
+	if !users.hasId(id.Id) {
+		return nil
+	}
+	user := getUser(id.Id)
+	if user == nil || user.Sn != id.Sn {
 		return nil
 	}
 	return user
 }
 
 func (users *Users) shallow_clone() *Users {
-	users_clone := &Users{
-		name_map: make(map[string]*User),
-		id_map:   make(map[uint64]*User),
-	}
-	for id, user := range users.id_map {
-		users_clone.name_map[user.Username] = user
-		users_clone.id_map[id] = user
+	users_clone := newUsers()
+	for id, name := range users.id_map {
+		users_clone.name_map[name] = id
+		users_clone.id_map[id] = name
 	}
 	return users_clone
 }
 
-func load_user(id uint64, dir string) (*User, error) {
-	json_file := filepath.Join(dir, "user.json")
-	bytes, err := os.ReadFile(json_file)
-	if err != nil {
-		return nil, err
+// Users whose `user_handler()` is running
+type LoadedUsers struct {
+	mutex sync.Mutex
+	users map[uint64]*User
+
+	// Users that are being loaded from the storage, see `getUser()`
+	loading map[uint64]*UserLoad
+
+	// Set when shutting down. No more users are loaded.
+	closed bool
+}
+
+// A user being loaded. Others who need the user wait for `Done` instead of loading it again.
+type UserLoad struct {
+	Done chan struct{}
+
+	// Only valid after `Done` is closed. nil if the user cannot be loaded.
+	User *User
+}
+
+var loadedUsers = LoadedUsers{
+	users:   make(map[uint64]*User),
+	loading: make(map[uint64]*UserLoad),
+}
+
+// Returns the user, loading it from the storage and starting its `user_handler()` if needed.
+// Returns nil if the user doesn't exist or cannot be loaded.
+//
+// The storage isn't read with `loadedUsers.mutex` held, so loading one user doesn't hold up
+// requests for the others.
+func getUser(id uint64) *User {
+	loadedUsers.mutex.Lock()
+	if loadedUsers.closed {
+		loadedUsers.mutex.Unlock()
+		return nil
+	}
+
+	user, found := loadedUsers.users[id]
+	if found {
+		// Keeps the user from being evicted, see `tryEvict()`
+		atomic.StoreInt64(&user.LastAccess, monotonicSeconds())
+		loadedUsers.mutex.Unlock()
+		return user
+	}
+
+	load, found := loadedUsers.loading[id]
+	if found {
+		loadedUsers.mutex.Unlock()
+		<-load.Done
+		if load.User == nil {
+			return nil
+		}
+		// Marks it as accessed, or loads it again if it was evicted in the meantime
+		return getUser(id)
+	}
+
+	load = &UserLoad{Done: make(chan struct{})}
+	loadedUsers.loading[id] = load
+	loadedUsers.mutex.Unlock()
+
+	user, err := loadUser(id)
+	if err != nil && err != errUserNotFound {
+		Log.e("getUser(): Error loading user %s: %s", redactId(id), redactError(err))
 	}
 
-	user := &User{}
-	err = json.Unmarshal(bytes, user)
+	loadedUsers.mutex.Lock()
+	defer loadedUsers.mutex.Unlock()
+
+	delete(loadedUsers.loading, id)
+	if user != nil && !loadedUsers.closed {
+		loadedUsers.users[id] = user
+		atomic.StoreInt64(&user.LastAccess, monotonicSeconds())
+		startUserHandler(user)
+		load.User = user
+	}
+	close(load.Done)
+	return load.User
+}
+
+func loadUser(id uint64) (*User, error) {
+	user, err := storage.loadUser(id)
 	if err != nil {
 		return nil, err
 	}
-
-	user.Id = id
-	user.EncryptedID = UserID{Id: id, Sn: user.Sn}.encrypt()
-	err = user.loadInbox()
+	err = user.init()
 	if err != nil {
 		return nil, err
 	}
+	Log.d("User loaded: %s, ID: %020d, SN: %020d, encID: %s", user.Username, user.Id, user.Sn, user.EncryptedID.toString())
+	return user, nil
+}
+
+// Called when `user_handler()` exits
+func (user *User) unload() {
+	loadedUsers.mutex.Lock()
+	defer loadedUsers.mutex.Unlock()
+
+	if loadedUsers.users[user.Id] == user {
+		delete(loadedUsers.users, user.Id)
+	}
+}
+
+// Unloads the user if it hasn't been accessed since `idleBefore` and no device is waiting
+// for messages. Called from `user_handler()`, which exits if this returns true.
+//
+// Whoever got the user from `getUser()` after `idleBefore` can rely on it not being evicted.
+func (user *User) tryEvict(idleBefore int64) bool {
+	for _, device := range user.Devices {
+		if device.RecvWaiter != nil || device.Subscriber != nil {
+			return false
+		}
+	}
+
+	loadedUsers.mutex.Lock()
+	defer loadedUsers.mutex.Unlock()
+
+	if atomic.LoadInt64(&user.LastAccess) >= idleBefore {
+		return false
+	}
+	delete(loadedUsers.users, user.Id)
+	Log.d("User evicted: %s", user.Username)
+	return true
+}
+
+type EvictRequest struct {
+	IdleBefore int64
+	Response   chan<- bool
+}
+
+// Periodically unloads users that haven't been accessed for `config.IdleUserSec`.
+// Runs until the server shuts down.
+func evictIdleUsers() {
+	idleSec := config.IdleUserSec
+	ticker := time.NewTicker(time.Duration(max(idleSec/4, 1)) * time.Second)
+	defer ticker.Stop()
+
+	respChan := make(chan bool)
+	defer close(respChan)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-serverCtx.Done():
+			return
+		}
+
+		idleBefore := monotonicSeconds() - idleSec
+		candidates := make([]*User, 0)
+		loadedUsers.mutex.Lock()
+		for _, user := range loadedUsers.users {
+			if atomic.LoadInt64(&user.LastAccess) < idleBefore {
+				candidates = append(candidates, user)
+			}
+		}
+		loadedUsers.mutex.Unlock()
+
+		for _, user := range candidates {
+			req := EvictRequest{IdleBefore: idleBefore, Response: respChan}
+			callUserHandler(user, user.Evict, req, respChan)
+		}
+	}
+}
+
+// Prepares a user record loaded from the storage (or a newly created one) for use
+func (user *User) init() error {
+	user.EncryptedID = UserID{Id: user.Id, Sn: user.Sn}.encrypt()
+
+	user.migrateLegacyDevice()
+	for _, device := range user.Devices {
+		inbox, err := storage.openInbox(user, device.Id)
+		if err != nil {
+			return err
+		}
+		device.Inbox = newQuotaInbox(inbox)
+	}
+
 	user.Login = make(chan LoginRequest)
 	user.Put = make(chan PutRequest)
 	user.Recv = make(chan RecvRequest)
 	user.UserInfo = make(chan UserInfoRequest)
 	user.FetchPrekey = make(chan FetchPrekeyRequest)
 	user.AddPrekeys = make(chan AddPrekeysRequest)
-	return user, nil
+	user.Stream = make(chan StreamRequest)
+	user.Ack = make(chan AckRequest)
+	user.NeedPrekeys = make(chan NeedPrekeysRequest)
+	user.ChangePasswd = make(chan ChangePasswdRequest)
+	user.DeleteAccount = make(chan DeleteAccountRequest)
+	user.Evict = make(chan EvictRequest)
+	user.Admin = make(chan AdminRequest)
+	user.Quit = make(chan struct{})
+	user.Done = make(chan struct{})
+	return nil
 }
 
 func (user *User) save() error {
-	jsonData, err := json.MarshalIndent(user, "", "\t")
-	if err != nil {
-		return err
-	}
-	jsonData = append(jsonData, '\n')
-
-	json_file := filepath.Join(user.userDir(), "user.json")
-	err = os.WriteFile(json_file, jsonData, 0644)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return storage.saveUser(user)
 }
 
 func load_users() (*Users, error) {
-	// Find all subdirs of `dir` whose name can be converted to UserID
-	topdir := usersDir()
-	dirs, err := os.ReadDir(topdir)
+	usernames, err := storage.loadUsernames()
 	if err != nil {
 		return nil, err
 	}
 
 	users := newUsers()
-	for _, dir := range dirs {
-		if !dir.IsDir() {
-			Log.i("load_users(): Not a dir: %s", dir.Name())
-			continue
-		}
-		if len(dir.Name()) != 20 {
-			Log.i("load_users(): Invalid user ID: %s", dir.Name())
-			continue
-		}
-		id, err := strconv.ParseUint(dir.Name(), 10, 64)
-		if err != nil {
-			Log.i("load_users(): Invalid user ID: %s", dir.Name())
-			continue
-		}
-		userDir := filepath.Join(topdir, dir.Name())
-		user, err := load_user(id, userDir)
-		if err != nil {
-			Log.e("load_users(): Error loading user: %s", err.Error())
-			continue
-		}
-		users.name_map[user.Username] = user
-		users.id_map[id] = user
-
-		sn := user.Sn
-		encID := UserID{Id: id, Sn: sn}.encrypt().toString()
-		Log.i("User loaded: %s, ID: %020d, SN: %020d, encID: %s", user.Username, id, sn, encID)
+	for name, id := range usernames {
+		users.name_map[name] = id
+		users.id_map[id] = name
 	}
+	Log.i("Users in index: %d", len(users.id_map))
 	return users, nil
 }
 
@@ -270,47 +541,24 @@ func addUser(users *Users, username string, passwd []byte) (*Users, error) {
 		return nil, fmt.Errorf("user name %s already exists", username)
 	}
 
-	salt, err := randBytes(16)
-	if err != nil {
-		return nil, fmt.Errorf("error generating salt: %s", err.Error())
-	}
-
-	hashed_passwd := __hash_passwd(passwd, salt)
-
-	id, err := config.genId()
+	id, err := genUserId()
 	if err != nil {
 		return nil, fmt.Errorf("error generating user ID: %s", err.Error())
 	}
 
 	user := &User{
-		Id:          id.Id,
-		Sn:          id.Sn,
-		EncryptedID: id.encrypt(),
+		Id: id.Id,
+		Sn: id.Sn,
 
 		Username: username,
-		Salt:     salt,
-		Passwd:   hashed_passwd,
-
-		Bearer: "",
-
-		SigningKey: "",
-		MasterKey:  "",
 
-		Prekeys:     make([]string, 0),
-		Inbox:       Inbox{},
-		Login:       make(chan LoginRequest),
-		Put:         make(chan PutRequest),
-		Recv:        make(chan RecvRequest),
-		UserInfo:    make(chan UserInfoRequest),
-		FetchPrekey: make(chan FetchPrekeyRequest),
-		AddPrekeys:  make(chan AddPrekeysRequest),
+		Devices:      make([]*Device, 0),
+		NextDeviceId: 1,
 	}
-	user.Inbox = newInbox(user)
 
-	// mkdir
-	err = os.MkdirAll(user.inboxDir(), 0755)
+	err = user.set_passwd(passwd)
 	if err != nil {
-		return nil, fmt.Errorf("error creating user dir: %s", err.Error())
+		return nil, fmt.Errorf("error hashing password: %s", err.Error())
 	}
 
 	err = user.save()
@@ -318,11 +566,28 @@ func addUser(users *Users, username string, passwd []byte) (*Users, error) {
 		return nil, fmt.Errorf("error saving user: %s", err.Error())
 	}
 
+	err = user.init()
+	if err != nil {
+		return nil, fmt.Errorf("error creating inbox: %s", err.Error())
+	}
+
 	newUsers := users.shallow_clone()
-	newUsers.name_map[username] = user
-	newUsers.id_map[id.Id] = user
+	newUsers.name_map[username] = user.Id
+	newUsers.id_map[user.Id] = username
 
-	go user_handler(user)
+	loadedUsers.mutex.Lock()
+	loadedUsers.users[user.Id] = user
+	atomic.StoreInt64(&user.LastAccess, monotonicSeconds())
+	startUserHandler(user)
+	loadedUsers.mutex.Unlock()
 
 	return newUsers, nil
 }
+
+// Returns a copy of `users` without `user`. Like `addUser()`, it doesn't modify `users`.
+func removeUser(users *Users, user *User) *Users {
+	newUsers := users.shallow_clone()
+	delete(newUsers.name_map, user.Username)
+	delete(newUsers.id_map, user.Id)
+	return newUsers
+}
@@ -15,14 +15,25 @@ type UserInfoRequest struct {
 }
 
 type UserInfoResponse struct {
-	Id         string `json:"id"`
+	Id string `json:"id"`
+
+	// Keys of the device that logged in most recently.
+	// For clients that don't know about devices.
 	SigningKey string `json:"sign_key"`   // public key for signing
 	MasterKey  string `json:"master_key"` // master public key for diffie-hellman key exchange
 
+	Devices []DeviceInfo `json:"devices"`
+
 	Err *RestAPIError `json:"-"`
 }
 
-func userInfo_restAPI_handler(_ *User, req UserInfoRequest) (UserInfoResponse, *RestAPIError) {
+type DeviceInfo struct {
+	Id         uint64 `json:"id"`
+	SigningKey string `json:"sign_key"`
+	MasterKey  string `json:"master_key"`
+}
+
+func userInfo_restAPI_handler(_ *User, _ uint64, req UserInfoRequest) (UserInfoResponse, *RestAPIError) {
 	// The `user` we've got as a param is the user asking the info,
 	// not the user we're asking about.
 	// So get the right user from the list.
@@ -37,8 +48,10 @@ func userInfo_restAPI_handler(_ *User, req UserInfoRequest) (UserInfoResponse, *
 	req.Response = respChan
 
 	// Writing to this channel will result in a call to the synchronized handler
-	user.UserInfo <- req
-	resp := <-respChan
+	resp, ok := callUserHandler(user, user.UserInfo, req, respChan)
+	if !ok {
+		return UserInfoResponse{}, NewError("User not found", http.StatusNotFound)
+	}
 
 	return resp, resp.Err
 }
@@ -46,9 +59,20 @@ func userInfo_restAPI_handler(_ *User, req UserInfoRequest) (UserInfoResponse, *
 // The synchronized handler is called from `user_handler()` and is synchronized
 // so that only one thread at a time can access the user's data.
 func userInfo_synchronized_handler(user *User) UserInfoResponse {
-	return UserInfoResponse{
-		Id:         user.EncryptedID.toString(),
-		SigningKey: user.SigningKey,
-		MasterKey:  user.MasterKey,
+	resp := UserInfoResponse{
+		Id:      user.EncryptedID.toString(),
+		Devices: make([]DeviceInfo, 0, len(user.Devices)),
+	}
+	if last := user.lastDevice(); last != nil {
+		resp.SigningKey = last.SigningKey
+		resp.MasterKey = last.MasterKey
+	}
+	for _, device := range user.Devices {
+		resp.Devices = append(resp.Devices, DeviceInfo{
+			Id:         device.Id,
+			SigningKey: device.SigningKey,
+			MasterKey:  device.MasterKey,
+		})
 	}
+	return resp
 }
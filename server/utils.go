@@ -5,7 +5,8 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -81,33 +82,6 @@ func (b *Base64Bytes) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-type Bearer string
-
-func makeBearer(id EncryptedID) (Bearer, error) {
-	token, err := randBytes(16)
-	if err != nil {
-		return "", err
-	}
-
-	bearer := fmt.Sprintf("%s.%s", id.toString(), base64Encode(token))
-
-	return Bearer(bearer), nil
-}
-
-func (bearer Bearer) toUserID() (UserID, error) {
-	parts := strings.Split(string(bearer), ".")
-	if len(parts) != 2 {
-		return UserID{}, fmt.Errorf("invalid bearer string: %s", bearer)
-	}
-
-	encId, err := encryptedIDfromString(parts[0])
-	if err != nil {
-		return UserID{}, err
-	}
-
-	return encId.decrypt(), nil
-}
-
 func find_first[T any](slice []T, predicate func(T) bool) int {
 	for i, v := range slice {
 		if predicate(v) {
@@ -134,3 +108,98 @@ func shift[T any](slice []T, n int) []T {
 	}
 	return slice[:L-n]
 }
+
+// Removes items that don't satisfy the predicate. Modifies the slice in place.
+func filter[T any](slice []T, predicate func(T) bool) []T {
+	n := 0
+	for _, v := range slice {
+		if predicate(v) {
+			slice[n] = v
+			n++
+		}
+	}
+	var empty T
+	for i := n; i < len(slice); i++ {
+		slice[i] = empty
+	}
+	return slice[:n]
+}
+
+const TEMP_SUFFIX = ".tmp"
+
+// Replaces the content of `file` so that after a crash, the file contains either the old
+// or the new data, never a mix of both.
+//
+// The data is written to a temporary file, flushed to disk and renamed over the original.
+// A temporary file left behind by a crash is cleaned up by `recoverTempFile()`.
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp := file + TEMP_SUFFIX
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, file)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(filepath.Dir(file))
+}
+
+// Makes sure that a rename or a new file in the directory survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Deals with a temporary file left behind by `writeFileAtomic()` when the server crashed.
+//
+// If the original file exists, the rename didn't happen and the original still contains
+// the old data. The temporary file is removed.
+// If there is no original, it was being created. The temporary file is moved in place
+// if `valid` accepts its content, otherwise it's removed.
+func recoverTempFile(tmp string, valid func([]byte) bool) error {
+	file := strings.TrimSuffix(tmp, TEMP_SUFFIX)
+
+	_, err := os.Stat(file)
+	if err == nil {
+		Log.w("Removing unfinished write: %s", redactPath(tmp))
+		return os.Remove(tmp)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	data, err := os.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+	if valid == nil || !valid(data) {
+		Log.w("Removing incomplete file: %s", redactPath(tmp))
+		return os.Remove(tmp)
+	}
+
+	Log.w("Recovering %s from %s", redactPath(file), redactPath(tmp))
+	err = os.Rename(tmp, file)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(file))
+}
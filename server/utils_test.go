@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readTestFile(t *testing.T, file string) string {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "data.json")
+	for _, content := range []string{"old", "new"} {
+		err := writeFileAtomic(file, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestFile(t, file); got != content {
+			t.Errorf("content = %q, want %q", got, content)
+		}
+	}
+	if _, err := os.Stat(file + TEMP_SUFFIX); !os.IsNotExist(err) {
+		t.Error("temporary file left behind")
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %s", info.Mode())
+	}
+}
+
+func TestRecoverTempFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string // empty if there is none
+		tmp      string
+		want     string // empty if the file shouldn't exist
+	}{
+		{"rename didn't happen", `{"v": 1}`, `{"v": 2}`, `{"v": 1}`},
+		{"new file", "", `{"v": 2}`, `{"v": 2}`},
+		{"torn new file", "", `{"v": `, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "data.json")
+			if test.original != "" {
+				writeTestFile(t, file, []byte(test.original))
+			}
+			writeTestFile(t, file+TEMP_SUFFIX, []byte(test.tmp))
+
+			err := recoverTempFile(file+TEMP_SUFFIX, json.Valid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(file + TEMP_SUFFIX); !os.IsNotExist(err) {
+				t.Error("temporary file left behind")
+			}
+			if test.want == "" {
+				if _, err := os.Stat(file); !os.IsNotExist(err) {
+					t.Error("file created from an incomplete write")
+				}
+				return
+			}
+			if got := readTestFile(t, file); got != test.want {
+				t.Errorf("content = %q, want %q", got, test.want)
+			}
+		})
+	}
+}